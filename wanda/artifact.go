@@ -2,8 +2,13 @@ package wanda
 
 import (
 	"fmt"
+	"log"
+	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Artifact defines a file or directory to extract from a built image.
@@ -19,6 +24,27 @@ type Artifact struct {
 	// Optional marks this artifact as best-effort.
 	// If true, extraction failure will be logged but won't fail the build.
 	Optional bool `yaml:"optional,omitempty"`
+
+	// Mode is the octal file mode (e.g. "0644") to set on the extracted
+	// files. If empty, files keep their mode in the image.
+	Mode string `yaml:"mode,omitempty"`
+}
+
+// isGlob reports whether Src is a glob pattern, such as
+// "/home/ray/.whl/*.whl". All the matching files and directories are
+// extracted into the Dst directory.
+func (a *Artifact) isGlob() bool { return isFilePathGlob(a.Src) }
+
+// fileMode returns the parsed Mode, and false if Mode is not set.
+func (a *Artifact) fileMode() (os.FileMode, bool, error) {
+	if a.Mode == "" {
+		return 0, false, nil
+	}
+	mode, err := strconv.ParseUint(a.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, false, fmt.Errorf("artifact mode must be octal permission bits: %q", a.Mode)
+	}
+	return os.FileMode(mode), true, nil
 }
 
 // Validate checks that the artifact paths are safe.
@@ -28,6 +54,24 @@ func (a *Artifact) Validate() error {
 	if !strings.HasPrefix(a.Src, "/") {
 		return fmt.Errorf("artifact src must be absolute path: %q", a.Src)
 	}
+	if a.isGlob() {
+		for _, seg := range strings.Split(path.Clean(a.Src), "/") {
+			if seg == "**" {
+				return fmt.Errorf("artifact src cannot use \"**\": %q", a.Src)
+			}
+			if _, err := path.Match(seg, ""); err != nil {
+				return fmt.Errorf("artifact src is not a valid pattern: %q", a.Src)
+			}
+		}
+		// Matches are found by copying the directory of the glob out of
+		// the container, which would be the whole file system.
+		if root, _ := globRoot(path.Clean(a.Src)); root == "/" {
+			return fmt.Errorf("artifact src glob must be under a directory other than /: %q", a.Src)
+		}
+	}
+	if _, _, err := a.fileMode(); err != nil {
+		return err
+	}
 
 	if filepath.IsAbs(a.Dst) {
 		return fmt.Errorf("artifact dst must be relative path: %q", a.Dst)
@@ -67,3 +111,45 @@ func (a *Artifact) ResolveDst(artifactsDir string) (string, error) {
 
 	return resolved, nil
 }
+
+// prepareArtifactsDir creates ArtifactsDir, and returns its path. In RayCI
+// mode, it is cleared first to avoid stale artifacts.
+func (f *Forge) prepareArtifactsDir() (string, error) {
+	artifactsDir := f.config.ArtifactsDir
+
+	if f.config.RayCI {
+		if err := os.RemoveAll(artifactsDir); err != nil {
+			return "", fmt.Errorf("clear artifacts dir: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(artifactsDir, 0755); err != nil {
+		return "", fmt.Errorf("create artifacts dir: %w", err)
+	}
+	return artifactsDir, nil
+}
+
+// resolveArtifact validates a, and returns its destination in
+// artifactsDir, creating the parent directory.
+func resolveArtifact(a *Artifact, artifactsDir string) (string, error) {
+	if err := a.Validate(); err != nil {
+		return "", fmt.Errorf("invalid artifact: %w", err)
+	}
+
+	dst, err := a.ResolveDst(artifactsDir)
+	if err != nil {
+		return "", fmt.Errorf("resolve artifact dst: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", fmt.Errorf("create dir for artifact %s: %w", a.Dst, err)
+	}
+	return dst, nil
+}
+
+func logExtracted(extracted []string, d time.Duration) {
+	log.Printf("extracted %d artifact(s) in %v:", len(extracted), d.Round(time.Millisecond))
+	for _, f := range extracted {
+		log.Printf("  %s", f)
+	}
+}
@@ -0,0 +1,229 @@
+package wanda
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// artifactsManifestFile is the file in the artifacts directory that lists
+// every extracted file.
+const artifactsManifestFile = "artifacts.json"
+
+// artifactRecord describes an extracted artifact file in the manifest.
+type artifactRecord struct {
+	Path   string `json:"path"` // Relative to the artifacts directory.
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+
+	Spec    string `json:"spec"`
+	Image   string `json:"image"`
+	ImageID string `json:"image_id,omitempty"` // Config digest of the image.
+
+	// ImageDigest is the image pinned by its manifest digest, as
+	// "repo@sha256:...", which can be pulled. Empty if the image was not
+	// pushed.
+	ImageDigest string `json:"image_digest,omitempty"`
+}
+
+func absPaths(paths []string) []string {
+	abs := make([]string, len(paths))
+	for i, p := range paths {
+		abs[i] = p
+		if a, err := filepath.Abs(p); err == nil {
+			abs[i] = a
+		}
+	}
+	return abs
+}
+
+// walkArtifactFiles calls fn for each regular file at or under the given
+// extracted paths. Symlinks are not followed.
+func walkArtifactFiles(paths []string, fn func(file string, info fs.FileInfo) error) error {
+	for _, p := range paths {
+		err := filepath.Walk(p, func(file string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			return fn(file, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyArtifactMode sets the mode of the artifact on the files extracted to
+// outputs, if it has one.
+func applyArtifactMode(a *Artifact, outputs []string) error {
+	mode, ok, err := a.fileMode()
+	if err != nil || !ok {
+		return err
+	}
+	return walkArtifactFiles(outputs, func(file string, _ fs.FileInfo) error {
+		if err := os.Chmod(file, mode); err != nil {
+			return fmt.Errorf("set mode of artifact %s: %w", a.Src, err)
+		}
+		return nil
+	})
+}
+
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeArtifactsManifest writes the manifest of the files extracted to the
+// given paths from image to artifactsDir. Records are sorted by path.
+func writeArtifactsManifest(
+	artifactsDir, spec, image, imageID, imageDigest string, extracted []string,
+) error {
+	absDir, err := filepath.Abs(artifactsDir)
+	if err != nil {
+		return fmt.Errorf("resolve artifacts dir: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	records := []*artifactRecord{}
+	err = walkArtifactFiles(extracted, func(file string, info fs.FileInfo) error {
+		rel, err := filepath.Rel(absDir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if seen[rel] {
+			return nil
+		}
+		seen[rel] = true
+
+		sum, err := sha256File(file)
+		if err != nil {
+			return fmt.Errorf("hash %s: %w", rel, err)
+		}
+		records = append(records, &artifactRecord{
+			Path:    rel,
+			SHA256:  sum,
+			Size:    info.Size(),
+			Spec:    spec,
+			Image:   image,
+			ImageID: imageID,
+
+			ImageDigest: imageDigest,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("list extracted artifacts: %w", err)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+
+	bs, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode artifacts manifest: %w", err)
+	}
+	bs = append(bs, '\n')
+	file := filepath.Join(artifactsDir, artifactsManifestFile)
+	if err := os.WriteFile(file, bs, 0644); err != nil {
+		return fmt.Errorf("write artifacts manifest: %w", err)
+	}
+	return nil
+}
+
+// globRoot splits a cleaned glob pattern into the directory before the
+// first segment with a glob, and the pattern segments after it.
+func globRoot(pattern string) (string, []string) {
+	segs := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	for i, seg := range segs {
+		if isFilePathGlob(seg) {
+			return "/" + path.Join(segs[:i]...), segs[i:]
+		}
+	}
+	return pattern, nil
+}
+
+// copyGlobFromContainer copies the files and directories that match the
+// glob Src of a into the directory dst. docker cp does not expand globs, so
+// the directory that contains the matches is copied to a temporary
+// directory first. It returns the paths that the matches are copied to.
+func copyGlobFromContainer(
+	ctx context.Context, d containerEngine, containerID string, a *Artifact, dst, artifactsDir string,
+) ([]string, error) {
+	root, pattern := globRoot(path.Clean(a.Src))
+
+	// Keep the copy on the same file system, so that matches can be moved.
+	tmp, err := os.MkdirTemp(artifactsDir, ".extract-")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := d.copyFromContainer(ctx, containerID, root+"/", tmp); err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	err = filepath.WalkDir(tmp, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || p == tmp {
+			return err
+		}
+		rel, err := filepath.Rel(tmp, p)
+		if err != nil {
+			return err
+		}
+		names := strings.Split(filepath.ToSlash(rel), "/")
+		if len(names) < len(pattern) {
+			return nil
+		}
+		if matchSegments(pattern, names) {
+			matches = append(matches, p)
+		}
+		if entry.IsDir() {
+			return fs.SkipDir // Matches are moved as a whole.
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("match %s: %w", a.Src, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no files match %s", a.Src)
+	}
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return nil, fmt.Errorf("create dir for artifact %s: %w", a.Dst, err)
+	}
+	var outputs []string
+	for _, m := range matches {
+		out := filepath.Join(dst, filepath.Base(m))
+		if err := os.RemoveAll(out); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(m, out); err != nil {
+			return nil, fmt.Errorf("move %s: %w", filepath.Base(m), err)
+		}
+		outputs = append(outputs, out)
+	}
+	return outputs, nil
+}
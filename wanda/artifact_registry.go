@@ -0,0 +1,288 @@
+package wanda
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
+	crane "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// registryArtifact is an artifact being extracted from the flattened file
+// system of an image.
+type registryArtifact struct {
+	*Artifact
+
+	src      string   // Cleaned Src, without a trailing '/'.
+	pattern  []string // Segments of a glob Src.
+	contents bool     // Src ends with '/', copy the contents of the directory.
+	dst      string   // Where Src itself is extracted to.
+
+	outputs []string // Paths that matches of Src are extracted to.
+}
+
+func newRegistryArtifact(a *Artifact, dst string) *registryArtifact {
+	ra := &registryArtifact{
+		Artifact: a,
+		src:      path.Clean(a.Src),
+		contents: strings.HasSuffix(a.Src, "/"),
+		dst:      dst,
+	}
+	if a.isGlob() {
+		ra.pattern = strings.Split(strings.TrimPrefix(ra.src, "/"), "/")
+		return ra
+	}
+	// Like docker cp, copy into an existing directory.
+	if info, err := os.Stat(dst); err == nil && info.IsDir() && !ra.contents {
+		ra.dst = filepath.Join(dst, path.Base(ra.src))
+	}
+	return ra
+}
+
+// addOutput records that a match of Src is extracted to dst.
+func (a *registryArtifact) addOutput(dst string) {
+	for _, out := range a.outputs {
+		if out == dst {
+			return
+		}
+	}
+	a.outputs = append(a.outputs, dst)
+}
+
+// target returns where the file at name in the image is extracted to, if
+// it is part of the artifact. The file is in the match of Src extracted to
+// root.
+func (a *registryArtifact) target(name string) (dst, root string, ok bool) {
+	if a.pattern != nil {
+		// Each match of a glob is extracted into the dst directory.
+		names := strings.Split(strings.TrimPrefix(name, "/"), "/")
+		n := len(a.pattern)
+		if len(names) < n || !matchSegments(a.pattern, names[:n]) {
+			return "", "", false
+		}
+		root := filepath.Join(a.dst, names[n-1])
+		return filepath.Join(root, filepath.FromSlash(path.Join(names[n:]...))), root, true
+	}
+
+	if name == a.src {
+		return a.dst, a.dst, true
+	}
+	if a.src == "/" {
+		return filepath.Join(a.dst, filepath.FromSlash(name)), a.dst, true
+	}
+	rel, ok := strings.CutPrefix(name, a.src+"/")
+	if !ok {
+		return "", "", false
+	}
+	return filepath.Join(a.dst, filepath.FromSlash(rel)), a.dst, true
+}
+
+// extractTarEntry writes the tar entry hdr, read from r, to the file at name
+// in root. links maps paths in the image to the names in root that they
+// were extracted to, for hard links. All files are created through root, so
+// that a symlink from the tar stream cannot make a later entry be written
+// outside of it.
+func extractTarEntry(root *os.Root, hdr *tar.Header, r io.Reader, name string, links map[string]string) error {
+	if hdr.Typeflag == tar.TypeDir {
+		return root.MkdirAll(name, 0755)
+	}
+	if err := root.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	// Replace anything extracted from an earlier artifact.
+	if err := root.RemoveAll(name); err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		f, err := root.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	case tar.TypeSymlink:
+		return root.Symlink(hdr.Linkname, name)
+	case tar.TypeLink:
+		target, ok := links[path.Clean("/"+hdr.Linkname)]
+		if !ok {
+			return fmt.Errorf("hard link target %q is not extracted", hdr.Linkname)
+		}
+		return root.Link(target, name)
+	}
+	return nil // Devices, fifos and the like are skipped.
+}
+
+// extractImageArtifacts extracts artifacts from the flattened file system of
+// img into artifactsDir. Whiteouts in the layers are applied by
+// mutate.Extract.
+func extractImageArtifacts(img crane.Image, artifacts []*registryArtifact, artifactsDir string) error {
+	root, err := os.OpenRoot(artifactsDir)
+	if err != nil {
+		return fmt.Errorf("open artifacts dir: %w", err)
+	}
+	defer root.Close()
+
+	rc := mutate.Extract(img)
+	defer rc.Close()
+
+	links := make(map[string]string)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read image file system: %w", err)
+		}
+		name := path.Clean("/" + hdr.Name)
+
+		for _, a := range artifacts {
+			dst, out, ok := a.target(name)
+			if !ok {
+				continue
+			}
+			a.addOutput(out)
+			if name == a.src && hdr.Typeflag == tar.TypeDir && a.contents {
+				continue // The directory itself is not copied.
+			}
+			rel, err := filepath.Rel(artifactsDir, dst)
+			if err != nil || !filepath.IsLocal(rel) {
+				return fmt.Errorf("extract %s: %s is outside of the artifacts dir", name, dst)
+			}
+			if err := extractArtifactEntry(root, hdr, tr, rel, links, name); err != nil {
+				return fmt.Errorf("extract %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// extractArtifactEntry extracts the tar entry hdr at name in the image to
+// dst in root. The content of a regular file can only be read from r once,
+// so when artifacts overlap, it is copied from where it was first extracted
+// to.
+func extractArtifactEntry(
+	root *os.Root, hdr *tar.Header, r io.Reader, dst string, links map[string]string, name string,
+) error {
+	if hdr.Typeflag != tar.TypeReg {
+		return extractTarEntry(root, hdr, r, dst, links)
+	}
+
+	first, ok := links[name]
+	if !ok {
+		if err := extractTarEntry(root, hdr, r, dst, links); err != nil {
+			return err
+		}
+		links[name] = dst
+		return nil
+	}
+
+	f, err := root.Open(first)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return extractTarEntry(root, hdr, f, dst, links)
+}
+
+// extractArtifactsFromRegistry copies the artifacts of spec from the image
+// at imageTag in the registry to ArtifactsDir. It reads the image layers
+// directly, so it needs neither a docker daemon nor the image pulled into
+// docker; it is used on cache hits, where the image is only in the registry.
+func (f *Forge) extractArtifactsFromRegistry(ctx context.Context, spec *Spec, imageTag string) error {
+	artifactsDir, err := f.prepareArtifactsDir()
+	if err != nil {
+		return err
+	}
+
+	ref, err := cranename.NewTag(imageTag)
+	if err != nil {
+		return fmt.Errorf("parse image tag %q: %w", imageTag, err)
+	}
+	img, err := remote.Image(ref, f.remoteOptsFor(ctx, nil)...)
+	if err != nil {
+		return fmt.Errorf("fetch image %s: %w", imageTag, err)
+	}
+
+	log.Printf("extracting %d artifact(s) from %s in the registry", len(spec.Artifacts), imageTag)
+	extractStart := time.Now()
+
+	var artifacts []*registryArtifact
+	for _, a := range spec.Artifacts {
+		dst, err := resolveArtifact(a, artifactsDir)
+		if err != nil {
+			return err
+		}
+		artifacts = append(artifacts, newRegistryArtifact(a, dst))
+	}
+
+	if err := extractImageArtifacts(img, artifacts, artifactsDir); err != nil {
+		return err
+	}
+
+	var extracted []string
+	for _, a := range artifacts {
+		if len(a.outputs) == 0 {
+			if a.Optional {
+				log.Printf("warning: optional artifact not found: %s", a.Src)
+				continue
+			}
+			return fmt.Errorf("copy artifact %s: not found in image", a.Src)
+		}
+		if err := applyArtifactMode(a.Artifact, a.outputs); err != nil {
+			return err
+		}
+		extracted = append(extracted, absPaths(a.outputs)...)
+	}
+
+	logExtracted(extracted, time.Since(extractStart))
+
+	imageID, err := img.ConfigName()
+	if err != nil {
+		return fmt.Errorf("read image config digest: %w", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return fmt.Errorf("read image digest: %w", err)
+	}
+	imageDigest := ref.Context().Digest(digest.String()).String()
+	return writeArtifactsManifest(
+		artifactsDir, spec.Name, imageTag, imageID.String(), imageDigest, extracted,
+	)
+}
+
+// extractArtifacts extracts the artifacts of the root spec after a build,
+// from docker or, on a cache hit in remote mode, from the registry.
+func (s *buildSession) extractArtifacts(ctx context.Context, spec *Spec, cacheHit bool) error {
+	if cacheHit && !s.forge.isRemote() {
+		log.Printf("skipping artifact extraction: local cache hit")
+		return nil
+	}
+
+	tag, err := s.forge.artifactsImageTag(spec)
+	if err != nil {
+		return err
+	}
+	defer s.forge.report.extracted(tag, time.Now())
+
+	if cacheHit {
+		return s.forge.extractArtifactsFromRegistry(ctx, spec, tag)
+	}
+	return s.forge.ExtractArtifacts(ctx, spec, tag)
+}
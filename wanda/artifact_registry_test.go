@@ -0,0 +1,262 @@
+package wanda
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+type testTarEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	linkname string
+	mode     int64
+}
+
+func testLayer(t *testing.T, entries []*testTarEntry) cranev1.Layer {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     e.mode,
+			Size:     int64(len(e.content)),
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write tar header: %v", err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatalf("write tar content: %v", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+
+	bs := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(bs)), nil
+	})
+	if err != nil {
+		t.Fatalf("make layer: %v", err)
+	}
+	return layer
+}
+
+func TestExtractArtifactsFromRegistry(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	workRepo := fmt.Sprintf("%s/work", server.Listener.Addr().String())
+
+	base := testLayer(t, []*testTarEntry{
+		{name: "home/ray/.whl/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "home/ray/.whl/ray-1.whl", content: "wheel1"},
+		{name: "home/ray/.whl/old.whl", content: "old"},
+		{name: "opt/bin/tool", content: "#!/bin/sh", mode: 0755},
+		{name: "opt/bin/tool-link", typeflag: tar.TypeSymlink, linkname: "tool"},
+		{name: "etc/config", content: "v1"},
+	})
+	top := testLayer(t, []*testTarEntry{
+		{name: "home/ray/.whl/.wh.old.whl"},
+		{name: "home/ray/.whl/ray-2.whl", content: "wheel2"},
+		{name: "etc/config", content: "v2"},
+	})
+	img, err := mutate.AppendLayers(empty.Image, base, top)
+	if err != nil {
+		t.Fatalf("append layers: %v", err)
+	}
+
+	config := &ForgeConfig{
+		WorkDir:      "testdata",
+		WorkRepo:     workRepo,
+		BuildID:      "b1",
+		ArtifactsDir: filepath.Join(t.TempDir(), "artifacts"),
+	}
+	forge, err := NewForge(config)
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+	tag := config.workTag("artifacts")
+	if err := remote.Write(mustNewTag(t, tag), img); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+
+	spec := &Spec{
+		Name: "artifacts",
+		Artifacts: []*Artifact{
+			{Src: "/home/ray/.whl/", Dst: "wheels"},
+			{Src: "/opt/bin", Dst: "bin"},
+			{Src: "/etc/config", Dst: "config.txt"},
+			{Src: "/etc/config", Dst: "again/config.txt"},
+			{Src: "/not/there", Dst: "missing", Optional: true},
+			{Src: "/home/ray/.whl/*.whl", Dst: "globbed", Mode: "0600"},
+			{Src: "/opt/*/tool", Dst: "tools"},
+		},
+	}
+	if err := forge.extractArtifactsFromRegistry(t.Context(), spec, tag); err != nil {
+		t.Fatalf("extractArtifactsFromRegistry: %v", err)
+	}
+
+	dir := config.ArtifactsDir
+	for file, want := range map[string]string{
+		"wheels/ray-1.whl":  "wheel1",
+		"wheels/ray-2.whl":  "wheel2",
+		"bin/tool":          "#!/bin/sh",
+		"config.txt":        "v2",
+		"again/config.txt":  "v2",
+		"bin/tool-link":     "#!/bin/sh",
+		"globbed/ray-1.whl": "wheel1",
+		"globbed/ray-2.whl": "wheel2",
+		"tools/tool":        "#!/bin/sh",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Errorf("read %s: %v", file, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "wheels/old.whl")); !os.IsNotExist(err) {
+		t.Errorf("whited out file was extracted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing optional artifact was extracted: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "bin/tool"))
+	if err != nil {
+		t.Fatalf("stat tool: %v", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("tool mode = %v, want 0755", info.Mode().Perm())
+	}
+
+	info, err = os.Stat(filepath.Join(dir, "globbed/ray-1.whl"))
+	if err != nil {
+		t.Fatalf("stat globbed wheel: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("globbed wheel mode = %v, want 0600", info.Mode().Perm())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "globbed/old.whl")); !os.IsNotExist(err) {
+		t.Errorf("whited out file matched the glob: %v", err)
+	}
+
+	bs, err := os.ReadFile(filepath.Join(dir, artifactsManifestFile))
+	if err != nil {
+		t.Fatalf("read artifacts manifest: %v", err)
+	}
+	var records []*artifactRecord
+	if err := json.Unmarshal(bs, &records); err != nil {
+		t.Fatalf("decode artifacts manifest: %v", err)
+	}
+	imageID, err := img.ConfigName()
+	if err != nil {
+		t.Fatalf("image config digest: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("image digest: %v", err)
+	}
+	imageDigest := mustNewTag(t, tag).Context().Digest(digest.String()).String()
+	var paths []string
+	for _, r := range records {
+		paths = append(paths, r.Path)
+		if r.Spec != "artifacts" || r.Image != tag || r.ImageID != imageID.String() ||
+			r.ImageDigest != imageDigest {
+			t.Errorf("record %+v has wrong source", r)
+		}
+	}
+	wantPaths := []string{
+		"again/config.txt",
+		"bin/tool",
+		"config.txt",
+		"globbed/ray-1.whl",
+		"globbed/ray-2.whl",
+		"tools/tool",
+		"wheels/ray-1.whl",
+		"wheels/ray-2.whl",
+	}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("artifacts manifest paths = %q, want %q", paths, wantPaths)
+	}
+	sum := sha256.Sum256([]byte("wheel2"))
+	if r := records[4]; r.SHA256 != hex.EncodeToString(sum[:]) || r.Size != 6 {
+		t.Errorf("record of %s = %+v", r.Path, r)
+	}
+
+	spec.Artifacts = append(spec.Artifacts, &Artifact{Src: "/also/not/there", Dst: "x"})
+	if err := forge.extractArtifactsFromRegistry(t.Context(), spec, tag); err == nil {
+		t.Errorf("extractArtifactsFromRegistry() with a missing artifact should fail")
+	}
+}
+
+func TestExtractImageArtifacts_symlinkEscape(t *testing.T) {
+	outside := t.TempDir()
+	// The symlink extracted by the first artifact points out of the
+	// artifacts dir, and the second artifact is extracted through it.
+	layer := testLayer(t, []*testTarEntry{
+		{name: "a/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "a/link", typeflag: tar.TypeSymlink, linkname: outside},
+		{name: "b/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "b/pwned", content: "pwned"},
+	})
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatalf("append layers: %v", err)
+	}
+
+	artifactsDir := t.TempDir()
+	var artifacts []*registryArtifact
+	for _, a := range []*Artifact{
+		{Src: "/a/", Dst: "out"},
+		{Src: "/b/pwned", Dst: "out/link/pwned"},
+	} {
+		dst, err := resolveArtifact(a, artifactsDir)
+		if err != nil {
+			t.Fatalf("resolveArtifact(%+v): %v", a, err)
+		}
+		artifacts = append(artifacts, newRegistryArtifact(a, dst))
+	}
+
+	if err := extractImageArtifacts(img, artifacts, artifactsDir); err == nil {
+		t.Errorf("extractImageArtifacts() through a symlink out of the artifacts dir got nil error")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "pwned")); !os.IsNotExist(err) {
+		t.Errorf("file written outside of the artifacts dir: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package wanda
 
 import (
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -19,6 +20,11 @@ func TestArtifact_Validate(t *testing.T) {
 		{"absolute dst rejected", "/app/file.txt", "/absolute/path.txt", "must be relative"},
 		{"dst with .. rejected", "/app/file.txt", "../escape.txt", "cannot escape"},
 		{"dst with nested .. rejected", "/app/file.txt", "subdir/../../escape.txt", "cannot escape"},
+		{"glob src", "/home/ray/.whl/*.whl", "wheels/", ""},
+		{"recursive glob rejected", "/home/**/*.whl", "wheels/", "cannot use"},
+		{"bad glob rejected", "/home/[ray/*.whl", "wheels/", "not a valid pattern"},
+		{"glob in root rejected", "/*.whl", "wheels/", "other than /"},
+		{"glob dir in root rejected", "/h*/ray/*.whl", "wheels/", "other than /"},
 	}
 
 	for _, tt := range tests {
@@ -77,3 +83,34 @@ func TestArtifact_ResolveDst(t *testing.T) {
 		})
 	}
 }
+
+func TestArtifact_fileMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    os.FileMode
+		wantSet bool
+		wantErr bool
+	}{
+		{"", 0, false, false},
+		{"0644", 0644, true, false},
+		{"755", 0755, true, false},
+		{"0o644", 0, false, true},
+		{"1777", 0, false, true},
+		{"rwx", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		a := &Artifact{Src: "/a", Dst: "a", Mode: tt.mode}
+		got, set, err := a.fileMode()
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("fileMode(%q) error = %v, want error %v", tt.mode, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want || set != tt.wantSet {
+			t.Errorf("fileMode(%q) = %v, %v; want %v, %v", tt.mode, got, set, tt.want, tt.wantSet)
+		}
+		if err := a.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() with mode %q = %v", tt.mode, err)
+		}
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"runtime"
 	"sort"
 	"strings"
+	"time"
 )
 
 func resolveBuildArgs(buildArgs []string, lookup lookupFunc) map[string]string {
@@ -39,6 +39,21 @@ type buildInput struct {
 	froms     map[string]*imageSource
 	buildArgs []string
 
+	// platform is the platform to build for. nil means the host platform.
+	platform *platform
+
+	// labels are set on the built image. They are not part of the core, so
+	// they do not change the digest.
+	labels map[string]string
+
+	// secrets are passed to the build with --secret. They are not part of
+	// the core either.
+	secrets []*buildSecret
+
+	// hashTime is how long it took to make the core, which hashes the build
+	// context.
+	hashTime time.Duration
+
 	tags map[string]struct{}
 }
 
@@ -78,6 +93,11 @@ type buildInputCore struct {
 	OS       string `json:",omitempty"` // "linux" (empty string) or GOOS
 
 	ContextOwner string `json:",omitempty"` // "uid:gid" override
+	Target       string `json:",omitempty"` // Dockerfile stage to build
+
+	// Engine is the container engine that builds the image, empty for
+	// docker. The engines do not build the same image from the same input.
+	Engine string `json:",omitempty"`
 }
 
 func (i *buildInput) makeCore(dockerfile string, lookup lookupFunc) (*buildInputCore, error) {
@@ -97,12 +117,17 @@ func (i *buildInput) makeCore(dockerfile string, lookup lookupFunc) (*buildInput
 
 	buildArgs := resolveBuildArgs(i.buildArgs, lookup)
 
-	platform := runtime.GOARCH
+	target := i.platform
+	if target == nil {
+		target = hostPlatform()
+	}
+
+	platform := target.Arch
 	if platform == "amd64" {
 		platform = ""
 	}
 
-	os := targetOS()
+	os := target.OS
 	if os == "linux" {
 		os = ""
 	}
@@ -0,0 +1,125 @@
+package wanda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// layerBuildFunc builds the spec with the given name, writing its output to
+// out. It reports whether the build was a cache hit. The build should stop
+// when ctx is done.
+type layerBuildFunc func(ctx context.Context, name string, out *buildOutput) (bool, error)
+
+// buildLayers builds the given dependency layers in order, running up to jobs
+// builds of the same layer concurrently. It reports whether the root spec
+// was a cache hit.
+func (s *buildSession) buildLayers(ctx context.Context, layers [][]string, jobs int) (bool, error) {
+	build := func(ctx context.Context, name string, out *buildOutput) (bool, error) {
+		rs := s.graph.Specs[name]
+		out.log.Printf("building %s (from %s)", name, rs.Path)
+		return s.forge.build(ctx, rs.Spec, out)
+	}
+
+	var rootHit bool
+	for _, layer := range layers {
+		hits, err := buildLayer(ctx, layer, jobs, build)
+		if err != nil {
+			return false, err
+		}
+		if hits[s.graph.Root] {
+			rootHit = true
+		}
+	}
+	return rootHit, nil
+}
+
+// buildLayer builds all specs in a layer with up to jobs concurrent builds.
+// When more than one build runs at a time, every output line is prefixed
+// with the spec name.
+//
+// After the first failure, or once ctx is done, specs that have not started
+// yet are skipped, and the context of the builds that are running is
+// cancelled.
+// Failures of all the builds that did run are joined into the returned error,
+// leaving out the builds that only failed because they were cancelled.
+// On success, it returns the cache hit result of each spec.
+func buildLayer(
+	ctx context.Context, layer []string, jobs int, build layerBuildFunc,
+) (map[string]bool, error) {
+	workers := max(min(jobs, len(layer)), 1)
+
+	layerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hits := make([]bool, len(layer))
+	errs := make([]error, len(layer))
+
+	sem := make(chan struct{}, workers)
+	var outMu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i, name := range layer {
+		select {
+		case sem <- struct{}{}:
+		case <-layerCtx.Done():
+		}
+		if layerCtx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			out := defaultBuildOutput()
+			if workers > 1 {
+				out = newPrefixedBuildOutput(&outMu, "["+name+"] ")
+				defer out.flush()
+			}
+
+			hit, err := build(layerCtx, name, out)
+			if err != nil {
+				errs[i] = fmt.Errorf("build %s: %w", name, err)
+				cancel()
+				return
+			}
+			hits[i] = hit
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() == nil {
+		errs = dropCanceled(errs)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]bool, len(layer))
+	for i, name := range layer {
+		m[name] = hits[i]
+	}
+	return m, nil
+}
+
+// dropCanceled returns errs without the errors of builds that were
+// cancelled because another build failed, so that they do not hide the
+// failure. They are kept if there is no other failure.
+func dropCanceled(errs []error) []error {
+	var kept []error
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			kept = append(kept, err)
+		}
+	}
+	if len(kept) == 0 {
+		return errs
+	}
+	return kept
+}
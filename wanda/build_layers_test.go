@@ -0,0 +1,169 @@
+package wanda
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBuildLayer_concurrent(t *testing.T) {
+	layer := []string{"a", "b", "c", "d"}
+
+	var running, maxRunning atomic.Int32
+	allStarted := make(chan struct{})
+	var startWg sync.WaitGroup
+	startWg.Add(2)
+	go func() {
+		startWg.Wait()
+		close(allStarted)
+	}()
+
+	build := func(ctx context.Context, name string, out *buildOutput) (bool, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		// The first two builds wait for each other, so they must run
+		// concurrently.
+		if name == "a" || name == "b" {
+			startWg.Done()
+			<-allStarted
+		}
+		return name == "c", nil
+	}
+
+	hits, err := buildLayer(t.Context(), layer, 2, build)
+	if err != nil {
+		t.Fatalf("buildLayer: %v", err)
+	}
+
+	want := map[string]bool{"a": false, "b": false, "c": true, "d": false}
+	if !reflect.DeepEqual(hits, want) {
+		t.Errorf("hits = %v, want %v", hits, want)
+	}
+	if got := maxRunning.Load(); got != 2 {
+		t.Errorf("max concurrent builds = %d, want 2", got)
+	}
+}
+
+func TestBuildLayer_sequential(t *testing.T) {
+	var order []string
+	build := func(ctx context.Context, name string, out *buildOutput) (bool, error) {
+		if out.log != defaultBuildOutput().log {
+			t.Errorf("build %s: got prefixed output for sequential build", name)
+		}
+		order = append(order, name)
+		return false, nil
+	}
+
+	if _, err := buildLayer(t.Context(), []string{"a", "b", "c"}, 0, build); err != nil {
+		t.Fatalf("buildLayer: %v", err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+}
+
+func TestBuildLayer_failureStopsPending(t *testing.T) {
+	var started []string
+	var mu sync.Mutex
+	build := func(ctx context.Context, name string, out *buildOutput) (bool, error) {
+		mu.Lock()
+		started = append(started, name)
+		mu.Unlock()
+		if name == "a" {
+			return false, errors.New("boom")
+		}
+		return false, nil
+	}
+
+	_, err := buildLayer(t.Context(), []string{"a", "b", "c"}, 1, build)
+	if err == nil {
+		t.Fatal("buildLayer: got nil error, want error")
+	}
+	if !strings.Contains(err.Error(), "build a: boom") {
+		t.Errorf("error = %q, want it to contain %q", err, "build a: boom")
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(started, want) {
+		t.Errorf("started = %v, want %v", started, want)
+	}
+}
+
+func TestBuildLayer_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+
+	var started []string
+	build := func(ctx context.Context, name string, out *buildOutput) (bool, error) {
+		started = append(started, name)
+		cancel() // Like a SIGINT during the first build.
+		return false, nil
+	}
+
+	_, err := buildLayer(ctx, []string{"a", "b", "c"}, 1, build)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("buildLayer: got error %v, want context.Canceled", err)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(started, want) {
+		t.Errorf("started = %v, want %v", started, want)
+	}
+}
+
+func TestBuildLayer_joinsErrors(t *testing.T) {
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		wg.Wait()
+		close(release)
+	}()
+
+	build := func(ctx context.Context, name string, out *buildOutput) (bool, error) {
+		// Both builds are running before either fails.
+		wg.Done()
+		<-release
+		return false, errors.New(name + " failed")
+	}
+
+	_, err := buildLayer(t.Context(), []string{"a", "b"}, 2, build)
+	if err == nil {
+		t.Fatal("buildLayer: got nil error, want error")
+	}
+	for _, want := range []string{"build a: a failed", "build b: b failed"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %q, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestBuildLayer_failureCancelsRunning(t *testing.T) {
+	bStarted := make(chan struct{})
+	build := func(ctx context.Context, name string, out *buildOutput) (bool, error) {
+		if name == "a" {
+			<-bStarted
+			return false, errors.New("boom")
+		}
+		close(bStarted)
+		<-ctx.Done() // Only returns if the failure of a cancels b.
+		return false, ctx.Err()
+	}
+
+	_, err := buildLayer(t.Context(), []string{"a", "b"}, 2, build)
+	if err == nil {
+		t.Fatal("buildLayer: got nil error, want error")
+	}
+	if !strings.Contains(err.Error(), "build a: boom") {
+		t.Errorf("error = %q, want it to contain %q", err, "build a: boom")
+	}
+	// The running build of b is cancelled, which is left out of the error.
+	if errors.Is(err, context.Canceled) || strings.Contains(err.Error(), "build b") {
+		t.Errorf("error = %q, want only the failure of a", err)
+	}
+}
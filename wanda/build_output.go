@@ -0,0 +1,102 @@
+package wanda
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// buildOutput is where a single spec build writes its logs and the output of
+// the docker commands it runs.
+type buildOutput struct {
+	stdout io.Writer
+	stderr io.Writer
+	log    *log.Logger
+
+	// flushers are flushed when the build is done.
+	flushers []*prefixWriter
+}
+
+func defaultBuildOutput() *buildOutput {
+	return &buildOutput{
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+		log:    log.Default(),
+	}
+}
+
+// newPrefixedBuildOutput creates a build output that prefixes every line
+// with prefix. Outputs sharing the same mu never interleave within a line,
+// so that concurrent builds stay readable.
+func newPrefixedBuildOutput(mu *sync.Mutex, prefix string) *buildOutput {
+	stdout := newPrefixWriter(mu, os.Stdout, prefix)
+	stderr := newPrefixWriter(mu, os.Stderr, prefix)
+	return &buildOutput{
+		stdout:   stdout,
+		stderr:   stderr,
+		log:      log.New(stderr, "", log.Default().Flags()),
+		flushers: []*prefixWriter{stdout, stderr},
+	}
+}
+
+// flush writes out any incomplete trailing lines.
+func (o *buildOutput) flush() {
+	for _, w := range o.flushers {
+		w.flush()
+	}
+}
+
+// prefixWriter buffers writes into lines, and writes each complete line to w
+// with a prefix.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(mu *sync.Mutex, w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{mu: mu, w: w, prefix: []byte(prefix)}
+}
+
+// Write implements io.Writer. Incomplete lines are held back until the next
+// newline or until flush is called.
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	var lines []byte
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, w.prefix...)
+		lines = append(lines, w.buf[:i+1]...)
+		w.buf = w.buf[i+1:]
+	}
+	if len(lines) > 0 {
+		if err := w.writeOut(lines); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *prefixWriter) flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	line := append(append([]byte{}, w.prefix...), w.buf...)
+	line = append(line, '\n')
+	w.buf = nil
+	w.writeOut(line)
+}
+
+func (w *prefixWriter) writeOut(bs []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.w.Write(bs)
+	return err
+}
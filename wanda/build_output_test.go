@@ -0,0 +1,35 @@
+package wanda
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var mu sync.Mutex
+	buf := new(bytes.Buffer)
+	w := newPrefixWriter(&mu, buf, "[a] ")
+
+	for _, s := range []string{"hello\nwor", "ld\n", "\nbye"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("write %q: %v", s, err)
+		}
+	}
+
+	const wantBeforeFlush = "[a] hello\n[a] world\n[a] \n"
+	if got := buf.String(); got != wantBeforeFlush {
+		t.Errorf("got %q before flush, want %q", got, wantBeforeFlush)
+	}
+
+	w.flush()
+	const want = wantBeforeFlush + "[a] bye\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q after flush, want %q", got, want)
+	}
+
+	w.flush() // nothing left to flush
+	if got := buf.String(); got != want {
+		t.Errorf("got %q after second flush, want %q", got, want)
+	}
+}
@@ -0,0 +1,185 @@
+package wanda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Statuses of the images in a build report.
+const (
+	reportBuilt    = "built"
+	reportCacheHit = "cache_hit"
+	reportFailed   = "failed"
+	reportNotBuilt = "not_built"
+)
+
+// phaseTimings are the durations of the phases of building an image, in
+// seconds.
+type phaseTimings struct {
+	Resolve float64 `json:"resolve,omitempty"`
+	Hash    float64 `json:"hash,omitempty"`
+	Build   float64 `json:"build,omitempty"`
+	Push    float64 `json:"push,omitempty"`
+	Extract float64 `json:"extract,omitempty"`
+}
+
+func seconds(d time.Duration) float64 { return d.Seconds() }
+
+// imageReport is the build report entry of an image. A multi-platform spec
+// has one entry for each platform it is built for.
+type imageReport struct {
+	Name     string `json:"name"`
+	SpecPath string `json:"spec_path"`
+	Platform string `json:"platform,omitempty"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+
+	InputDigest string `json:"input_digest,omitempty"`
+	CacheHit    bool   `json:"cache_hit"`
+	WorkTag     string `json:"work_tag,omitempty"`
+	CacheTag    string `json:"cache_tag,omitempty"`
+
+	// ImageDigest is the digest of the image in the work repo. It is only
+	// known in remote mode.
+	ImageDigest string `json:"image_digest,omitempty"`
+
+	// ContextSize is the size in bytes of the build context tar stream
+	// sent to docker. It is zero when the image was not built.
+	ContextSize int64 `json:"context_size,omitempty"`
+
+	Timings phaseTimings `json:"timings"`
+}
+
+// finish records the result of building the image.
+func (r *imageReport) finish(hit bool, err error) {
+	r.CacheHit = hit
+	switch {
+	case err != nil:
+		r.Status = reportFailed
+		r.Error = err.Error()
+	case hit:
+		r.Status = reportCacheHit
+	default:
+		r.Status = reportBuilt
+	}
+}
+
+// buildReport collects the report entries of the images of a build. Builds
+// of the same layer add their entries concurrently.
+type buildReport struct {
+	mu     sync.Mutex
+	images map[string][]*imageReport // By spec name.
+}
+
+func newBuildReport() *buildReport {
+	return &buildReport{images: make(map[string][]*imageReport)}
+}
+
+// add adds the entry of the image of the spec with the given name for
+// platform p, or for the host platform if p is nil. A nil report returns an
+// entry that is not recorded.
+func (b *buildReport) add(name string, p *platform) *imageReport {
+	r := &imageReport{Name: name}
+	if p != nil {
+		r.Platform = p.String()
+	}
+	if b == nil {
+		return r
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.images[name] = append(b.images[name], r)
+	return r
+}
+
+// extracted records the time taken to extract the artifacts of the image
+// with workTag, since start.
+func (b *buildReport) extracted(workTag string, start time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, images := range b.images {
+		for _, r := range images {
+			if r.WorkTag == workTag {
+				r.Timings.Extract = seconds(time.Since(start))
+			}
+		}
+	}
+}
+
+// entries returns the report entries of all the specs of the graph, in build
+// order. Specs that were not built have a single not_built entry.
+func (b *buildReport) entries(g *depGraph) []*imageReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []*imageReport
+	for _, name := range g.Order {
+		path := g.Specs[name].Path
+		images := b.images[name]
+		if len(images) == 0 {
+			images = []*imageReport{{Name: name, Status: reportNotBuilt}}
+		}
+		for _, r := range images {
+			r.SpecPath = path
+			entries = append(entries, r)
+		}
+	}
+	return entries
+}
+
+// buildReportFile is the JSON document written by -report.
+type buildReportFile struct {
+	Root  string         `json:"root"`
+	Specs []*imageReport `json:"specs"`
+}
+
+// writeReport writes the build report of the session to file as JSON.
+func (s *buildSession) writeReport(file string) error {
+	doc := &buildReportFile{
+		Root:  s.graph.Root,
+		Specs: s.forge.report.entries(s.graph),
+	}
+	bs, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal report: %w", err)
+	}
+	if err := os.WriteFile(file, append(bs, '\n'), 0644); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	return nil
+}
+
+// reportImageDigest records the digest of the image at workTag in the work
+// repo in r. It is only looked up when a report is written, and only in
+// remote mode. Failing to look it up does not fail the build.
+func (f *Forge) reportImageDigest(
+	ctx context.Context, r *imageReport, workTag string, out *buildOutput,
+) {
+	if f.config.Report == "" || !f.isRemote() {
+		return
+	}
+
+	ref, err := cranename.NewTag(workTag)
+	if err != nil {
+		out.log.Printf("report: parse work tag %q: %v", workTag, err)
+		return
+	}
+	desc, err := remote.Head(ref, f.remoteOptsFor(ctx, nil)...)
+	if err != nil {
+		out.log.Printf("report: look up %s: %v", workTag, err)
+		return
+	}
+	r.ImageDigest = desc.Digest.String()
+}
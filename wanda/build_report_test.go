@@ -0,0 +1,146 @@
+package wanda
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestBuildReportEntries(t *testing.T) {
+	g := &depGraph{
+		Root:  "app",
+		Order: []string{"base", "tools", "app"},
+		Specs: map[string]*resolvedSpec{
+			"base":  {Spec: &Spec{Name: "base"}, Path: "base.wanda.yaml"},
+			"tools": {Spec: &Spec{Name: "tools"}, Path: "tools.wanda.yaml"},
+			"app":   {Spec: &Spec{Name: "app"}, Path: "app.wanda.yaml"},
+		},
+	}
+
+	report := newBuildReport()
+	app := report.add("app", nil)
+	app.WorkTag = "work:app"
+	app.finish(false, fmt.Errorf("boom"))
+	amd64 := report.add("base", &platform{OS: "linux", Arch: "amd64"})
+	amd64.finish(true, nil)
+	arm64 := report.add("base", &platform{OS: "linux", Arch: "arm64"})
+	arm64.finish(false, nil)
+
+	report.extracted("work:app", time.Now().Add(-time.Second))
+	if app.Timings.Extract < 1 {
+		t.Errorf("extract timing = %v, want at least 1s", app.Timings.Extract)
+	}
+
+	var got []string
+	for _, r := range report.entries(g) {
+		got = append(got, strings.Join([]string{r.Name, r.SpecPath, r.Platform, r.Status}, " "))
+	}
+	want := []string{
+		"base base.wanda.yaml linux/amd64 cache_hit",
+		"base base.wanda.yaml linux/arm64 built",
+		"tools tools.wanda.yaml  not_built",
+		"app app.wanda.yaml  failed",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries() = %q, want %q", got, want)
+	}
+	if app.Error != "boom" {
+		t.Errorf("app error = %q, want boom", app.Error)
+	}
+
+	var nilReport *buildReport
+	if r := nilReport.add("app", nil); r == nil || r.Name != "app" {
+		t.Errorf("add() on nil report = %+v", r)
+	}
+}
+
+func TestBuild_reportCacheHit(t *testing.T) {
+	server := httptest.NewServer(registry.New(
+		registry.Logger(log.New(io.Discard, "", 0)),
+	))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	writeSpec(t, tmpDir, "Dockerfile", "FROM scratch\nCOPY hello.txt /\n")
+	writeSpec(t, tmpDir, "hello.txt", "hello\n")
+	specFile := writeSpec(t, tmpDir, "hello.wanda.yaml", strings.Join([]string{
+		"name: hello",
+		"dockerfile: Dockerfile",
+		"srcs: [hello.txt]",
+	}, "\n"))
+
+	reportFile := filepath.Join(tmpDir, "report.json")
+	config := &ForgeConfig{
+		WorkDir:        tmpDir,
+		WorkRepo:       server.Listener.Addr().String() + "/work",
+		BuildID:        "b1",
+		WandaSpecsFile: writeWandaSpecs(t, tmpDir, []string{"."}),
+		Report:         reportFile,
+	}
+
+	var buf strings.Builder
+	if err := Digest(t.Context(), specFile, config, &buf); err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	inputDigest := strings.TrimSpace(buf.String())
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+	imgDigest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("image digest: %v", err)
+	}
+	cacheTag := config.cacheTag(inputDigest)
+	if err := remote.Write(mustNewTag(t, cacheTag), img); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+
+	if err := Build(t.Context(), specFile, config); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	bs, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("read report: %v", err)
+	}
+	var got buildReportFile
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatalf("unmarshal report: %v", err)
+	}
+	if got.Root != "hello" || len(got.Specs) != 1 {
+		t.Fatalf("report = %s, want one entry for hello", bs)
+	}
+
+	r := got.Specs[0]
+	want := &imageReport{
+		Name:        "hello",
+		SpecPath:    specFile,
+		Status:      reportCacheHit,
+		InputDigest: inputDigest,
+		CacheHit:    true,
+		WorkTag:     config.workTag("hello"),
+		CacheTag:    cacheTag,
+		ImageDigest: imgDigest.String(),
+		Timings:     r.Timings,
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("report entry = %+v, want %+v", r, want)
+	}
+	if r.Timings.Resolve <= 0 || r.Timings.Hash <= 0 {
+		t.Errorf("timings = %+v, want resolve and hash", r.Timings)
+	}
+}
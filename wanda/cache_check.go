@@ -0,0 +1,88 @@
+package wanda
+
+import (
+	"context"
+	"fmt"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// checkCache looks up the image at cacheTag. On a hit, the image is tagged
+// with the tags of in, as if it was just built. It reports whether it is a
+// hit.
+func (f *Forge) checkCache(
+	ctx context.Context, in *buildInput, cacheTag, workTag string, out *buildOutput,
+) (bool, error) {
+	if f.isRemote() {
+		return f.checkRemoteCache(ctx, in, cacheTag, workTag, out)
+	}
+	return f.checkLocalCache(ctx, in, cacheTag, out)
+}
+
+func (f *Forge) checkRemoteCache(
+	ctx context.Context, in *buildInput, cacheTag, workTag string, out *buildOutput,
+) (bool, error) {
+	ct, err := cranename.NewTag(cacheTag)
+	if err != nil {
+		return false, fmt.Errorf("parse cache tag %q: %w", cacheTag, err)
+	}
+	wt, err := cranename.NewTag(workTag)
+	if err != nil {
+		return false, fmt.Errorf("parse work tag %q: %w", workTag, err)
+	}
+
+	var desc *remote.Descriptor
+	err = f.retry.do(ctx, "get "+cacheTag, out.log, func() error {
+		var err error
+		desc, err = remote.Get(ct, f.remoteOptsFor(ctx, nil)...)
+		return err
+	})
+	if err != nil {
+		out.log.Printf("cache image miss: %v", err)
+		return false, nil
+	}
+	if err := f.verifyCacheImage(ctx, ct, desc.Digest); err != nil {
+		out.log.Printf("cache image miss: untrusted %s: %v", desc.Digest, err)
+		return false, nil
+	}
+	out.log.Printf("cache hit: %s", desc.Digest)
+	f.cacheHitCount.Add(1)
+
+	out.log.Printf("tag output as %s", workTag)
+	if err := f.retry.do(ctx, "tag "+workTag, out.log, func() error {
+		return remote.Tag(wt, desc, f.remoteOptsFor(ctx, nil)...)
+	}); err != nil {
+		return false, fmt.Errorf("tag cache image: %w", err)
+	}
+	if f.config.LocalRegistry != "" {
+		if err := f.pullCacheHit(ctx, workTag, in.tagList(), out); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (f *Forge) checkLocalCache(
+	ctx context.Context, in *buildInput, cacheTag string, out *buildOutput,
+) (bool, error) {
+	info, err := f.engine.inspectImage(ctx, cacheTag)
+	if err != nil {
+		return false, fmt.Errorf("check cache image: %w", err)
+	}
+	if info == nil {
+		return false, nil
+	}
+	out.log.Printf("cache hit: %s", info.ID)
+	f.cacheHitCount.Add(1)
+
+	for _, tag := range in.tagList() {
+		out.log.Printf("tag output as %s", tag)
+		if tag != cacheTag {
+			if err := f.engine.tag(ctx, cacheTag, tag); err != nil {
+				return false, fmt.Errorf("tag cache image: %w", err)
+			}
+		}
+	}
+	return true, nil
+}
@@ -2,6 +2,8 @@ package wanda
 
 import (
 	"fmt"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -26,3 +28,83 @@ func defaultCacheEpoch(nowFunc func() time.Time) string {
 func DefaultCacheEpoch() string {
 	return defaultCacheEpoch(time.Now)
 }
+
+// Cache epoch policies. Any other policy is an explicit epoch, used as is.
+const (
+	epochDaily   = "daily"
+	epochWeekly  = "weekly"
+	epochMonthly = "monthly"
+	epochNever   = "never"
+)
+
+// epochPolicyFile is the file next to the wandaspecs file that sets the
+// cache epoch policy of all the specs of a repo.
+const epochPolicyFile = ".wandaepoch"
+
+// cacheEpochPolicy is the cache epoch policy applied to a spec. The epoch
+// is part of the build input digest, so the cache of the spec is
+// invalidated whenever the epoch changes.
+type cacheEpochPolicy struct {
+	Policy string `json:"policy"`
+
+	// Source is where the policy is set: "spec", "config" for the epoch of
+	// the forge config, the path of the policy file of the repo, or
+	// "default" for the default epoch of the forge config.
+	Source string `json:"source"`
+
+	Epoch string `json:"epoch"`
+}
+
+// epochForPolicy returns the epoch of the given policy at now. Epochs
+// start at midnight in the SFO time zone, like the default epochs.
+func epochForPolicy(policy string, now time.Time) string {
+	now = now.In(sfoAround)
+	switch policy {
+	case epochDaily:
+		return now.Format("2006-01-02")
+	case epochWeekly:
+		year, week := now.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case epochMonthly:
+		return now.Format("2006-01")
+	case epochNever:
+		return ""
+	}
+	return policy
+}
+
+// readEpochPolicyFile reads the policy in file: its first line that is
+// not empty or a comment. It returns "" if there is no such file.
+func readEpochPolicyFile(file string) (string, error) {
+	bs, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(bs), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return line, nil
+	}
+	return "", nil
+}
+
+// cacheEpoch returns the cache epoch policy that applies to spec: the one
+// of the spec, or else the epoch of the config, or else the one of the
+// repo, or else the default epoch of the config. Epochs of the config can
+// also name a policy.
+func (f *Forge) cacheEpoch(spec *Spec) *cacheEpochPolicy {
+	p := &cacheEpochPolicy{Policy: f.config.DefaultEpoch, Source: "default"}
+	if spec.CacheEpoch != "" {
+		p.Policy, p.Source = spec.CacheEpoch, "spec"
+	} else if f.config.Epoch != "" {
+		p.Policy, p.Source = f.config.Epoch, "config"
+	} else if f.repoEpoch != "" {
+		p.Policy, p.Source = f.repoEpoch, f.repoEpochFile
+	}
+	p.Epoch = epochForPolicy(p.Policy, f.epochTime)
+	return p
+}
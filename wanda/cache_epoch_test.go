@@ -1,6 +1,7 @@
 package wanda
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -61,3 +62,97 @@ func TestDefaultCacheEpoch(t *testing.T) {
 		})
 	}
 }
+
+func TestEpochForPolicy(t *testing.T) {
+	// Late evening in SFO is already the next day in UTC.
+	now := time.Date(2025, time.June, 1, 6, 0, 0, 0, time.UTC) // Saturday in SFO.
+
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{policy: "daily", want: "2025-05-31"},
+		{policy: "weekly", want: "2025-W22"},
+		{policy: "monthly", want: "2025-05"},
+		{policy: "never", want: ""},
+		{policy: "202522b", want: "202522b"},
+		{policy: "", want: ""},
+	}
+	for _, test := range tests {
+		if got := epochForPolicy(test.policy, now); got != test.want {
+			t.Errorf("epochForPolicy(%q) = %q, want %q", test.policy, got, test.want)
+		}
+	}
+}
+
+func TestForgeCacheEpoch(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &ForgeConfig{
+		WorkDir:        tmpDir,
+		DefaultEpoch:   "202523a",
+		WandaSpecsFile: writeWandaSpecs(t, tmpDir, []string{"."}),
+	}
+	now := time.Date(2025, time.June, 3, 12, 0, 0, 0, sfoAround)
+
+	cacheEpoch := func(epoch string, spec *Spec) *cacheEpochPolicy {
+		t.Helper()
+		c := *config
+		c.Epoch = epoch
+		forge, err := NewForge(&c)
+		if err != nil {
+			t.Fatalf("make forge: %v", err)
+		}
+		forge.epochTime = now
+		return forge.cacheEpoch(spec)
+	}
+	hello := &Spec{Name: "hello"}
+	never := &Spec{Name: "hello", CacheEpoch: "never"}
+
+	for _, test := range []struct {
+		name  string
+		epoch string
+		spec  *Spec
+		want  cacheEpochPolicy
+	}{
+		{"default", "", hello, cacheEpochPolicy{"202523a", "default", "202523a"}},
+		{"flag", "202522b", hello, cacheEpochPolicy{"202522b", "config", "202522b"}},
+		{"spec over flag", "202522b", never, cacheEpochPolicy{"never", "spec", ""}},
+	} {
+		if got := cacheEpoch(test.epoch, test.spec); *got != test.want {
+			t.Errorf("cacheEpoch() %s = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	policyFile := writeSpec(t, tmpDir, epochPolicyFile, "# Rotate monthly.\nmonthly\n")
+	for _, test := range []struct {
+		name  string
+		epoch string
+		spec  *Spec
+		want  cacheEpochPolicy
+	}{
+		{"repo over default", "", hello, cacheEpochPolicy{"monthly", policyFile, "2025-06"}},
+		{"flag over repo", "daily", hello, cacheEpochPolicy{"daily", "config", "2025-06-03"}},
+		{"spec over repo", "", never, cacheEpochPolicy{"never", "spec", ""}},
+		{"spec over flag and repo", "daily", never, cacheEpochPolicy{"never", "spec", ""}},
+	} {
+		if got := cacheEpoch(test.epoch, test.spec); *got != test.want {
+			t.Errorf("cacheEpoch() %s = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	// The epoch goes into the digest.
+	writeSpec(t, tmpDir, "Dockerfile", "FROM scratch\n")
+	specFile := writeSpec(t, tmpDir, "hello.wanda.yaml", strings.Join([]string{
+		"name: hello",
+		"dockerfile: Dockerfile",
+		"cache_epoch: weekly",
+	}, "\n"))
+	var buf strings.Builder
+	if err := DigestExplain(t.Context(), specFile, config, &buf); err != nil {
+		t.Fatalf("explain digest: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"policy": "weekly"`) ||
+		!strings.Contains(buf.String(), `"source": "spec"`) {
+		t.Errorf("explanation does not show the weekly spec policy:\n%s", buf.String())
+	}
+}
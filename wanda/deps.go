@@ -17,6 +17,10 @@ type depGraph struct {
 	// Contains only specs reachable from Root.
 	Order []string
 
+	// Layers groups Order into dependency layers. Specs in a layer only
+	// depend on specs in previous layers, so they can be built concurrently.
+	Layers [][]string
+
 	// Root is the name of the root spec (the one requested to build).
 	Root string
 
@@ -63,10 +67,14 @@ func buildDepGraph(specPath string, lookup lookupFunc, namePrefix, wandaSpecsFil
 	if err != nil {
 		return nil, fmt.Errorf("parse root spec: %w", err)
 	}
-	expanded := spec.expandVar(lookup)
+	expanded, err := spec.selectMatrixCombo(lookup)
+	if err != nil {
+		return nil, fmt.Errorf("expand root spec matrix: %w", err)
+	}
 	if err := checkUnexpandedVars(expanded, absPath); err != nil {
 		return nil, fmt.Errorf("check root spec: %w", err)
 	}
+	expanded.dir = filepath.Dir(absPath)
 	g.Root = expanded.Name
 	g.Specs[expanded.Name] = &resolvedSpec{Spec: expanded, Path: absPath}
 
@@ -206,6 +214,7 @@ func (g *depGraph) topoSort(reachable map[string]bool) error {
 	}
 
 	var order []string
+	var layers [][]string
 	for len(order) < len(reachable) {
 		// Collect all nodes with in-degree 0.
 		var layer []string
@@ -229,6 +238,7 @@ func (g *depGraph) topoSort(reachable map[string]bool) error {
 
 		// Sort layer alphabetically for deterministic order.
 		sort.Strings(layer)
+		layers = append(layers, layer)
 
 		// Add layer to order and remove from graph.
 		for _, name := range layer {
@@ -241,5 +251,6 @@ func (g *depGraph) topoSort(reachable map[string]bool) error {
 	}
 
 	g.Order = order
+	g.Layers = layers
 	return nil
 }
@@ -258,6 +258,11 @@ func TestBuildDepGraph_Diamond(t *testing.T) {
 	if indices["c"] > indices["a"] {
 		t.Errorf("c should come before a")
 	}
+
+	wantLayers := [][]string{{"d"}, {"b", "c"}, {"a"}}
+	if !reflect.DeepEqual(graph.Layers, wantLayers) {
+		t.Errorf("Layers = %v, want %v", graph.Layers, wantLayers)
+	}
 }
 
 func TestBuildDepGraph_CycleDetection(t *testing.T) {
@@ -0,0 +1,266 @@
+package wanda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// digestExplanation is the full input of a spec's content-addressed digest.
+// It is what `wanda digest -explain` dumps, and what `-diff` compares.
+type digestExplanation struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform,omitempty"`
+	Digest   string `json:"digest"`
+
+	// EpochPolicy is the cache epoch policy that set the epoch of the core.
+	EpochPolicy *cacheEpochPolicy `json:"epoch_policy,omitempty"`
+
+	Core  *buildInputCore  `json:"core"`
+	Files []*tarFileRecord `json:"files"`
+}
+
+// explainPlatform returns the platform to explain the digest of spec for.
+// Only one platform of a multi-platform spec can be explained at a time.
+func (f *Forge) explainPlatform(spec *Spec) (*platform, error) {
+	if len(spec.Platforms) == 0 {
+		return nil, nil
+	}
+	platforms, err := f.selectPlatforms(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(platforms) != 1 {
+		return nil, fmt.Errorf(
+			"%s has %d platforms; select one to explain", spec.Name, len(platforms),
+		)
+	}
+	return platforms[0], nil
+}
+
+// explainSpec resolves the digest of spec along with all of its inputs.
+func (f *Forge) explainSpec(ctx context.Context, spec *Spec) (*digestExplanation, error) {
+	p, err := f.explainPlatform(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	in, inputCore, err := f.resolveBuildInput(ctx, spec, p)
+	if err != nil {
+		return nil, err
+	}
+	inputDigest, err := inputCore.digest()
+	if err != nil {
+		return nil, fmt.Errorf("compute build input digest: %w", err)
+	}
+	records, err := in.context.records()
+	if err != nil {
+		return nil, fmt.Errorf("list build context records: %w", err)
+	}
+
+	e := &digestExplanation{
+		Name:        spec.Name,
+		Digest:      inputDigest,
+		EpochPolicy: f.cacheEpoch(spec),
+		Core:        inputCore,
+		Files:       records,
+	}
+	if p != nil {
+		e.Platform = p.String()
+	}
+	return e, nil
+}
+
+func readDigestExplanation(file string) (*digestExplanation, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	e := new(digestExplanation)
+	if err := json.Unmarshal(bs, e); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", file, err)
+	}
+	if e.Core == nil {
+		return nil, fmt.Errorf("%s: missing build input core", file)
+	}
+	return e, nil
+}
+
+func diffValue(field, old, new string) []string {
+	if old == new {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: %q -> %q", field, old, new)}
+}
+
+// diffMaps compares two string maps, reporting each key that was added,
+// removed or changed.
+func diffMaps(kind string, old, new map[string]string) []string {
+	keys := make(map[string]struct{})
+	for k := range old {
+		keys[k] = struct{}{}
+	}
+	for k := range new {
+		keys[k] = struct{}{}
+	}
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var diffs []string
+	for _, k := range sorted {
+		o, inOld := old[k]
+		n, inNew := new[k]
+		switch {
+		case !inOld:
+			diffs = append(diffs, fmt.Sprintf("%s %s: added %q", kind, k, n))
+		case !inNew:
+			diffs = append(diffs, fmt.Sprintf("%s %s: removed %q", kind, k, o))
+		case o != n:
+			diffs = append(diffs, fmt.Sprintf("%s %s: %q -> %q", kind, k, o, n))
+		}
+	}
+	return diffs
+}
+
+// diffTarFileRecord describes how a file in the build context changed.
+func diffTarFileRecord(old, new *tarFileRecord) string {
+	var changes []string
+	if old.ContentDigest != new.ContentDigest {
+		changes = append(changes, fmt.Sprintf(
+			"content %s -> %s", old.ContentDigest, new.ContentDigest,
+		))
+	}
+	if old.Size != new.Size {
+		changes = append(changes, fmt.Sprintf("size %d -> %d", old.Size, new.Size))
+	}
+	if old.Mode != new.Mode {
+		changes = append(changes, fmt.Sprintf("mode %o -> %o", old.Mode, new.Mode))
+	}
+	if old.UserID != new.UserID || old.GroupID != new.GroupID {
+		changes = append(changes, fmt.Sprintf(
+			"owner %d:%d -> %d:%d",
+			old.UserID, old.GroupID, new.UserID, new.GroupID,
+		))
+	}
+	if old.Symlink != new.Symlink {
+		changes = append(changes, fmt.Sprintf(
+			"symlink %q -> %q", old.Symlink, new.Symlink,
+		))
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("file %s: changed (%s)", new.Name, strings.Join(changes, ", "))
+}
+
+// diffTarFileRecords compares the build context files of two explanations.
+func diffTarFileRecords(old, new []*tarFileRecord) []string {
+	oldFiles := make(map[string]*tarFileRecord, len(old))
+	for _, r := range old {
+		oldFiles[r.Name] = r
+	}
+	newFiles := make(map[string]*tarFileRecord, len(new))
+	for _, r := range new {
+		newFiles[r.Name] = r
+	}
+
+	var diffs []string
+	for _, r := range old {
+		if _, ok := newFiles[r.Name]; !ok {
+			diffs = append(diffs, "file "+r.Name+": removed")
+		}
+	}
+	for _, r := range new {
+		o, ok := oldFiles[r.Name]
+		if !ok {
+			diffs = append(diffs, "file "+r.Name+": added")
+			continue
+		}
+		if d := diffTarFileRecord(o, r); d != "" {
+			diffs = append(diffs, d)
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// diffExplanations lists the differences between the inputs of two digests,
+// one per line. It returns nil if the inputs are the same.
+func diffExplanations(old, new *digestExplanation) []string {
+	var diffs []string
+	oc, nc := old.Core, new.Core
+	diffs = append(diffs, diffValue("epoch", oc.Epoch, nc.Epoch)...)
+	diffs = append(diffs, diffValue("dockerfile", oc.Dockerfile, nc.Dockerfile)...)
+	diffs = append(diffs, diffValue("target", oc.Target, nc.Target)...)
+	diffs = append(diffs, diffValue("platform", oc.Platform, nc.Platform)...)
+	diffs = append(diffs, diffValue("os", oc.OS, nc.OS)...)
+	diffs = append(diffs, diffValue("context owner", oc.ContextOwner, nc.ContextOwner)...)
+	diffs = append(diffs, diffValue("engine", oc.Engine, nc.Engine)...)
+	diffs = append(diffs, diffMaps("build arg", oc.BuildArgs, nc.BuildArgs)...)
+	diffs = append(diffs, diffMaps("base image", oc.Froms, nc.Froms)...)
+	diffs = append(diffs, diffTarFileRecords(old.Files, new.Files)...)
+
+	if len(diffs) == 0 && oc.BuildContext != nc.BuildContext {
+		// Should not happen when the file records are complete.
+		diffs = append(diffs, diffValue("build context", oc.BuildContext, nc.BuildContext)...)
+	}
+	return diffs
+}
+
+// DigestExplain writes the full input of the content-addressed digest of the
+// given spec file to w as JSON: the build input core that is hashed, and the
+// record of every file in the build context.
+func DigestExplain(ctx context.Context, specFile string, config *ForgeConfig, w io.Writer) error {
+	s, err := newBuildSession(specFile, config)
+	if err != nil {
+		return err
+	}
+
+	e, err := s.forge.explainSpec(ctx, s.graph.Specs[s.graph.Root].Spec)
+	if err != nil {
+		return fmt.Errorf("explain digest for %s: %w", s.graph.Root, err)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(e)
+}
+
+// DigestDiff compares the digest input dumped to oldFile by DigestExplain
+// with the current digest input of the given spec file, and writes what
+// changed to w.
+func DigestDiff(
+	ctx context.Context, specFile string, config *ForgeConfig, oldFile string, w io.Writer,
+) error {
+	old, err := readDigestExplanation(oldFile)
+	if err != nil {
+		return fmt.Errorf("read old digest input: %w", err)
+	}
+
+	s, err := newBuildSession(specFile, config)
+	if err != nil {
+		return err
+	}
+
+	e, err := s.forge.explainSpec(ctx, s.graph.Specs[s.graph.Root].Spec)
+	if err != nil {
+		return fmt.Errorf("explain digest for %s: %w", s.graph.Root, err)
+	}
+
+	if old.Digest == e.Digest {
+		fmt.Fprintf(w, "digest unchanged: %s\n", e.Digest)
+		return nil
+	}
+	fmt.Fprintf(w, "digest changed: %s -> %s\n", old.Digest, e.Digest)
+	for _, d := range diffExplanations(old, e) {
+		fmt.Fprintf(w, "  %s\n", d)
+	}
+	return nil
+}
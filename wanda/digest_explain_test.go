@@ -0,0 +1,149 @@
+package wanda
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDigestExplain(t *testing.T) {
+	config := &ForgeConfig{
+		WorkDir:    "testdata",
+		NamePrefix: "cr.ray.io/rayproject/",
+		Epoch:      "1",
+	}
+
+	var buf strings.Builder
+	if err := DigestExplain(t.Context(), "testdata/glob.wanda.yaml", config, &buf); err != nil {
+		t.Fatalf("DigestExplain() = %v, want nil", err)
+	}
+
+	e := new(digestExplanation)
+	if err := json.Unmarshal([]byte(buf.String()), e); err != nil {
+		t.Fatalf("unmarshal %q: %v", buf.String(), err)
+	}
+
+	var digestBuf strings.Builder
+	if err := Digest(t.Context(), "testdata/glob.wanda.yaml", config, &digestBuf); err != nil {
+		t.Fatalf("Digest() = %v, want nil", err)
+	}
+	if want := strings.TrimSpace(digestBuf.String()); e.Digest != want {
+		t.Errorf("explained digest = %q, want %q", e.Digest, want)
+	}
+	if got, err := e.Core.digest(); err != nil || got != e.Digest {
+		t.Errorf("core digest = %q, %v; want %q", got, err, e.Digest)
+	}
+	if got, err := digestTarFileRecords(e.Files); err != nil || got != e.Core.BuildContext {
+		t.Errorf("files digest = %q, %v; want %q", got, err, e.Core.BuildContext)
+	}
+
+	var names []string
+	for _, f := range e.Files {
+		names = append(names, f.Name)
+	}
+	want := []string{"Dockerfile.glob", "src/foo.cpp", "src/foo.h", "world.txt"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("files = %v, want %v", names, want)
+	}
+	if e.Name != "glob" || e.Core.Epoch != "1" {
+		t.Errorf("got name %q epoch %q, want glob and 1", e.Name, e.Core.Epoch)
+	}
+	wantPolicy := &cacheEpochPolicy{Policy: "1", Source: "config", Epoch: "1"}
+	if !reflect.DeepEqual(e.EpochPolicy, wantPolicy) {
+		t.Errorf("epoch policy = %+v, want %+v", e.EpochPolicy, wantPolicy)
+	}
+}
+
+func TestDigestDiff(t *testing.T) {
+	config := &ForgeConfig{
+		WorkDir:    "testdata",
+		NamePrefix: "cr.ray.io/rayproject/",
+		Epoch:      "1",
+	}
+
+	var buf strings.Builder
+	if err := DigestExplain(t.Context(), "testdata/hello-test.wanda.yaml", config, &buf); err != nil {
+		t.Fatalf("DigestExplain() = %v, want nil", err)
+	}
+	oldFile := filepath.Join(t.TempDir(), "old.json")
+	if err := os.WriteFile(oldFile, []byte(buf.String()), 0644); err != nil {
+		t.Fatalf("write old dump: %v", err)
+	}
+
+	var same strings.Builder
+	if err := DigestDiff(t.Context(), "testdata/hello-test.wanda.yaml", config, oldFile, &same); err != nil {
+		t.Fatalf("DigestDiff() = %v, want nil", err)
+	}
+	if !strings.HasPrefix(same.String(), "digest unchanged: sha256:") {
+		t.Errorf("DigestDiff() with same input = %q", same.String())
+	}
+
+	config.Epoch = "2"
+	var changed strings.Builder
+	if err := DigestDiff(t.Context(), "testdata/hello-test.wanda.yaml", config, oldFile, &changed); err != nil {
+		t.Fatalf("DigestDiff() = %v, want nil", err)
+	}
+	got := changed.String()
+	if !strings.HasPrefix(got, "digest changed: ") {
+		t.Errorf("DigestDiff() = %q, want digest changed", got)
+	}
+	if !strings.Contains(got, `  epoch: "1" -> "2"`) {
+		t.Errorf("DigestDiff() = %q, want epoch change", got)
+	}
+}
+
+func TestDiffExplanations(t *testing.T) {
+	old := &digestExplanation{
+		Core: &buildInputCore{
+			Epoch:        "a",
+			Dockerfile:   "Dockerfile",
+			Froms:        map[string]string{"ubuntu:22.04": "sha256:111"},
+			BuildArgs:    map[string]string{"A": "1", "B": "2"},
+			ContextOwner: "",
+		},
+		Files: []*tarFileRecord{
+			{Name: "Dockerfile", Mode: 0o644, Size: 10, ContentDigest: "sha256:d"},
+			{Name: "gone.txt", Mode: 0o644, Size: 1, ContentDigest: "sha256:g"},
+			{Name: "run.sh", Mode: 0o644, Size: 3, ContentDigest: "sha256:r"},
+		},
+	}
+	new := &digestExplanation{
+		Core: &buildInputCore{
+			Epoch:        "b",
+			Dockerfile:   "Dockerfile",
+			Froms:        map[string]string{"ubuntu:22.04": "sha256:222"},
+			BuildArgs:    map[string]string{"A": "1", "C": "3"},
+			ContextOwner: "1000:100",
+			Target:       "runtime",
+		},
+		Files: []*tarFileRecord{
+			{Name: "Dockerfile", Mode: 0o644, Size: 10, ContentDigest: "sha256:d"},
+			{Name: "new.txt", Mode: 0o644, Size: 1, ContentDigest: "sha256:n"},
+			{Name: "run.sh", Mode: 0o755, Size: 4, ContentDigest: "sha256:s"},
+		},
+	}
+
+	got := diffExplanations(old, new)
+	want := []string{
+		`epoch: "a" -> "b"`,
+		`target: "" -> "runtime"`,
+		`context owner: "" -> "1000:100"`,
+		`build arg B: removed "2"`,
+		`build arg C: added "3"`,
+		`base image ubuntu:22.04: "sha256:111" -> "sha256:222"`,
+		"file gone.txt: removed",
+		"file new.txt: added",
+		"file run.sh: changed (content sha256:r -> sha256:s, size 3 -> 4, mode 644 -> 755)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffExplanations() =\n%s\nwant\n%s",
+			strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if d := diffExplanations(old, old); d != nil {
+		t.Errorf("diffExplanations() of same input = %v, want nil", d)
+	}
+}
@@ -2,38 +2,55 @@ package wanda
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"runtime"
+	"slices"
 	"sort"
 	"strings"
+	"time"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
 )
 
-func dockerCmdEnvs() []string {
+// cmdEnvs returns the environment variables with the given keys that are
+// set, in KEY=value form.
+func cmdEnvs(keys ...string) []string {
 	var envs []string
-	for _, k := range []string{
-		"HOME",
-		"USER",
-		"PATH",
-		"DOCKER_CONFIG",
-		"AWS_REGION",
-	} {
+	for _, k := range keys {
 		if v, ok := os.LookupEnv(k); ok {
 			envs = append(envs, fmt.Sprintf("%s=%s", k, v))
 		}
 	}
-
 	return envs
 }
 
+func dockerCmdEnvs() []string {
+	return cmdEnvs(
+		"HOME",
+		"USER",
+		"PATH",
+		"DOCKER_CONFIG",
+		"AWS_REGION",
+	)
+}
+
 type dockerCmd struct {
 	bin     string
 	workDir string
 
 	envs []string
 
+	stdout io.Writer
+	stderr io.Writer
+	logger *log.Logger
+
 	useLegacyEngine bool
 }
 
@@ -60,16 +77,40 @@ func newDockerCmd(config *dockerCmdConfig) *dockerCmd {
 	return &dockerCmd{
 		bin:             bin,
 		envs:            envs,
+		stdout:          os.Stdout,
+		stderr:          os.Stderr,
+		logger:          log.Default(),
 		useLegacyEngine: config.useLegacyEngine,
 	}
 }
 
 func (c *dockerCmd) setWorkDir(dir string) { c.workDir = dir }
 
-func (c *dockerCmd) cmd(args ...string) *exec.Cmd {
-	cmd := exec.Command(c.bin, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// setOutput redirects the logs and the output of the docker commands.
+func (c *dockerCmd) setOutput(out *buildOutput) {
+	c.stdout = out.stdout
+	c.stderr = out.stderr
+	c.logger = out.log
+}
+
+// dockerStopTimeout is how long a docker command has to exit after it is
+// interrupted because its context is done, before it is killed.
+const dockerStopTimeout = 10 * time.Second
+
+// cmd returns the docker command with the given args. When ctx is done, the
+// command is interrupted, so that docker can stop what it started, like a
+// build, and then killed if it does not exit within dockerStopTimeout.
+func (c *dockerCmd) cmd(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, c.bin, args...)
+	cmd.Cancel = func() error {
+		if runtime.GOOS == "windows" {
+			return cmd.Process.Kill()
+		}
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = dockerStopTimeout
+	cmd.Stdout = c.stdout
+	cmd.Stderr = c.stderr
 	cmd.Env = c.envs
 	if c.workDir != "" {
 		cmd.Dir = c.workDir
@@ -77,13 +118,13 @@ func (c *dockerCmd) cmd(args ...string) *exec.Cmd {
 	return cmd
 }
 
-func (c *dockerCmd) run(args ...string) error {
-	cmd := c.cmd(args...)
+func (c *dockerCmd) run(ctx context.Context, args ...string) error {
+	cmd := c.cmd(ctx, args...)
 	return cmd.Run()
 }
 
-func (c *dockerCmd) output(args ...string) ([]byte, error) {
-	cmd := c.cmd(args...)
+func (c *dockerCmd) output(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := c.cmd(ctx, args...)
 	buf := new(bytes.Buffer)
 	cmd.Stdout = buf
 	if err := cmd.Run(); err != nil {
@@ -92,13 +133,13 @@ func (c *dockerCmd) output(args ...string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (c *dockerCmd) pull(src, asTag string) error {
-	if err := c.run("pull", src); err != nil {
+func (c *dockerCmd) pull(ctx context.Context, src, asTag string) error {
+	if err := c.run(ctx, "pull", src); err != nil {
 		return fmt.Errorf("pull %s: %w", src, err)
 	}
 
 	if src != asTag {
-		if err := c.tag(src, asTag); err != nil {
+		if err := c.tag(ctx, src, asTag); err != nil {
 			return fmt.Errorf("tag %s %s: %w", src, asTag, err)
 		}
 	}
@@ -112,8 +153,24 @@ type dockerImageInfo struct {
 	RepoTags    []string
 }
 
-func (c *dockerCmd) inspectImage(tag string) (*dockerImageInfo, error) {
-	cmd := c.cmd("image", "inspect", tag)
+// repoDigest returns the repo digest of the image in the repository of
+// tag, or "" if the image has not been pushed to or pulled from there.
+func (info *dockerImageInfo) repoDigest(tag string) string {
+	ref, err := cranename.ParseReference(tag)
+	if err != nil {
+		return ""
+	}
+	for _, rd := range info.RepoDigests {
+		d, err := cranename.NewDigest(rd)
+		if err == nil && d.Context().Name() == ref.Context().Name() {
+			return rd
+		}
+	}
+	return ""
+}
+
+func (c *dockerCmd) inspectImage(ctx context.Context, tag string) (*dockerImageInfo, error) {
+	cmd := c.cmd(ctx, "image", "inspect", tag)
 	buf := new(bytes.Buffer)
 	cmd.Stdout = buf
 	if err := cmd.Run(); err != nil {
@@ -132,17 +189,44 @@ func (c *dockerCmd) inspectImage(tag string) (*dockerImageInfo, error) {
 	return info[0], nil
 }
 
-func (c *dockerCmd) tag(src, asTag string) error {
-	return c.run("tag", src, asTag)
+func (c *dockerCmd) tag(ctx context.Context, src, asTag string) error {
+	return c.run(ctx, "tag", src, asTag)
+}
+
+// push pushes tag with docker. The error output of docker is kept in the
+// returned error, so that the failure can be classified.
+func (c *dockerCmd) push(ctx context.Context, tag string) error {
+	cmd := c.cmd(ctx, "push", tag)
+	buf := new(bytes.Buffer)
+	if c.stderr != nil {
+		cmd.Stderr = io.MultiWriter(c.stderr, buf)
+	} else {
+		cmd.Stderr = buf
+	}
+	if err := cmd.Run(); err != nil {
+		return &dockerPushError{tag: tag, err: err, output: buf.String()}
+	}
+	return nil
 }
 
 // createContainer creates a container from an image without starting it.
 // Returns the container ID.
-func (c *dockerCmd) createContainer(image string) (string, error) {
+func (c *dockerCmd) createContainer(ctx context.Context, image string) (string, error) {
+	// Name the container, so that it can still be removed if the command is
+	// interrupted after docker created it, but before it printed the ID.
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", fmt.Errorf("generate container name: %w", err)
+	}
+	name := fmt.Sprintf("wanda-%x", suffix)
+
 	// "true" is a no-op command required for images without CMD/ENTRYPOINT.
 	// The container is never started, so the command doesn't actually run.
-	out, err := c.output("create", image, "true")
+	out, err := c.output(ctx, "create", "--name", name, image, "true")
 	if err != nil {
+		if ctx.Err() != nil {
+			c.removeContainer(ctx, name) // Might not exist; best effort.
+		}
 		return "", err
 	}
 	return strings.TrimSpace(string(out)), nil
@@ -151,23 +235,25 @@ func (c *dockerCmd) createContainer(image string) (string, error) {
 // copyFromContainer copies a file or directory from a container to the host.
 // If src ends with "/", the contents of the directory are copied (not the
 // directory itself) by appending "." per docker cp convention.
-func (c *dockerCmd) copyFromContainer(containerID, src, dst string) error {
+func (c *dockerCmd) copyFromContainer(ctx context.Context, containerID, src, dst string) error {
 	if strings.HasSuffix(src, "/") {
 		src += "."
 	}
-	return c.run("cp", containerID+":"+src, dst)
+	return c.run(ctx, "cp", containerID+":"+src, dst)
 }
 
-func (c *dockerCmd) removeContainer(containerID string) error {
-	return c.run("rm", containerID)
+// removeContainer removes a container. It still runs when ctx is done, so
+// that an interrupted build does not leave its containers behind, but gives
+// up after dockerStopTimeout.
+func (c *dockerCmd) removeContainer(ctx context.Context, containerID string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), dockerStopTimeout)
+	defer cancel()
+	return c.run(ctx, "rm", containerID)
 }
 
-func (c *dockerCmd) build(in *buildInput, core *buildInputCore, hints *buildInputHints) error {
-	if hints == nil {
-		hints = newBuildInputHints(nil, nil)
-	}
-
-	// Pull down the required images, and tag them properly.
+// pullFroms pulls the remote base images of the build, and tags them with
+// the names that the Dockerfile uses.
+func (c *dockerCmd) pullFroms(ctx context.Context, in *buildInput, core *buildInputCore) error {
 	var froms []string
 	for from := range core.Froms {
 		froms = append(froms, from)
@@ -182,18 +268,23 @@ func (c *dockerCmd) build(in *buildInput, core *buildInputCore, hints *buildInpu
 		if src.local != "" { // local image, already ready.
 			continue
 		}
-		if err := c.pull(src.src, src.name); err != nil {
+		if err := c.pull(ctx, src.src, src.name); err != nil {
 			return fmt.Errorf("pull %s(%s): %w", src.name, src.src, err)
 		}
 	}
 	// TODO(aslonnie): maybe recheck all the IDs of the from images?
+	return nil
+}
 
-	// Build the image.
-	var args []string
-	args = append(args, "build")
-	if !c.useLegacyEngine {
-		args = append(args, "--progress=plain")
+// buildFlags returns the flags of a build command of engine for the input,
+// and the environment variables that the build secrets are read from.
+func buildFlags(
+	engine string, in *buildInput, core *buildInputCore, hints *buildInputHints,
+) (args, envs []string) {
+	if hints == nil {
+		hints = newBuildInputHints(nil, nil)
 	}
+
 	// Give the build a name for the agent it runs on. A wanda step runs directly on the
 	// agent rather than in a container, so a service listening there -- a package index,
 	// say -- is outside the build's own network namespace and otherwise unreachable from a
@@ -211,12 +302,24 @@ func (c *dockerCmd) build(in *buildInput, core *buildInputCore, hints *buildInpu
 	// Deliberately not --network=host, which would also work: that shares the agent's
 	// network namespace with the build, exposing whatever else listens there, including on
 	// loopback. This adds one hosts entry and leaves the namespace intact.
-	args = append(args, "--add-host", "rayci.localhost:host-gateway")
+	//
+	// host-gateway is docker's; podman adds host.containers.internal for
+	// the host by itself.
+	if engine != enginePodman {
+		args = append(args, "--add-host", "rayci.localhost:host-gateway")
+	}
 	args = append(args, "-f", core.Dockerfile)
+	if core.Target != "" {
+		args = append(args, "--target", core.Target)
+	}
+	if in.platform != nil {
+		args = append(args, "--platform", in.platform.String())
+	}
 
 	for _, t := range in.tagList() {
 		args = append(args, "-t", t)
 	}
+	args = append(args, labelArgs(in.labels)...)
 
 	buildArgs := make(map[string]string)
 	for k, v := range hints.BuildArgs {
@@ -237,12 +340,43 @@ func (c *dockerCmd) build(in *buildInput, core *buildInputCore, hints *buildInpu
 		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", k, v))
 	}
 
+	for _, s := range in.secrets {
+		args = append(args, "--secret", s.arg())
+		if s.env != "" {
+			envs = append(envs, fmt.Sprintf("%s=%s", s.env, s.value))
+		}
+	}
+	return args, envs
+}
+
+func (c *dockerCmd) build(
+	ctx context.Context, in *buildInput, core *buildInputCore, hints *buildInputHints,
+) error {
+	if len(in.secrets) > 0 && c.useLegacyEngine {
+		return fmt.Errorf("build secrets need buildkit")
+	}
+
+	// Pull down the required images, and tag them properly.
+	if err := c.pullFroms(ctx, in, core); err != nil {
+		return err
+	}
+
+	// Build the image.
+	var args []string
+	args = append(args, "build")
+	if !c.useLegacyEngine {
+		args = append(args, "--progress=plain")
+	}
+	flags, secretEnvs := buildFlags(engineDocker, in, core, hints)
+	args = append(args, flags...)
+
 	// read context from stdin
 	args = append(args, "-")
 
-	log.Printf("docker %s", strings.Join(args, " "))
+	c.logger.Printf("docker %s", strings.Join(redactSecretArgs(args), " "))
 
-	buildCmd := c.cmd(args...)
+	buildCmd := c.cmd(ctx, args...)
+	buildCmd.Env = slices.Concat(buildCmd.Env, secretEnvs)
 	if in.context != nil {
 		buildCmd.Stdin = newWriterToReader(in.context)
 	}
@@ -1,10 +1,14 @@
 package wanda
 
 import (
+	"context"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
@@ -32,7 +36,7 @@ func TestDockerCmdBuild(t *testing.T) {
 		"MESSAGE=does not matter", // will be shadowed by the build args
 	}, nil)
 
-	if err := cmd.build(input, core, hints); err != nil {
+	if err := cmd.build(t.Context(), input, core, hints); err != nil {
 		t.Fatalf("build: %v", err)
 	}
 
@@ -94,7 +98,7 @@ func TestDockerCmdBuild_addHost(t *testing.T) {
 		t.Fatalf("make build input core: %v", err)
 	}
 
-	if err := cmd.build(input, core, newBuildInputHints(nil, nil)); err != nil {
+	if err := cmd.build(t.Context(), input, core, newBuildInputHints(nil, nil)); err != nil {
 		t.Fatalf("build with add-host: %v", err)
 	}
 }
@@ -120,7 +124,7 @@ func TestDockerCmdBuild_withHints(t *testing.T) {
 		"MESSAGE=hint message", // will be shadowed by the build args
 	}, nil)
 
-	if err := cmd.build(input, core, hints); err != nil {
+	if err := cmd.build(t.Context(), input, core, hints); err != nil {
 		t.Fatalf("build: %v", err)
 	}
 
@@ -162,25 +166,47 @@ func TestDockerCmdBuild_withHints(t *testing.T) {
 	}
 }
 
+func TestDockerCmdRun_cancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sleep as the docker binary")
+	}
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not found")
+	}
+	cmd := newDockerCmd(&dockerCmdConfig{bin: sleep})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := cmd.run(ctx, "60"); err == nil {
+		t.Fatal("run: got nil error, want interrupted")
+	}
+	if d := time.Since(start); d >= dockerStopTimeout {
+		t.Errorf("run took %s, want it interrupted before it is killed", d)
+	}
+}
+
 func TestDockerCmdCopyFromContainer(t *testing.T) {
 	cmd := newDockerCmd(&dockerCmdConfig{})
 
 	const testImage = "alpine:latest"
 
-	if err := cmd.run("pull", testImage); err != nil {
+	if err := cmd.run(t.Context(), "pull", testImage); err != nil {
 		t.Fatalf("pull image: %v", err)
 	}
 
-	containerID, err := cmd.createContainer(testImage)
+	containerID, err := cmd.createContainer(t.Context(), testImage)
 	if err != nil {
 		t.Fatalf("createContainer: %v", err)
 	}
-	defer cmd.removeContainer(containerID)
+	defer cmd.removeContainer(t.Context(), containerID)
 
 	tmpDir := t.TempDir()
 
 	// Copy a known file from the container
-	if err := cmd.copyFromContainer(containerID, "/etc/alpine-release", filepath.Join(tmpDir, "alpine-release")); err != nil {
+	if err := cmd.copyFromContainer(t.Context(), containerID, "/etc/alpine-release", filepath.Join(tmpDir, "alpine-release")); err != nil {
 		t.Fatalf("copyFromContainer: %v", err)
 	}
 
@@ -194,20 +220,20 @@ func TestDockerCmdCopyFromContainer_directory(t *testing.T) {
 
 	const testImage = "alpine:latest"
 
-	if err := cmd.run("pull", testImage); err != nil {
+	if err := cmd.run(t.Context(), "pull", testImage); err != nil {
 		t.Fatalf("pull image: %v", err)
 	}
 
-	containerID, err := cmd.createContainer(testImage)
+	containerID, err := cmd.createContainer(t.Context(), testImage)
 	if err != nil {
 		t.Fatalf("createContainer: %v", err)
 	}
-	defer cmd.removeContainer(containerID)
+	defer cmd.removeContainer(t.Context(), containerID)
 
 	tmpDir := t.TempDir()
 
 	// Copy a directory from the container
-	if err := cmd.copyFromContainer(containerID, "/etc", filepath.Join(tmpDir, "etc")); err != nil {
+	if err := cmd.copyFromContainer(t.Context(), containerID, "/etc", filepath.Join(tmpDir, "etc")); err != nil {
 		t.Fatalf("copyFromContainer: %v", err)
 	}
 
@@ -221,15 +247,15 @@ func TestDockerCmdCopyFromContainer_directoryContents(t *testing.T) {
 
 	const testImage = "alpine:latest"
 
-	if err := cmd.run("pull", testImage); err != nil {
+	if err := cmd.run(t.Context(), "pull", testImage); err != nil {
 		t.Fatalf("pull image: %v", err)
 	}
 
-	containerID, err := cmd.createContainer(testImage)
+	containerID, err := cmd.createContainer(t.Context(), testImage)
 	if err != nil {
 		t.Fatalf("createContainer: %v", err)
 	}
-	defer cmd.removeContainer(containerID)
+	defer cmd.removeContainer(t.Context(), containerID)
 
 	tmpDir := t.TempDir()
 	dst := filepath.Join(tmpDir, "out")
@@ -238,7 +264,7 @@ func TestDockerCmdCopyFromContainer_directoryContents(t *testing.T) {
 	}
 
 	// Trailing slash on src copies contents, not the directory itself.
-	if err := cmd.copyFromContainer(containerID, "/etc/apk/", dst); err != nil {
+	if err := cmd.copyFromContainer(t.Context(), containerID, "/etc/apk/", dst); err != nil {
 		t.Fatalf("copyFromContainer: %v", err)
 	}
 
@@ -256,20 +282,40 @@ func TestDockerCmdCopyFromContainer_notFound(t *testing.T) {
 
 	const testImage = "alpine:latest"
 
-	if err := cmd.run("pull", testImage); err != nil {
+	if err := cmd.run(t.Context(), "pull", testImage); err != nil {
 		t.Fatalf("pull image: %v", err)
 	}
 
-	containerID, err := cmd.createContainer(testImage)
+	containerID, err := cmd.createContainer(t.Context(), testImage)
 	if err != nil {
 		t.Fatalf("createContainer: %v", err)
 	}
-	defer cmd.removeContainer(containerID)
+	defer cmd.removeContainer(t.Context(), containerID)
 
 	tmpDir := t.TempDir()
 
 	// Copying a non-existent file should fail
-	if err := cmd.copyFromContainer(containerID, "/nonexistent/file", filepath.Join(tmpDir, "file")); err == nil {
+	if err := cmd.copyFromContainer(t.Context(), containerID, "/nonexistent/file", filepath.Join(tmpDir, "file")); err == nil {
 		t.Error("copyFromContainer should fail for non-existent file")
 	}
 }
+
+func TestDockerImageInfoRepoDigest(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+	info := &dockerImageInfo{RepoDigests: []string{
+		"ubuntu@sha256:" + hex,
+		"localhost:5000/work@sha256:" + hex,
+	}}
+	for _, test := range []struct {
+		tag  string
+		want string
+	}{
+		{"localhost:5000/work:z-abc", "localhost:5000/work@sha256:" + hex},
+		{"docker.io/library/ubuntu:22.04", "ubuntu@sha256:" + hex},
+		{"cr.ray.io/rayproject/hello", ""},
+	} {
+		if got := info.repoDigest(test.tag); got != test.want {
+			t.Errorf("repoDigest(%q) = %q, want %q", test.tag, got, test.want)
+		}
+	}
+}
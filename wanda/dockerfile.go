@@ -0,0 +1,378 @@
+package wanda
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// dockerfileInstruction is an instruction in a Dockerfile, with line
+// continuations joined and heredoc bodies skipped.
+type dockerfileInstruction struct {
+	Cmd   string   // Upper-cased instruction, e.g. "FROM".
+	Flags []string // Leading "--flag=value" arguments.
+	Args  []string // Arguments after the flags, JSON form decoded.
+	Line  int      // Line number where the instruction starts.
+}
+
+// flag returns the value of the --name=value flag of the instruction.
+func (i *dockerfileInstruction) flag(name string) (string, bool) {
+	prefix := "--" + name + "="
+	for _, f := range i.Flags {
+		if v, ok := strings.CutPrefix(f, prefix); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+var dockerfileHeredocRegexp = regexp.MustCompile(`<<(-?)(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)`)
+
+// parseDockerfile parses the instructions of a Dockerfile. It understands
+// comments, the escape parser directive, line continuations and heredocs,
+// which is enough to inspect the images and files that a Dockerfile uses.
+func parseDockerfile(r io.Reader) ([]*dockerfileInstruction, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	escape := `\`
+	directives := true // Parser directives are only allowed at the top.
+
+	var insts []*dockerfileInstruction
+	var heredocs []string // Pending heredoc terminators to skip.
+	var stripTabs []bool
+
+	var cur strings.Builder
+	curLine := 0
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+
+		if len(heredocs) > 0 {
+			body := line
+			if stripTabs[0] {
+				body = strings.TrimLeft(body, "\t")
+			}
+			if body == heredocs[0] {
+				heredocs, stripTabs = heredocs[1:], stripTabs[1:]
+			}
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if directives {
+			if k, v, ok := parseDockerfileDirective(trimmed); ok {
+				if k == "escape" {
+					escape = v
+				}
+				continue
+			}
+			directives = false
+		}
+
+		if strings.HasPrefix(trimmed, "#") {
+			continue // Comments, also allowed within continuations.
+		}
+		if cur.Len() == 0 {
+			if trimmed == "" {
+				continue
+			}
+			curLine = lineNum
+		}
+
+		if strings.HasSuffix(trimmed, escape) {
+			cur.WriteString(strings.TrimSuffix(trimmed, escape))
+			cur.WriteString(" ")
+			continue
+		}
+		cur.WriteString(trimmed)
+
+		inst, err := parseDockerfileInstruction(cur.String(), curLine)
+		if err != nil {
+			return nil, err
+		}
+		cur.Reset()
+		if inst == nil {
+			continue
+		}
+		insts = append(insts, inst)
+
+		switch inst.Cmd {
+		case "RUN", "COPY", "ADD":
+			for _, m := range dockerfileHeredocRegexp.FindAllStringSubmatch(
+				strings.Join(inst.Args, " "), -1,
+			) {
+				if m[2] != m[4] {
+					continue // Mismatched quotes, not a heredoc.
+				}
+				heredocs = append(heredocs, m[3])
+				stripTabs = append(stripTabs, m[1] == "-")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cur.Len() > 0 {
+		inst, err := parseDockerfileInstruction(cur.String(), curLine)
+		if err != nil {
+			return nil, err
+		}
+		if inst != nil {
+			insts = append(insts, inst)
+		}
+	}
+	return insts, nil
+}
+
+// parseDockerfileDirective parses a "# key=value" parser directive line.
+func parseDockerfileDirective(line string) (string, string, bool) {
+	body, ok := strings.CutPrefix(line, "#")
+	if !ok {
+		return "", "", false
+	}
+	k, v, ok := strings.Cut(body, "=")
+	if !ok {
+		return "", "", false
+	}
+	k = strings.ToLower(strings.TrimSpace(k))
+	if k == "" || strings.ContainsAny(k, " \t") {
+		return "", "", false
+	}
+	return k, strings.TrimSpace(v), true
+}
+
+func parseDockerfileInstruction(s string, line int) (*dockerfileInstruction, error) {
+	cmd, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	if cmd == "" {
+		return nil, nil
+	}
+	inst := &dockerfileInstruction{
+		Cmd:  strings.ToUpper(cmd),
+		Line: line,
+	}
+
+	rest = strings.TrimSpace(rest)
+	for strings.HasPrefix(rest, "--") {
+		var f string
+		f, rest, _ = strings.Cut(rest, " ")
+		inst.Flags = append(inst.Flags, f)
+		rest = strings.TrimSpace(rest)
+	}
+
+	if strings.HasPrefix(rest, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(rest), &args); err == nil {
+			inst.Args = args
+			return inst, nil
+		}
+		// Not valid JSON, docker treats it as shell form.
+	}
+	inst.Args = strings.Fields(rest)
+	return inst, nil
+}
+
+func parseDockerfileFile(file string) ([]*dockerfileInstruction, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	insts, err := parseDockerfile(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", file, err)
+	}
+	return insts, nil
+}
+
+// expandDockerfileVars substitutes $VAR, ${VAR}, ${VAR:-word} and
+// ${VAR:+word} in s the way docker does for ARG and ENV values. It returns
+// the names of the variables that were used but not defined.
+func expandDockerfileVars(s string, vars map[string]string) (string, []string) {
+	var b strings.Builder
+	var missing []string
+
+	isNameChar := func(c byte) bool {
+		return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && s[i+1] == '$' {
+			b.WriteByte('$')
+			i++
+			continue
+		}
+		if c != '$' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+
+		if s[i+1] == '{' {
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				b.WriteString(s[i:])
+				break
+			}
+			expr := s[i+2 : i+end]
+			i += end
+
+			name, word, op := expr, "", ""
+			for _, o := range []string{":-", ":+", "-", "+"} {
+				if n, w, ok := strings.Cut(expr, o); ok {
+					name, word, op = n, w, o
+					break
+				}
+			}
+			v, ok := vars[name]
+			switch op {
+			case ":-", "-":
+				if !ok || (op == ":-" && v == "") {
+					v, _ = expandDockerfileVars(word, vars)
+				}
+			case ":+", "+":
+				if ok && (op == "+" || v != "") {
+					v, _ = expandDockerfileVars(word, vars)
+				} else {
+					v = ""
+				}
+			default:
+				if !ok {
+					missing = append(missing, name)
+				}
+			}
+			b.WriteString(v)
+			continue
+		}
+
+		j := i + 1
+		for j < len(s) && isNameChar(s[j]) {
+			j++
+		}
+		if j == i+1 {
+			b.WriteByte(c)
+			continue
+		}
+		name := s[i+1 : j]
+		v, ok := vars[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+		b.WriteString(v)
+		i = j - 1
+	}
+	return b.String(), missing
+}
+
+// dockerfileScope tracks the variables in effect while walking through the
+// instructions of a Dockerfile.
+type dockerfileScope struct {
+	buildArgs map[string]string
+
+	global map[string]string // Global ARGs that have a value.
+
+	stage      map[string]string // ARG and ENV values in the current stage.
+	stageNames []string          // Stage names seen so far, lower-cased.
+	inStage    bool
+}
+
+// platformArgs returns the automatic platform build args for p.
+func platformArgs(p *platform) map[string]string {
+	return map[string]string{
+		"TARGETPLATFORM": p.String(),
+		"TARGETOS":       p.OS,
+		"TARGETARCH":     p.Arch,
+		"BUILDPLATFORM":  p.String(),
+		"BUILDOS":        p.OS,
+		"BUILDARCH":      p.Arch,
+	}
+}
+
+func newDockerfileScope(buildArgs map[string]string, p *platform) *dockerfileScope {
+	return &dockerfileScope{
+		buildArgs: buildArgs,
+		global:    platformArgs(p),
+	}
+}
+
+// vars returns the variables that can be used by the current instruction.
+func (s *dockerfileScope) vars() map[string]string {
+	if !s.inStage {
+		return s.global
+	}
+	return s.stage
+}
+
+// expand substitutes variables in s with the values in effect.
+func (s *dockerfileScope) expand(str string) (string, []string) {
+	return expandDockerfileVars(str, s.vars())
+}
+
+// isStage reports whether ref names a previous stage, by name or index.
+func (s *dockerfileScope) isStage(ref string) bool {
+	_, ok := s.stageIndex(ref)
+	return ok
+}
+
+// apply updates the scope after the instruction inst.
+func (s *dockerfileScope) apply(inst *dockerfileInstruction) {
+	switch inst.Cmd {
+	case "FROM":
+		name := ""
+		if len(inst.Args) >= 3 && strings.EqualFold(inst.Args[1], "AS") {
+			name = strings.ToLower(inst.Args[2])
+		}
+		s.stageNames = append(s.stageNames, name)
+		s.stage = make(map[string]string)
+		s.inStage = true
+	case "ARG":
+		for _, arg := range inst.Args {
+			name, def, hasDef := strings.Cut(arg, "=")
+			if hasDef {
+				def, _ = s.expand(def)
+			}
+
+			v, ok := s.buildArgs[name]
+			if !ok {
+				v, ok = def, hasDef
+			}
+			if !s.inStage {
+				if ok {
+					s.global[name] = v
+				}
+				continue
+			}
+			if !ok {
+				// Redeclaring a global ARG inherits its value.
+				v, ok = s.global[name]
+			}
+			if ok {
+				s.stage[name] = v
+			}
+		}
+	case "ENV":
+		if !s.inStage {
+			return
+		}
+		args := inst.Args
+		if len(args) >= 2 && !strings.Contains(args[0], "=") {
+			// Legacy "ENV key value" form.
+			v, _ := s.expand(strings.Join(args[1:], " "))
+			s.stage[args[0]] = v
+			return
+		}
+		for _, arg := range args {
+			if k, v, ok := strings.Cut(arg, "="); ok {
+				v, _ = s.expand(strings.Trim(v, `"'`))
+				s.stage[k] = v
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package wanda
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stageIndex returns the index of the previous stage that ref names, by
+// name or index.
+func (s *dockerfileScope) stageIndex(ref string) (int, bool) {
+	ref = strings.ToLower(ref)
+	for i, name := range s.stageNames {
+		if ref == name || ref == fmt.Sprint(i) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// inStages reports whether inst, the next instruction to apply, is part of
+// one of the given stages. Instructions before the first FROM are part of
+// every stage, and nil stages means all of them.
+func (s *dockerfileScope) inStages(inst *dockerfileInstruction, stages map[int]bool) bool {
+	if stages == nil {
+		return true
+	}
+	i := len(s.stageNames) - 1
+	if inst.Cmd == "FROM" {
+		i++ // FROM starts a new stage.
+	}
+	return i < 0 || stages[i]
+}
+
+// stageRefs returns the unexpanded images or stages that a COPY or RUN
+// instruction reads from, with COPY --from and RUN --mount=from=.
+func stageRefs(inst *dockerfileInstruction) []string {
+	var refs []string
+	switch inst.Cmd {
+	case "COPY":
+		if from, ok := inst.flag("from"); ok {
+			refs = append(refs, from)
+		}
+	case "RUN":
+		for _, f := range inst.Flags {
+			mount, ok := strings.CutPrefix(f, "--mount=")
+			if !ok {
+				continue
+			}
+			for _, kv := range strings.Split(mount, ",") {
+				if k, v, _ := strings.Cut(kv, "="); k == "from" {
+					refs = append(refs, v)
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// targetStages returns the indexes of the stages that building the stage
+// named target runs: the target itself and the stages that it uses,
+// directly or through other stages. BuildKit skips all other stages. It
+// returns nil, meaning all stages, for an empty target.
+func targetStages(
+	insts []*dockerfileInstruction, target string,
+	buildArgs map[string]string, p *platform,
+) (map[int]bool, error) {
+	if target == "" {
+		return nil, nil
+	}
+
+	scope := newDockerfileScope(buildArgs, p)
+	deps := make(map[int][]int) // Stage index -> stages it uses.
+	for _, inst := range insts {
+		cur := len(scope.stageNames) - 1
+		if inst.Cmd == "FROM" && len(inst.Args) > 0 {
+			ref, _ := expandDockerfileVars(inst.Args[0], scope.global)
+			if i, ok := scope.stageIndex(ref); ok {
+				deps[cur+1] = append(deps[cur+1], i)
+			}
+		}
+		for _, raw := range stageRefs(inst) {
+			ref, _ := scope.expand(raw)
+			if i, ok := scope.stageIndex(ref); ok {
+				deps[cur] = append(deps[cur], i)
+			}
+		}
+		scope.apply(inst)
+	}
+
+	root := -1
+	for i, name := range scope.stageNames {
+		if name != "" && name == strings.ToLower(target) {
+			root = i
+			break
+		}
+	}
+	if root < 0 {
+		return nil, fmt.Errorf("target %q is not a stage of the dockerfile", target)
+	}
+
+	stages := map[int]bool{root: true}
+	queue := []int{root}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		for _, dep := range deps[i] {
+			if !stages[dep] {
+				stages[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return stages, nil
+}
@@ -0,0 +1,129 @@
+package wanda
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTargetStages(t *testing.T) {
+	insts := mustParseDockerfile(t, strings.Join([]string{
+		"ARG BASE_STAGE=base",
+		"FROM ubuntu:22.04 AS base",
+		"FROM busybox AS tools",
+		"FROM ${BASE_STAGE} AS build",
+		"COPY --from=1 /bin/sh /bin/sh",
+		"FROM python:3.12 AS wheel",
+		"RUN --mount=type=cache,from=build,target=/b ls /b",
+		"FROM base AS Final",
+		"COPY --from=wheel /w /w",
+	}, "\n"))
+
+	tests := []struct {
+		target string
+		want   map[int]bool
+	}{
+		{target: "", want: nil},
+		{target: "base", want: map[int]bool{0: true}},
+		{target: "tools", want: map[int]bool{1: true}},
+		{target: "build", want: map[int]bool{0: true, 1: true, 2: true}},
+		{target: "wheel", want: map[int]bool{0: true, 1: true, 2: true, 3: true}},
+		{target: "final", want: map[int]bool{0: true, 1: true, 2: true, 3: true, 4: true}},
+	}
+	host := hostPlatform()
+	for _, test := range tests {
+		got, err := targetStages(insts, test.target, nil, host)
+		if err != nil {
+			t.Errorf("targetStages(%q): %v", test.target, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("targetStages(%q) = %v, want %v", test.target, got, test.want)
+		}
+	}
+
+	if _, err := targetStages(insts, "missing", nil, host); err == nil {
+		t.Errorf("targetStages(missing) got nil error, want error")
+	}
+	if _, err := targetStages(insts, "0", nil, host); err == nil {
+		t.Errorf("targetStages(0) got nil error, want error")
+	}
+}
+
+func TestTargetChecks(t *testing.T) {
+	host := hostPlatform()
+	insts := mustParseDockerfile(t, strings.Join([]string{
+		"FROM ubuntu:22.04 AS base",
+		"COPY base.txt /",
+		"FROM busybox AS tools",
+		"COPY tools.txt /",
+		"FROM base AS final",
+		"COPY final.txt /",
+	}, "\n"))
+
+	stages, err := targetStages(insts, "final", nil, host)
+	if err != nil {
+		t.Fatalf("targetStages: %v", err)
+	}
+	srcs := dockerfileSrcs(insts, nil, host, stages)
+	want := []*dockerfileSrc{
+		{Cmd: "COPY", Src: "base.txt", Line: 2},
+		{Cmd: "COPY", Src: "final.txt", Line: 6},
+	}
+	if !reflect.DeepEqual(srcs, want) {
+		for _, src := range srcs {
+			t.Logf("%+v", src)
+		}
+		t.Errorf("dockerfileSrcs() mismatch")
+	}
+
+	spec := &Spec{Froms: []string{"ubuntu:22.04", "busybox"}, Target: "final"}
+	got := fromsProblems(spec, "Dockerfile", insts, nil, host)
+	wantProblems := []string{`froms entry "busybox" is not used by Dockerfile`}
+	if !reflect.DeepEqual(got, wantProblems) {
+		t.Errorf("fromsProblems() = %q, want %q", got, wantProblems)
+	}
+
+	spec = &Spec{Froms: []string{"busybox"}, Target: "tools"}
+	if got := fromsProblems(spec, "Dockerfile", insts, nil, host); got != nil {
+		t.Errorf("fromsProblems(tools) = %q, want nil", got)
+	}
+
+	spec = &Spec{Target: "nope"}
+	if got := fromsProblems(spec, "Dockerfile", insts, nil, host); len(got) != 1 {
+		t.Errorf("fromsProblems(nope) = %q, want one problem", got)
+	}
+}
+
+func TestDigest_targetChangesDigest(t *testing.T) {
+	config := &ForgeConfig{WorkDir: "testdata"}
+
+	digest := func(specFile string) string {
+		t.Helper()
+		var buf strings.Builder
+		if err := Digest(t.Context(), specFile, config, &buf); err != nil {
+			t.Fatalf("Digest(%s): %v", specFile, err)
+		}
+		return buf.String()
+	}
+
+	// The hello stage does not copy src/, so it does not need it in srcs.
+	hello := digest("testdata/target-hello.wanda.yaml")
+	world := digest("testdata/target-world.wanda.yaml")
+	if hello == world {
+		t.Errorf("Digest() same for different targets: %q", hello)
+	}
+
+	// Without a target, the last stage copies src/, which is not in srcs.
+	noTarget := filepath.Join(t.TempDir(), "no-target.wanda.yaml")
+	spec := "name: no-target\ndockerfile: Dockerfile.target\nsrcs: [world.txt]\n"
+	if err := os.WriteFile(noTarget, []byte(spec), 0644); err != nil {
+		t.Fatalf("write spec: %v", err)
+	}
+	var buf strings.Builder
+	if err := Digest(t.Context(), noTarget, config, &buf); err == nil {
+		t.Errorf("Digest() without target got nil error, want missing srcs error")
+	}
+}
@@ -0,0 +1,105 @@
+package wanda
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	const content = `# syntax=docker/dockerfile:1.3-labs
+# escape=\
+
+ARG BASE=ubuntu:22.04
+FROM ${BASE} AS build
+# a comment
+RUN apt-get update && \
+    # a comment in a continuation
+    apt-get install -y curl
+
+RUN <<EOF
+FROM not-an-instruction
+EOF
+
+copy --from=build --chown=1000 ["/a b", "/dst/"]
+CMD ["bash"]
+`
+	insts, err := parseDockerfile(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("parseDockerfile: %v", err)
+	}
+
+	want := []*dockerfileInstruction{
+		{Cmd: "ARG", Args: []string{"BASE=ubuntu:22.04"}, Line: 4},
+		{Cmd: "FROM", Args: []string{"${BASE}", "AS", "build"}, Line: 5},
+		{Cmd: "RUN", Args: strings.Fields("apt-get update && apt-get install -y curl"), Line: 7},
+		{Cmd: "RUN", Args: []string{"<<EOF"}, Line: 11},
+		{
+			Cmd:   "COPY",
+			Flags: []string{"--from=build", "--chown=1000"},
+			Args:  []string{"/a b", "/dst/"},
+			Line:  15,
+		},
+		{Cmd: "CMD", Args: []string{"bash"}, Line: 16},
+	}
+	if !reflect.DeepEqual(insts, want) {
+		for _, inst := range insts {
+			t.Logf("%+v", inst)
+		}
+		t.Fatalf("parseDockerfile() mismatch")
+	}
+
+	if v, ok := insts[4].flag("from"); !ok || v != "build" {
+		t.Errorf("flag(from) = %q, %v; want build", v, ok)
+	}
+	if _, ok := insts[4].flag("link"); ok {
+		t.Errorf("flag(link) found, want not found")
+	}
+}
+
+func TestParseDockerfile_escapeDirective(t *testing.T) {
+	const content = "# escape=`\nFROM mcr.microsoft.com/windows\nRUN dir `\n  c:\\\n"
+	insts, err := parseDockerfile(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("parseDockerfile: %v", err)
+	}
+	if len(insts) != 2 {
+		t.Fatalf("got %d instructions, want 2", len(insts))
+	}
+	if got, want := insts[1].Args, []string{"dir", `c:\`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RUN args = %q, want %q", got, want)
+	}
+}
+
+func TestExpandDockerfileVars(t *testing.T) {
+	vars := map[string]string{
+		"A":     "a",
+		"EMPTY": "",
+	}
+	for _, test := range []struct {
+		in      string
+		want    string
+		missing []string
+	}{
+		{"$A", "a", nil},
+		{"${A}-x", "a-x", nil},
+		{"x$A/y", "xa/y", nil},
+		{"${B:-b}", "b", nil},
+		{"${EMPTY:-e}", "e", nil},
+		{"${EMPTY-e}", "", nil},
+		{"${A:+set}", "set", nil},
+		{"${B:+set}", "", nil},
+		{`\$A`, "$A", nil},
+		{"$B", "", []string{"B"}},
+		{"${B}/$C", "/", []string{"B", "C"}},
+		{"$", "$", nil},
+	} {
+		got, missing := expandDockerfileVars(test.in, vars)
+		if got != test.want || !reflect.DeepEqual(missing, test.missing) {
+			t.Errorf(
+				"expandDockerfileVars(%q) = %q, %v; want %q, %v",
+				test.in, got, missing, test.want, test.missing,
+			)
+		}
+	}
+}
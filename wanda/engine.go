@@ -0,0 +1,60 @@
+package wanda
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// Container engines that images can be built with.
+const (
+	engineDocker = "docker"
+	enginePodman = "podman"
+)
+
+// containerEngine is the CLI of a container engine, which builds images and
+// keeps them, and the containers created from them, in its local store.
+type containerEngine interface {
+	setWorkDir(dir string)
+	setOutput(out *buildOutput)
+
+	// build builds the image of in, pulling its base images first.
+	build(ctx context.Context, in *buildInput, core *buildInputCore, hints *buildInputHints) error
+
+	pull(ctx context.Context, src, asTag string) error
+	push(ctx context.Context, tag string) error
+	tag(ctx context.Context, src, asTag string) error
+
+	// inspectImage returns the image with the given tag in the local store,
+	// or nil if there is no such image.
+	inspectImage(ctx context.Context, tag string) (*dockerImageInfo, error)
+
+	createContainer(ctx context.Context, image string) (string, error)
+	copyFromContainer(ctx context.Context, containerID, src, dst string) error
+	removeContainer(ctx context.Context, containerID string) error
+}
+
+// checkEngine checks that name is a supported container engine. An empty
+// name is docker.
+func checkEngine(name string) error {
+	switch name {
+	case "", engineDocker, enginePodman:
+		return nil
+	}
+	return fmt.Errorf(
+		"unknown container engine %q; use %s or %s",
+		name, engineDocker, enginePodman,
+	)
+}
+
+// newEngine returns a new command runner of the configured container engine.
+// Every build uses its own, so that it can run in its own environment.
+func (f *Forge) newEngine() containerEngine {
+	if f.config.Engine == enginePodman {
+		return newPodmanCmd(f.config.DockerBin)
+	}
+	return newDockerCmd(&dockerCmdConfig{
+		bin:             f.config.DockerBin,
+		useLegacyEngine: runtime.GOOS == "windows",
+	})
+}
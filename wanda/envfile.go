@@ -58,3 +58,21 @@ func ParseEnvFile(path string) (map[string]string, error) {
 
 	return env, nil
 }
+
+// newEnvLookup returns the lookup for variable expansion: the variables of
+// envFile, if set, over the OS environment.
+func newEnvLookup(envFile string) (lookupFunc, error) {
+	if envFile == "" {
+		return os.LookupEnv, nil
+	}
+	envfileVars, err := ParseEnvFile(envFile)
+	if err != nil {
+		return nil, fmt.Errorf("parse envfile: %w", err)
+	}
+	return func(key string) (string, bool) {
+		if v, ok := envfileVars[key]; ok {
+			return v, true
+		}
+		return os.LookupEnv(key)
+	}, nil
+}
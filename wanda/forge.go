@@ -1,6 +1,8 @@
 package wanda
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -8,10 +10,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
-	cranename "github.com/google/go-containerregistry/pkg/name"
 	crane "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
@@ -29,29 +31,14 @@ func newBuildSession(specFile string, config *ForgeConfig) (*buildSession, error
 		config = &ForgeConfig{}
 	}
 
-	wandaSpecsFile := config.WandaSpecsFile
-	if wandaSpecsFile == "" {
-		wandaSpecsFile = filepath.Join(config.WorkDir, ".wandaspecs")
-	}
-
-	lookup := lookupFunc(os.LookupEnv)
-	if config.EnvFile != "" {
-		envfileVars, err := ParseEnvFile(config.EnvFile)
-		if err != nil {
-			return nil, fmt.Errorf("parse envfile: %w", err)
-		}
-		lookup = func(key string) (string, bool) {
-			if v, ok := envfileVars[key]; ok {
-				return v, true
-			}
-			return os.LookupEnv(key)
-		}
+	lookup, err := newEnvLookup(config.EnvFile)
+	if err != nil {
+		return nil, err
 	}
 
 	s := new(buildSession)
 
-	var err error
-	s.graph, err = buildDepGraph(specFile, lookup, config.NamePrefix, wandaSpecsFile)
+	s.graph, err = buildDepGraph(specFile, lookup, config.NamePrefix, config.wandaSpecsFile())
 	if err != nil {
 		return nil, fmt.Errorf("build dep graph: %w", err)
 	}
@@ -69,45 +56,59 @@ func newBuildSession(specFile string, config *ForgeConfig) (*buildSession, error
 // all its dependencies in topological order.
 // In RayCI mode, dependencies are assumed built by prior pipeline steps; only
 // the root is built.
-func Build(specFile string, config *ForgeConfig) error {
+// When ctx is done, the docker commands and registry requests of the build
+// are stopped, and specs that have not started are not built.
+func Build(ctx context.Context, specFile string, config *ForgeConfig) error {
+	if config.LocalRegistry != "" {
+		if err := checkLocalRegistryHost(runtime.GOOS, os.Getenv); err != nil {
+			return err
+		}
+		c, stop, err := withLocalRegistry(config)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		config = c
+	}
+
 	s, err := newBuildSession(specFile, config)
 	if err != nil {
 		return err
 	}
 
 	// In RayCI mode, only build the root (deps built by prior pipeline steps).
-	order := s.graph.Order
+	layers := s.graph.Layers
 	if config.RayCI {
-		order = []string{s.graph.Root}
+		layers = [][]string{{s.graph.Root}}
 	}
 
-	var targetCacheHit bool
-	for _, name := range order {
-		rs := s.graph.Specs[name]
-
-		log.Printf("building %s (from %s)", name, rs.Path)
-
-		hitsBefore := s.forge.cacheHit()
-		if err := s.forge.Build(rs.Spec); err != nil {
-			return fmt.Errorf("build %s: %w", name, err)
-		}
-		if name == s.graph.Root {
-			targetCacheHit = s.forge.cacheHit() > hitsBefore
+	err = s.build(ctx, layers)
+	if config.Report != "" {
+		if reportErr := s.writeReport(config.Report); reportErr != nil {
+			return errors.Join(err, reportErr)
 		}
 	}
+	return err
+}
 
-	// Extract artifacts only for the root spec, and only if it was actually
-	// built (not a cache hit). On cache hit, the image exists only in the
-	// remote registry; extracting would require pulling it first.
+// build builds the given layers of the session, then extracts the artifacts
+// of the root spec.
+func (s *buildSession) build(ctx context.Context, layers [][]string) error {
+	config := s.forge.config
+	targetCacheHit, err := s.buildLayers(ctx, layers, config.Jobs)
+	if err != nil {
+		return err
+	}
+
+	// Extract artifacts only for the root spec. On a cache hit in remote
+	// mode, the image exists only in the registry, so the artifacts are read
+	// from its layers there. On a local cache hit, extraction is skipped.
 	if config.ArtifactsDir != "" {
 		rootSpec := s.graph.Specs[s.graph.Root].Spec
-		if len(rootSpec.Artifacts) > 0 && !targetCacheHit {
-			rootTag := s.forge.workTag(rootSpec.Name)
-			if err := s.forge.ExtractArtifacts(rootSpec, rootTag); err != nil {
+		if len(rootSpec.Artifacts) > 0 {
+			if err := s.extractArtifacts(ctx, rootSpec, targetCacheHit); err != nil {
 				return fmt.Errorf("extract artifacts: %w", err)
 			}
-		} else if targetCacheHit && len(rootSpec.Artifacts) > 0 {
-			log.Printf("skipping artifact extraction: cache hit")
 		}
 	}
 
@@ -122,11 +123,37 @@ type Forge struct {
 
 	remoteOpts []remote.Option
 
-	cacheHitCount int
+	cacheHitCount atomic.Int64
 
-	docker *dockerCmd
+	engine containerEngine
 
 	lookup lookupFunc
+
+	commit gitCommit
+
+	signing *cacheSigning
+
+	report *buildReport
+
+	retry *retryPolicy
+
+	// locked pins the external base images in locked mode.
+	locked *lockFile
+
+	hashes *fileHashCache
+
+	// repoEpoch is the cache epoch policy of the repo, read from
+	// repoEpochFile.
+	repoEpoch     string
+	repoEpochFile string
+
+	// epochTime is the time that the epochs of the policies are taken at,
+	// so that all the specs of a run are in the same epoch.
+	epochTime time.Time
+
+	// plannedFroms are the images that wanda-built froms resolve to in a
+	// plan, keyed by plannedFromKey.
+	plannedFroms map[string]*imageSource
 }
 
 // NewForge creates a new forge with the given configuration.
@@ -134,6 +161,9 @@ func NewForge(config *ForgeConfig) (*Forge, error) {
 	if err := checkPlatformSupport(); err != nil {
 		return nil, err
 	}
+	if err := checkEngine(config.Engine); err != nil {
+		return nil, err
+	}
 
 	absWorkDir, err := filepath.Abs(filepath.FromSlash(config.WorkDir))
 	if err != nil {
@@ -150,13 +180,41 @@ func NewForge(config *ForgeConfig) (*Forge, error) {
 				Architecture: runtime.GOARCH,
 			}),
 		},
+		report:    newBuildReport(),
+		retry:     newRetryPolicy(config),
+		epochTime: time.Now(),
+	}
+	f.engine = f.newEngine()
+
+	f.signing, err = newCacheSigning(config)
+	if err != nil {
+		return nil, err
+	}
+
+	f.repoEpochFile = filepath.Join(filepath.Dir(config.wandaSpecsFile()), epochPolicyFile)
+	f.repoEpoch, err = readEpochPolicyFile(f.repoEpochFile)
+	if err != nil {
+		return nil, fmt.Errorf("read cache epoch policy: %w", err)
+	}
+
+	if config.HashCache != "" {
+		f.hashes, err = loadFileHashCache(config.HashCache)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Locked {
+		f.locked, err = readLockFile(config.lockFile())
+		if err != nil {
+			return nil, fmt.Errorf("read lockfile: %w", err)
+		}
 	}
-	f.docker = f.newDockerCmd()
 
 	return f, nil
 }
 
-func (f *Forge) cacheHit() int { return f.cacheHitCount }
+func (f *Forge) cacheHit() int { return int(f.cacheHitCount.Load()) }
 
 func (f *Forge) addSrcFile(ts *tarStream, src string) {
 	ts.addFile(src, nil, filepath.Join(f.workDir, filepath.FromSlash(src)))
@@ -168,13 +226,6 @@ func (f *Forge) cacheTag(digest string) string {
 	return f.config.cacheTag(digest)
 }
 
-func (f *Forge) newDockerCmd() *dockerCmd {
-	return newDockerCmd(&dockerCmdConfig{
-		bin:             f.config.DockerBin,
-		useLegacyEngine: runtime.GOOS == "windows",
-	})
-}
-
 // isDockerScratch reports whether s is Docker's built-in empty base image.
 // "scratch" is not a real registry image; Docker handles it as a special
 // keyword in FROM instructions, so it must not be pulled or resolved.
@@ -182,9 +233,12 @@ func isDockerScratch(s string) bool {
 	return s == "scratch"
 }
 
-func (f *Forge) resolveBases(froms []string) (map[string]*imageSource, error) {
+func (f *Forge) resolveBases(
+	ctx context.Context, froms []string, p *platform,
+) (map[string]*imageSource, error) {
 	m := make(map[string]*imageSource)
 	namePrefix := f.config.NamePrefix
+	remoteOpts := f.remoteOptsFor(ctx, p)
 
 	for _, from := range froms {
 		if isDockerScratch(from) {
@@ -198,7 +252,7 @@ func (f *Forge) resolveBases(froms []string) (map[string]*imageSource, error) {
 
 		if strings.HasPrefix(from, "@") { // A local image.
 			name := strings.TrimPrefix(from, "@")
-			src, err := resolveDockerImage(f.docker, from, name)
+			src, err := resolveDockerImage(ctx, f.engine, from, name)
 			if err != nil {
 				return nil, fmt.Errorf("resolve local image %s: %w", from, err)
 			}
@@ -207,9 +261,20 @@ func (f *Forge) resolveBases(froms []string) (map[string]*imageSource, error) {
 		}
 
 		if namePrefix != "" && strings.HasPrefix(from, namePrefix) {
+			dep := localDepName(from, namePrefix)
+			if src, ok := f.plannedFroms[plannedFromKey(dep, p)]; ok {
+				m[from] = &imageSource{
+					name:  from,
+					id:    src.id,
+					src:   src.src,
+					local: src.local,
+				}
+				continue
+			}
+
 			if !f.isRemote() {
 				// Treat it as a local image.
-				src, err := resolveDockerImage(f.docker, from, from)
+				src, err := resolveDockerImage(ctx, f.engine, from, from)
 				if err != nil {
 					return nil, fmt.Errorf(
 						"resolve prefixed local image %s: %w", from, err,
@@ -224,7 +289,7 @@ func (f *Forge) resolveBases(froms []string) (map[string]*imageSource, error) {
 			fromName := strings.TrimPrefix(from, f.config.NamePrefix)
 			workTag := f.workTag(fromName)
 
-			src, err := resolveRemoteImage(from, workTag, f.remoteOpts...)
+			src, err := f.resolveRemote(ctx, from, workTag, remoteOpts...)
 			if err != nil {
 				return nil, fmt.Errorf(
 					"resolve remote work image %s: %w", from, err,
@@ -235,7 +300,7 @@ func (f *Forge) resolveBases(froms []string) (map[string]*imageSource, error) {
 		}
 
 		// A normal remote image that we need to pull from the network.
-		src, err := resolveRemoteImage(from, from, f.remoteOpts...)
+		src, err := f.resolveExternal(ctx, from, p, remoteOpts...)
 		if err != nil {
 			return nil, fmt.Errorf("resolve remote image %s: %w", from, err)
 		}
@@ -245,32 +310,24 @@ func (f *Forge) resolveBases(froms []string) (map[string]*imageSource, error) {
 }
 
 // ExtractArtifacts copies artifacts from a built image to ArtifactsDir.
-// The image must be locally available (this is only called after a successful
-// build, not on cache hits).
-func (f *Forge) ExtractArtifacts(spec *Spec, imageTag string) error {
-	d := f.newDockerCmd()
-	artifactsDir := f.config.ArtifactsDir
-
-	// In RayCI mode, clear the artifacts directory to avoid stale artifacts.
-	if f.config.RayCI {
-		if err := os.RemoveAll(artifactsDir); err != nil {
-			return fmt.Errorf("clear artifacts dir: %w", err)
-		}
-	}
-
-	if err := os.MkdirAll(artifactsDir, 0755); err != nil {
-		return fmt.Errorf("create artifacts dir: %w", err)
+// The image must be locally available in docker; for images that are only
+// in the registry, see extractArtifactsFromRegistry.
+func (f *Forge) ExtractArtifacts(ctx context.Context, spec *Spec, imageTag string) error {
+	d := f.newEngine()
+	artifactsDir, err := f.prepareArtifactsDir()
+	if err != nil {
+		return err
 	}
 
 	log.Printf("extracting %d artifact(s) from %s", len(spec.Artifacts), imageTag)
 	extractStart := time.Now()
 
-	containerID, err := d.createContainer(imageTag)
+	containerID, err := d.createContainer(ctx, imageTag)
 	if err != nil {
 		return fmt.Errorf("create container: %w", err)
 	}
 	defer func() {
-		if err := d.removeContainer(containerID); err != nil {
+		if err := d.removeContainer(ctx, containerID); err != nil {
 			log.Printf("warning: failed to remove container %s: %v", containerID, err)
 		}
 	}()
@@ -278,43 +335,54 @@ func (f *Forge) ExtractArtifacts(spec *Spec, imageTag string) error {
 	var extracted []string
 
 	for _, a := range spec.Artifacts {
-		if err := a.Validate(); err != nil {
-			return fmt.Errorf("invalid artifact: %w", err)
-		}
-
-		dst, err := a.ResolveDst(artifactsDir)
+		dst, err := resolveArtifact(a, artifactsDir)
 		if err != nil {
-			return fmt.Errorf("resolve artifact dst: %w", err)
+			return err
 		}
 
-		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
-			return fmt.Errorf("create dir for artifact %s: %w", a.Dst, err)
+		outputs := []string{dst}
+		if a.isGlob() {
+			outputs, err = copyGlobFromContainer(ctx, d, containerID, a, dst, artifactsDir)
+		} else {
+			err = d.copyFromContainer(ctx, containerID, a.Src, dst)
 		}
-
-		if err := d.copyFromContainer(containerID, a.Src, dst); err != nil {
+		if err != nil {
 			if a.Optional {
 				log.Printf("warning: optional artifact not found: %s", a.Src)
 				continue
 			}
 			return fmt.Errorf("copy artifact %s: %w", a.Src, err)
 		}
-		if abs, err := filepath.Abs(dst); err == nil {
-			dst = abs
+		if err := applyArtifactMode(a, outputs); err != nil {
+			return err
 		}
-		extracted = append(extracted, dst)
+		extracted = append(extracted, absPaths(outputs)...)
 	}
 
-	log.Printf("extracted %d artifact(s) in %v:", len(extracted), time.Since(extractStart).Round(time.Millisecond))
-	for _, f := range extracted {
-		log.Printf("  %s", f)
+	logExtracted(extracted, time.Since(extractStart))
+
+	info, err := d.inspectImage(ctx, imageTag)
+	if err != nil {
+		return fmt.Errorf("inspect image: %w", err)
 	}
-	return nil
+	var imageID, imageDigest string
+	if info != nil {
+		imageID = info.ID
+		imageDigest = info.repoDigest(imageTag)
+	}
+	return writeArtifactsManifest(
+		artifactsDir, spec.Name, imageTag, imageID, imageDigest, extracted,
+	)
 }
 
-// resolveBuildInput assembles the build input and core for a spec.
+// resolveBuildInput assembles the build input and core for a spec built for
+// platform p, or for the host platform if p is nil.
 // This is the shared setup used by both Build and digestSpec.
-func (f *Forge) resolveBuildInput(spec *Spec) (*buildInput, *buildInputCore, error) {
+func (f *Forge) resolveBuildInput(
+	ctx context.Context, spec *Spec, p *platform,
+) (*buildInput, *buildInputCore, error) {
 	ts := newTarStream()
+	ts.hashes = f.hashes
 
 	if spec.ContextOwner != "" {
 		owner, err := parseContextOwner(spec.ContextOwner)
@@ -324,36 +392,51 @@ func (f *Forge) resolveBuildInput(spec *Spec) (*buildInput, *buildInputCore, err
 		ts.owner = owner
 	}
 
-	files, err := listSrcFiles(f.workDir, spec.Srcs, spec.Dockerfile)
+	ignores, err := specSrcIgnores(spec, f.workDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s: %w", wandaIgnoreFile, err)
+	}
+
+	files, err := listSrcFiles(f.workDir, spec.Srcs, spec.Dockerfile, ignores)
 	if err != nil {
 		return nil, nil, fmt.Errorf("list src files: %w", err)
 	}
+	if err := f.checkSrcs(spec, p, files); err != nil {
+		return nil, nil, err
+	}
 	for _, file := range files {
 		f.addSrcFile(ts, file)
 	}
 
 	in := newBuildInput(ts, spec.BuildArgs)
+	in.platform = p
 
-	froms, err := f.resolveBases(spec.Froms)
+	froms, err := f.resolveBases(ctx, spec.Froms, p)
 	if err != nil {
 		return nil, nil, fmt.Errorf("resolve bases: %w", err)
 	}
 	in.froms = froms
 
+	hashStart := time.Now()
 	inputCore, err := in.makeCore(spec.Dockerfile, f.lookup)
 	if err != nil {
 		return nil, nil, fmt.Errorf("make build input core: %w", err)
 	}
-	inputCore.Epoch = f.config.Epoch
+	in.hashTime = time.Since(hashStart)
+	inputCore.Epoch = f.cacheEpoch(spec).Epoch
 	inputCore.ContextOwner = spec.ContextOwner
+	inputCore.Target = spec.Target
+	if f.config.Engine == enginePodman {
+		inputCore.Engine = enginePodman
+	}
 
 	return in, inputCore, nil
 }
 
-// digestSpec computes the content-addressed digest for the given spec without
-// checking the cache or building the image.
-func (f *Forge) digestSpec(spec *Spec) (string, error) {
-	_, inputCore, err := f.resolveBuildInput(spec)
+// digestSpec computes the content-addressed digest for the given spec built
+// for platform p without checking the cache or building the image.
+func (f *Forge) digestSpec(ctx context.Context, spec *Spec, p *platform) (string, error) {
+	_, inputCore, err := f.resolveBuildInput(ctx, spec, p)
 	if err != nil {
 		return "", err
 	}
@@ -364,38 +447,95 @@ func (f *Forge) digestSpec(spec *Spec) (string, error) {
 // file to w. It performs all the standard digest-generation steps (resolving
 // base images, hashing the build context, expanding build args) but does not
 // check the cache or build the image.
-func Digest(specFile string, config *ForgeConfig, w io.Writer) error {
+// For a multi-platform spec, it writes one "<platform> <digest>" line for
+// each platform that would be built.
+func Digest(ctx context.Context, specFile string, config *ForgeConfig, w io.Writer) error {
 	s, err := newBuildSession(specFile, config)
 	if err != nil {
 		return err
 	}
 
-	inputDigest, err := s.forge.digestSpec(s.graph.Specs[s.graph.Root].Spec)
-	if err != nil {
-		return fmt.Errorf("compute digest for %s: %w", s.graph.Root, err)
+	spec := s.graph.Specs[s.graph.Root].Spec
+	if len(spec.Platforms) == 0 {
+		inputDigest, err := s.forge.digestSpec(ctx, spec, nil)
+		if err != nil {
+			return fmt.Errorf("compute digest for %s: %w", s.graph.Root, err)
+		}
+		fmt.Fprintln(w, inputDigest)
+		return nil
 	}
 
-	fmt.Fprintln(w, inputDigest)
+	platforms, err := s.forge.selectPlatforms(spec)
+	if err != nil {
+		return err
+	}
+	for _, p := range platforms {
+		inputDigest, err := s.forge.digestSpec(ctx, spec, p)
+		if err != nil {
+			return fmt.Errorf("compute digest for %s on %s: %w", s.graph.Root, p, err)
+		}
+		fmt.Fprintf(w, "%s %s\n", p, inputDigest)
+	}
 	return nil
 }
 
 // Build builds a container image from the given specification.
-func (f *Forge) Build(spec *Spec) error {
-	in, inputCore, err := f.resolveBuildInput(spec)
+func (f *Forge) Build(ctx context.Context, spec *Spec) error {
+	_, err := f.build(ctx, spec, defaultBuildOutput())
+	return err
+}
+
+// build builds a container image from the given specification, writing logs
+// and docker output to out. It reports whether the image was a cache hit.
+func (f *Forge) build(ctx context.Context, spec *Spec, out *buildOutput) (bool, error) {
+	if len(spec.Platforms) > 0 {
+		return f.buildPlatforms(ctx, spec, out)
+	}
+	return f.buildPlatform(ctx, spec, nil, out)
+}
+
+// buildPlatform builds the image of spec for platform p. A nil p builds for
+// the host platform; otherwise the image is named after p.
+func (f *Forge) buildPlatform(
+	ctx context.Context, spec *Spec, p *platform, out *buildOutput,
+) (hit bool, err error) {
+	r := f.report.add(spec.Name, p)
+	defer func() { r.finish(hit, err) }()
+
+	if err := f.checkFroms(spec, p, out); err != nil {
+		return false, err
+	}
+
+	start := time.Now()
+	in, inputCore, err := f.resolveBuildInput(ctx, spec, p)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	caching := !spec.DisableCaching
 
+	hashStart := time.Now()
 	inputDigest, err := inputCore.digest()
 	if err != nil {
-		return fmt.Errorf("compute build input digest: %w", err)
+		return false, fmt.Errorf("compute build input digest: %w", err)
+	}
+	r.Timings.Resolve = seconds(hashStart.Sub(start) - in.hashTime)
+	r.Timings.Hash = seconds(in.hashTime + time.Since(hashStart))
+	r.InputDigest = inputDigest
+	out.log.Println("build input digest:", inputDigest)
+	in.labels = f.imageLabels(ctx, spec, inputDigest)
+
+	name := spec.Name
+	if p != nil {
+		name = p.imageName(spec.Name)
 	}
-	log.Println("build input digest:", inputDigest)
 
 	cacheTag := f.cacheTag(inputDigest)
-	workTag := f.workTag(spec.Name)
+	workTag := f.workTag(name)
+	r.WorkTag = workTag
+	if caching {
+		r.CacheTag = cacheTag
+	}
 
 	// Add all the tags.
 
@@ -409,85 +549,67 @@ func (f *Forge) Build(spec *Spec) error {
 		// Name tag is the tag we use to reference the image locally.
 		// It is also what can be referenced by following steps.
 		if f.config.NamePrefix != "" {
-			nameTag := f.config.NamePrefix + spec.Name
+			nameTag := f.config.NamePrefix + name
 			in.addTag(nameTag)
 		}
-		for _, tag := range spec.Tags { // And add extra tags.
-			in.addTag(tag)
+		// Per-platform images only carry the extra tags once they are
+		// assembled into an image index.
+		if p == nil {
+			for _, tag := range spec.Tags { // And add extra tags.
+				in.addTag(tag)
+			}
 		}
 	}
 
 	if caching && !f.config.Rebuild {
-		if f.isRemote() {
-			ct, err := cranename.NewTag(cacheTag)
-			if err != nil {
-				return fmt.Errorf("parse cache tag %q: %w", cacheTag, err)
-			}
-			wt, err := cranename.NewTag(workTag)
-			if err != nil {
-				return fmt.Errorf("parse work tag %q: %w", workTag, err)
-			}
-
-			desc, err := remote.Get(ct, f.remoteOpts...)
-			if err != nil {
-				log.Printf("cache image miss: %v", err)
-			} else {
-				log.Printf("cache hit: %s", desc.Digest)
-				f.cacheHitCount++
-
-				log.Printf("tag output as %s", workTag)
-				if err := remote.Tag(wt, desc, f.remoteOpts...); err != nil {
-					return fmt.Errorf("tag cache image: %w", err)
-				}
-
-				return nil // and we are done.
-			}
-		} else {
-			info, err := f.docker.inspectImage(cacheTag)
-			if err != nil {
-				return fmt.Errorf("check cache image: %w", err)
-			}
-			if info != nil {
-				log.Printf("cache hit: %s", info.ID)
-				f.cacheHitCount++
-
-				for _, tag := range in.tagList() {
-					log.Printf("tag output as %s", tag)
-					if tag != cacheTag {
-						if err := f.docker.tag(cacheTag, tag); err != nil {
-							return fmt.Errorf("tag cache image: %w", err)
-						}
-					}
-				}
-				return nil // and we are done.
+		hit, err := f.checkCache(ctx, in, cacheTag, workTag, out)
+		if err != nil || hit {
+			if hit {
+				f.reportImageDigest(ctx, r, workTag, out)
 			}
+			return hit, err
 		}
 	}
 
 	inputHints := newBuildInputHints(spec.BuildHintArgs, f.lookup)
 
+	secrets, err := f.resolveSecrets(spec)
+	if err != nil {
+		return false, fmt.Errorf("resolve secrets: %w", err)
+	}
+	in.secrets = secrets
+
 	// Now we can build the image.
-	// Always use a new dockerCmd so that it can run in its own environment.
-	d := f.newDockerCmd()
+	// Always use a new engine command so that it can run in its own
+	// environment.
+	d := f.newEngine()
 	d.setWorkDir(f.workDir)
+	d.setOutput(out)
 
-	if err := d.build(in, inputCore, inputHints); err != nil {
-		return fmt.Errorf("build docker: %w", err)
+	started := time.Now()
+	if err := d.build(ctx, in, inputCore, inputHints); err != nil {
+		return false, fmt.Errorf("build docker: %w", err)
 	}
+	r.Timings.Build = seconds(time.Since(started))
+	r.ContextSize = in.context.size.Load()
 
 	// Push the image to the work repo with workTag and cacheTag if needed.
 	if f.isRemote() {
-		if err := d.run("push", workTag); err != nil {
-			return fmt.Errorf("push docker: %w", err)
+		pushStart := time.Now()
+		b := &provenanceBuild{
+			spec:        spec,
+			platform:    p,
+			core:        inputCore,
+			inputDigest: inputDigest,
+			started:     started,
+			finished:    pushStart,
 		}
-
-		// Save cache result too.
-		if caching && !f.config.ReadOnlyCache {
-			if err := d.run("push", cacheTag); err != nil {
-				return fmt.Errorf("push cache: %w", err)
-			}
+		if err := f.pushImage(ctx, d, b, workTag, cacheTag, out); err != nil {
+			return false, err
 		}
+		r.Timings.Push = seconds(time.Since(pushStart))
+		f.reportImageDigest(ctx, r, workTag, out)
 	}
 
-	return nil
+	return false, nil
 }
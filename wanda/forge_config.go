@@ -2,9 +2,11 @@ package wanda
 
 import (
 	"fmt"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
+	"time"
 )
 
 var supportedPlatforms = map[string]map[string]struct{}{
@@ -57,6 +59,94 @@ type ForgeConfig struct {
 	EnvFile        string
 	ArtifactsDir   string
 
+	// DefaultEpoch is the cache epoch of specs without their own policy,
+	// when neither Epoch nor the .wandaepoch file of the repo sets one.
+	// Epoch, when set, overrides the policy of the repo.
+	DefaultEpoch string
+
+	// Engine is the container engine that builds images: "docker" (the
+	// default) or "podman", which needs no daemon and can run rootless.
+	// DockerBin is the path to the CLI binary of either.
+	Engine string
+
+	// Jobs is the maximum number of specs in the same dependency layer that
+	// are built concurrently. Values less than 2 build one spec at a time.
+	Jobs int
+
+	// Platform selects the only platform to build for multi-platform specs,
+	// in os/arch format. When empty, all platforms of the spec are built.
+	Platform string
+
+	// FromsCheck sets how a mismatch between a spec's froms and the images
+	// its Dockerfile uses is handled: "warn" (the default), "error" or "off".
+	FromsCheck string
+
+	// SrcsCheck sets how COPY and ADD sources of a Dockerfile that are not
+	// in the spec's srcs are handled: "error" (the default) fails the build,
+	// "suggest" also lists the srcs entries to add, and "off" skips the
+	// check.
+	SrcsCheck string
+
+	// LocalRegistry is a directory to serve a built-in registry from during
+	// a local build. The registry is used as the work repo, so that local
+	// builds read and write the cache like RayCI builds do. It listens on
+	// loopback, so it only works on Linux with the container engine on the
+	// same host. gc with it also removes unused blobs from the directory.
+	LocalRegistry string
+
+	// GitCommit is the git commit that images are built from, recorded in
+	// their labels and provenance. When empty, the HEAD commit of WorkDir is
+	// used if it is a git checkout.
+	GitCommit string
+
+	// Provenance pushes a SLSA provenance attestation of each built image to
+	// the work repo, as an OCI artifact that refers to the image.
+	Provenance bool
+
+	// SigningKey is an ECDSA private key in PEM format that cache images
+	// pushed to the work repo are signed with, in the cosign signature
+	// format.
+	SigningKey string
+
+	// VerifyKey is an ECDSA public key in PEM format, like a cosign.pub
+	// file. When set, a remote cache hit is only used if the cache image has
+	// a valid signature by the key; otherwise the image is rebuilt. It
+	// defaults to the public key of SigningKey.
+	VerifyKey string
+
+	// Report is a file to write a JSON report of the build to, with an
+	// entry for each spec of the dependency graph in build order: its input
+	// digest, whether it was a cache hit, its tags and image digest, the
+	// size of its build context and the time taken by each build phase.
+	// The report is also written when the build fails.
+	Report string
+
+	// RetryAttempts is how many times a registry operation of the build,
+	// like resolving a base image, checking the cache or pushing an image,
+	// is tried when it fails with a transient error: a 5xx or 429 response,
+	// a timeout or a dropped connection. Zero uses the default of 4 tries;
+	// 1 disables retries.
+	RetryAttempts int
+
+	// RetryBackoff is the base delay before the first retry. It doubles
+	// with every retry, up to 30s, with random jitter. Zero uses 1s.
+	RetryBackoff time.Duration
+
+	// HashCache is a file to cache the content digests of build context
+	// files in across runs. A file whose size, mtime, inode and mode have
+	// not changed is not read again. When empty, every file is hashed.
+	HashCache string
+
+	// LockFile is the lockfile that pins the external base images of the
+	// specs, written by Lock. It defaults to wanda.lock next to the
+	// wandaspecs file.
+	LockFile string
+
+	// Locked resolves external base images only from LockFile, without
+	// going to the registry. Resolving an image that is not in the lockfile
+	// fails, as the lockfile is then stale.
+	Locked bool
+
 	RayCI   bool
 	Rebuild bool
 
@@ -65,6 +155,23 @@ type ForgeConfig struct {
 
 func (c *ForgeConfig) isRemote() bool { return c.WorkRepo != "" }
 
+// lockFile returns the path of the lockfile.
+func (c *ForgeConfig) lockFile() string {
+	if c.LockFile != "" {
+		return c.LockFile
+	}
+	return filepath.Join(filepath.Dir(c.wandaSpecsFile()), lockFileName)
+}
+
+// wandaSpecsFile returns the file listing the spec directories, which is
+// .wandaspecs under the work dir by default.
+func (c *ForgeConfig) wandaSpecsFile() string {
+	if c.WandaSpecsFile != "" {
+		return c.WandaSpecsFile
+	}
+	return filepath.Join(c.WorkDir, ".wandaspecs")
+}
+
 func (c *ForgeConfig) workRepo() string {
 	if c.WorkRepo != "" {
 		return c.WorkRepo
@@ -67,11 +67,11 @@ const worldDotTxt = "This is my world!"
 func TestForgeLocal_noNamePrefix(t *testing.T) {
 	config := &ForgeConfig{WorkDir: "testdata"}
 
-	if err := Build("testdata/localbase.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/localbase.wanda.yaml", config); err != nil {
 		t.Fatalf("build base: %v", err)
 	}
 
-	if err := Build("testdata/local.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/local.wanda.yaml", config); err != nil {
 		t.Fatalf("build: %v", err)
 	}
 
@@ -118,7 +118,7 @@ func TestForge_globFiles(t *testing.T) {
 		NamePrefix: "cr.ray.io/rayproject/",
 	}
 
-	if err := Build("testdata/glob.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/glob.wanda.yaml", config); err != nil {
 		t.Fatalf("build: %v", err)
 	}
 
@@ -171,7 +171,7 @@ func TestForge_withHints(t *testing.T) {
 		Rebuild:    true,
 	}
 
-	if err := Build("testdata/hello-hint.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/hello-hint.wanda.yaml", config); err != nil {
 		t.Fatalf("build: %v", err)
 	}
 
@@ -217,7 +217,7 @@ func TestForge(t *testing.T) {
 		NamePrefix: "cr.ray.io/rayproject/",
 	}
 
-	if err := Build("testdata/hello-test.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/hello-test.wanda.yaml", config); err != nil {
 		t.Fatalf("build: %v", err)
 	}
 
@@ -242,7 +242,7 @@ func TestForge(t *testing.T) {
 		t.Fatalf("got %d layers, want 1", len(layers))
 	}
 
-	if err := Build("testdata/world.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/world.wanda.yaml", config); err != nil {
 		t.Fatalf("build world: %v", err)
 	}
 
@@ -282,7 +282,7 @@ func TestForge_noCache(t *testing.T) {
 		NamePrefix: "cr.ray.io/rayproject/",
 	}
 
-	if err := Build("testdata/hello-nocache.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/hello-nocache.wanda.yaml", config); err != nil {
 		t.Fatalf("build: %v", err)
 	}
 
@@ -318,7 +318,7 @@ func TestForge_noCache(t *testing.T) {
 		t.Fatalf("parse hello spec: %v", err)
 	}
 
-	if err := forge.Build(helloSpec); err != nil {
+	if err := forge.Build(t.Context(), helloSpec); err != nil {
 		t.Fatalf("rebuild hello: %v", err)
 	}
 
@@ -353,12 +353,12 @@ func TestForge_noCacheAfterExpandVar(t *testing.T) {
 		t.Fatal("DisableCaching should be true after expandVar")
 	}
 
-	if err := forge.Build(spec); err != nil {
+	if err := forge.Build(t.Context(), spec); err != nil {
 		t.Fatalf("first build: %v", err)
 	}
 
 	// Build again - should have 0 cache hits since caching is disabled.
-	if err := forge.Build(spec); err != nil {
+	if err := forge.Build(t.Context(), spec); err != nil {
 		t.Fatalf("second build: %v", err)
 	}
 
@@ -405,11 +405,11 @@ func TestForgeWithRemoteWorkRepo(t *testing.T) {
 		Epoch:      "1",
 	}
 
-	if err := Build("testdata/hello-test.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/hello-test.wanda.yaml", config); err != nil {
 		t.Fatalf("build hello: %v", err)
 	}
 
-	if err := Build("testdata/world.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/world.wanda.yaml", config); err != nil {
 		t.Fatalf("build world: %v", err)
 	}
 
@@ -455,7 +455,7 @@ func TestForgeWithRemoteWorkRepo(t *testing.T) {
 	// Apply a hint, and it should still be cache hit.
 	helloSpec.BuildHintArgs = []string{"REMOTE_CACHE_URL=http://localhost:5000"}
 
-	if err := forge.Build(helloSpec); err != nil {
+	if err := forge.Build(t.Context(), helloSpec); err != nil {
 		t.Fatalf("rebuild hello: %v", err)
 	}
 
@@ -489,7 +489,7 @@ func TestForgeWithRemoteWorkRepo(t *testing.T) {
 		t.Fatalf("make forge for new epoch: %v", err)
 	}
 
-	if err := forge2.Build(helloSpec); err != nil {
+	if err := forge2.Build(t.Context(), helloSpec); err != nil {
 		t.Fatalf("rebuild hello: %v", err)
 	}
 
@@ -518,7 +518,7 @@ func TestBuild_WithDeps(t *testing.T) {
 		WandaSpecsFile: wandaSpecs,
 	}
 
-	if err := Build("testdata/dep-top.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/dep-top.wanda.yaml", config); err != nil {
 		t.Fatalf("build with deps: %v", err)
 	}
 
@@ -551,7 +551,7 @@ func TestBuild_NoDeps(t *testing.T) {
 		NamePrefix: "cr.ray.io/rayproject/",
 	}
 
-	if err := Build("testdata/hello-test.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/hello-test.wanda.yaml", config); err != nil {
 		t.Fatalf("build with deps: %v", err)
 	}
 
@@ -595,11 +595,11 @@ func TestForgeLocal_withNamePrefix(t *testing.T) {
 		Epoch:      randomEpoch(),
 	}
 
-	if err := Build("testdata/hello-test.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/hello-test.wanda.yaml", config); err != nil {
 		t.Fatalf("build hello: %v", err)
 	}
 
-	if err := Build("testdata/world.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/world.wanda.yaml", config); err != nil {
 		t.Fatalf("build world: %v", err)
 	}
 
@@ -643,7 +643,7 @@ func TestForgeLocal_withNamePrefix(t *testing.T) {
 		t.Fatalf("parse hello spec: %v", err)
 	}
 
-	if err := forge.Build(helloSpec); err != nil {
+	if err := forge.Build(t.Context(), helloSpec); err != nil {
 		t.Fatalf("rebuild hello: %v", err)
 	}
 
@@ -677,7 +677,7 @@ func TestForgeLocal_withNamePrefix(t *testing.T) {
 		t.Fatalf("make forge for new epoch: %v", err)
 	}
 
-	if err := forge2.Build(helloSpec); err != nil {
+	if err := forge2.Build(t.Context(), helloSpec); err != nil {
 		t.Fatalf("rebuild hello: %v", err)
 	}
 
@@ -693,7 +693,7 @@ func TestBuild_WithEnvfile(t *testing.T) {
 		EnvFile:    "testdata/test.env",
 	}
 
-	if err := Build("testdata/env-file-test.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/env-file-test.wanda.yaml", config); err != nil {
 		t.Fatalf("build with envfile: %v", err)
 	}
 
@@ -731,7 +731,7 @@ func TestBuild_EnvfileMissing(t *testing.T) {
 		EnvFile:    "testdata/nonexistent.env",
 	}
 
-	err := Build("testdata/env-file-missing.wanda.yaml", config)
+	err := Build(t.Context(), "testdata/env-file-missing.wanda.yaml", config)
 	if err == nil {
 		t.Fatal("expected error for missing envfile, got nil")
 	}
@@ -778,7 +778,7 @@ func TestBuild_EnvfileCacheInvalidation(t *testing.T) {
 	}
 
 	// First build
-	if err := Build(specPath, config); err != nil {
+	if err := Build(t.Context(), specPath, config); err != nil {
 		t.Fatalf("first build: %v", err)
 	}
 
@@ -805,7 +805,7 @@ func TestBuild_EnvfileCacheInvalidation(t *testing.T) {
 	}
 	expandedSpec1 := parsedSpec1.expandVar(lookup1)
 
-	if err := forge1.Build(expandedSpec1); err != nil {
+	if err := forge1.Build(t.Context(), expandedSpec1); err != nil {
 		t.Fatalf("second build: %v", err)
 	}
 	if forge1.cacheHit() != 1 {
@@ -840,7 +840,7 @@ func TestBuild_EnvfileCacheInvalidation(t *testing.T) {
 	}
 	expandedSpec2 := parsedSpec2.expandVar(lookup2)
 
-	if err := forge2.Build(expandedSpec2); err != nil {
+	if err := forge2.Build(t.Context(), expandedSpec2); err != nil {
 		t.Fatalf("third build: %v", err)
 	}
 	if forge2.cacheHit() != 0 {
@@ -856,7 +856,7 @@ func TestBuild_ScratchFrom(t *testing.T) {
 		NamePrefix: "cr.ray.io/rayproject/",
 	}
 
-	if err := Build("testdata/scratch-from.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/scratch-from.wanda.yaml", config); err != nil {
 		t.Fatalf("build with scratch from: %v", err)
 	}
 }
@@ -879,7 +879,7 @@ func TestBuild_WithArtifacts_exact(t *testing.T) {
 		Rebuild:      true, // force rebuild to test extraction
 	}
 
-	if err := Build("testdata/artifact-exact.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/artifact-exact.wanda.yaml", config); err != nil {
 		t.Fatalf("build: %v", err)
 	}
 
@@ -907,7 +907,7 @@ func TestBuild_WithArtifacts_optional(t *testing.T) {
 	}
 
 	// Build should succeed even though the optional artifact doesn't exist
-	if err := Build("testdata/artifact-optional.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/artifact-optional.wanda.yaml", config); err != nil {
 		t.Fatalf("build: %v", err)
 	}
 
@@ -951,7 +951,7 @@ func TestBuild_WithArtifacts_rootOnly(t *testing.T) {
 		Rebuild:        true,
 	}
 
-	if err := Build("testdata/artifact-dep-top.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/artifact-dep-top.wanda.yaml", config); err != nil {
 		t.Fatalf("build with deps: %v", err)
 	}
 
@@ -978,7 +978,7 @@ func TestBuild_WithArtifacts_cacheHit(t *testing.T) {
 		Rebuild:      true, // force build for first run
 	}
 
-	if err := Build("testdata/artifact-exact.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/artifact-exact.wanda.yaml", config); err != nil {
 		t.Fatalf("first build: %v", err)
 	}
 
@@ -991,7 +991,7 @@ func TestBuild_WithArtifacts_cacheHit(t *testing.T) {
 	config.ArtifactsDir = artifactsDir2
 	config.Rebuild = false
 
-	if err := Build("testdata/artifact-exact.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/artifact-exact.wanda.yaml", config); err != nil {
 		t.Fatalf("second build: %v", err)
 	}
 
@@ -1037,7 +1037,7 @@ func TestBuild_WithArtifacts_depCacheHitRootRebuilt(t *testing.T) {
 	}
 
 	// First build: both dep and root are fresh, artifacts extracted.
-	if err := Build("testdata/cache-dep-top.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/cache-dep-top.wanda.yaml", config); err != nil {
 		t.Fatalf("first build: %v", err)
 	}
 
@@ -1058,7 +1058,7 @@ func TestBuild_WithArtifacts_depCacheHitRootRebuilt(t *testing.T) {
 
 	// Second build: dep cache hit, root cache miss.
 	// Artifacts SHOULD be extracted because the root was rebuilt.
-	if err := Build("testdata/cache-dep-top.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/cache-dep-top.wanda.yaml", config); err != nil {
 		t.Fatalf("second build: %v", err)
 	}
 
@@ -1079,7 +1079,7 @@ func TestBuild_WithArtifacts_noCmdImage(t *testing.T) {
 		Rebuild:      true,
 	}
 
-	if err := Build("testdata/artifact-nocmd.wanda.yaml", config); err != nil {
+	if err := Build(t.Context(), "testdata/artifact-nocmd.wanda.yaml", config); err != nil {
 		t.Fatalf("build: %v", err)
 	}
 
@@ -1101,7 +1101,7 @@ func TestDigest_format(t *testing.T) {
 		WorkDir:    "testdata",
 		NamePrefix: "cr.ray.io/rayproject/",
 	}
-	if err := Digest("testdata/hello-test.wanda.yaml", config, &buf); err != nil {
+	if err := Digest(t.Context(), "testdata/hello-test.wanda.yaml", config, &buf); err != nil {
 		t.Fatalf("Digest() = %v, want nil", err)
 	}
 	got := strings.TrimSpace(buf.String())
@@ -1116,10 +1116,10 @@ func TestDigest_deterministic(t *testing.T) {
 		NamePrefix: "cr.ray.io/rayproject/",
 	}
 	var buf1, buf2 strings.Builder
-	if err := Digest("testdata/hello-test.wanda.yaml", config, &buf1); err != nil {
+	if err := Digest(t.Context(), "testdata/hello-test.wanda.yaml", config, &buf1); err != nil {
 		t.Fatalf("first Digest() = %v, want nil", err)
 	}
-	if err := Digest("testdata/hello-test.wanda.yaml", config, &buf2); err != nil {
+	if err := Digest(t.Context(), "testdata/hello-test.wanda.yaml", config, &buf2); err != nil {
 		t.Fatalf("second Digest() = %v, want nil", err)
 	}
 	if got1, got2 := buf1.String(), buf2.String(); got1 != got2 {
@@ -1139,10 +1139,10 @@ func TestDigest_epochChangesDigest(t *testing.T) {
 		Epoch:      "epoch2",
 	}
 	var buf1, buf2 strings.Builder
-	if err := Digest("testdata/hello-test.wanda.yaml", config1, &buf1); err != nil {
+	if err := Digest(t.Context(), "testdata/hello-test.wanda.yaml", config1, &buf1); err != nil {
 		t.Fatalf("Digest(epoch1) = %v, want nil", err)
 	}
-	if err := Digest("testdata/hello-test.wanda.yaml", config2, &buf2); err != nil {
+	if err := Digest(t.Context(), "testdata/hello-test.wanda.yaml", config2, &buf2); err != nil {
 		t.Fatalf("Digest(epoch2) = %v, want nil", err)
 	}
 	if buf1.String() == buf2.String() {
@@ -1165,7 +1165,7 @@ func TestDigest_envFileChangesDigest(t *testing.T) {
 	}
 
 	var buf1 strings.Builder
-	if err := Digest("testdata/env-file-test.wanda.yaml", config, &buf1); err != nil {
+	if err := Digest(t.Context(), "testdata/env-file-test.wanda.yaml", config, &buf1); err != nil {
 		t.Fatalf("Digest(v1) = %v, want nil", err)
 	}
 
@@ -1174,7 +1174,7 @@ func TestDigest_envFileChangesDigest(t *testing.T) {
 	}
 
 	var buf2 strings.Builder
-	if err := Digest("testdata/env-file-test.wanda.yaml", config, &buf2); err != nil {
+	if err := Digest(t.Context(), "testdata/env-file-test.wanda.yaml", config, &buf2); err != nil {
 		t.Fatalf("Digest(v2) = %v, want nil", err)
 	}
 
@@ -1193,7 +1193,7 @@ func TestDigest_matchesBuildDigest(t *testing.T) {
 	}
 
 	var buf strings.Builder
-	if err := Digest("testdata/hello-test.wanda.yaml", config, &buf); err != nil {
+	if err := Digest(t.Context(), "testdata/hello-test.wanda.yaml", config, &buf); err != nil {
 		t.Fatalf("Digest() = %v, want nil", err)
 	}
 	digest := strings.TrimSpace(buf.String())
@@ -0,0 +1,189 @@
+package wanda
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
+)
+
+// Modes of checking a spec's froms against its Dockerfile.
+const (
+	fromsCheckWarn  = "warn"
+	fromsCheckError = "error"
+	fromsCheckOff   = "off"
+)
+
+// dockerfileImageRef is an image that a Dockerfile builds or copies from.
+type dockerfileImageRef struct {
+	Ref     string   // Image reference, with variables substituted.
+	Line    int      // Line number of the instruction.
+	Missing []string // Variables in the reference that have no value.
+}
+
+// dockerfileImageRefs returns the images used by FROM, COPY --from and
+// RUN --mount=from= instructions in the given stages, except for
+// references to earlier build stages. buildArgs are the values of the build
+// args passed to the build. nil stages means all stages.
+func dockerfileImageRefs(
+	insts []*dockerfileInstruction, buildArgs map[string]string, p *platform,
+	stages map[int]bool,
+) []*dockerfileImageRef {
+	scope := newDockerfileScope(buildArgs, p)
+
+	var refs []*dockerfileImageRef
+	add := func(raw string, vars map[string]string, line int) {
+		ref, missing := expandDockerfileVars(raw, vars)
+		if len(missing) == 0 && scope.isStage(ref) {
+			return
+		}
+		refs = append(refs, &dockerfileImageRef{
+			Ref:     ref,
+			Line:    line,
+			Missing: missing,
+		})
+	}
+
+	for _, inst := range insts {
+		if !scope.inStages(inst, stages) {
+			scope.apply(inst)
+			continue
+		}
+		if inst.Cmd == "FROM" {
+			// FROM can only use global ARGs.
+			if len(inst.Args) > 0 {
+				add(inst.Args[0], scope.global, inst.Line)
+			}
+		}
+		for _, ref := range stageRefs(inst) {
+			add(ref, scope.vars(), inst.Line)
+		}
+		scope.apply(inst)
+	}
+	return refs
+}
+
+// normalizeImageRef returns the fully qualified form of an image reference,
+// so that "ubuntu" and "docker.io/library/ubuntu:latest" compare equal.
+func normalizeImageRef(s string) string {
+	ref, err := cranename.ParseReference(s)
+	if err != nil {
+		return s
+	}
+	return ref.Name()
+}
+
+// fromsProblems compares the images that a Dockerfile uses with the froms
+// declared in its spec. An image that is used but not declared escapes the
+// content digest; a declared image that is never used is likely stale.
+func fromsProblems(
+	spec *Spec, dockerfile string, insts []*dockerfileInstruction,
+	buildArgs map[string]string, p *platform,
+) []string {
+	declared := make(map[string]string) // normalized -> froms entry
+	for _, from := range spec.Froms {
+		// "@name" froms are local images that the Dockerfile uses as "name".
+		declared[normalizeImageRef(strings.TrimPrefix(from, "@"))] = from
+	}
+
+	stages, err := targetStages(insts, spec.Target, buildArgs, p)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", dockerfile, err)}
+	}
+
+	var problems []string
+	used := make(map[string]bool)
+	unresolved := false
+
+	for _, ref := range dockerfileImageRefs(insts, buildArgs, p, stages) {
+		if len(ref.Missing) > 0 {
+			unresolved = true
+			problems = append(problems, fmt.Sprintf(
+				"%s:%d: cannot check image %q: no value for %s",
+				dockerfile, ref.Line, ref.Ref, strings.Join(ref.Missing, ", "),
+			))
+			continue
+		}
+		if from, ok := declared[normalizeImageRef(ref.Ref)]; ok {
+			used[from] = true
+			continue
+		}
+		if isDockerScratch(ref.Ref) {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf(
+			"%s:%d: image %q is not declared in froms",
+			dockerfile, ref.Line, ref.Ref,
+		))
+	}
+
+	// With unresolved references, any declared image might be used.
+	if !unresolved {
+		for _, from := range spec.Froms {
+			if !used[from] {
+				problems = append(problems, fmt.Sprintf(
+					"froms entry %q is not used by %s", from, dockerfile,
+				))
+			}
+		}
+	}
+	return problems
+}
+
+// specBuildArgs returns the build args passed to docker build for spec;
+// build args override build hint args.
+func (f *Forge) specBuildArgs(spec *Spec) map[string]string {
+	args := resolveBuildArgs(spec.BuildHintArgs, f.lookup)
+	for k, v := range resolveBuildArgs(spec.BuildArgs, f.lookup) {
+		args[k] = v
+	}
+	return args
+}
+
+// checkFroms checks the froms of spec against its Dockerfile, as it is
+// built for platform p; a nil p is the host platform. Depending on the
+// configured mode, problems are logged as warnings or fail the build.
+func (f *Forge) checkFroms(spec *Spec, p *platform, out *buildOutput) error {
+	mode := f.config.FromsCheck
+	switch mode {
+	case fromsCheckOff:
+		return nil
+	case "":
+		mode = fromsCheckWarn
+	case fromsCheckWarn, fromsCheckError:
+	default:
+		return fmt.Errorf("unknown froms check mode %q", mode)
+	}
+	name := spec.Name
+	if p != nil {
+		name = p.imageName(spec.Name)
+	} else {
+		p = hostPlatform()
+	}
+
+	var problems []string
+	dockerfile := filepath.Join(f.workDir, filepath.FromSlash(spec.Dockerfile))
+	insts, err := parseDockerfileFile(dockerfile)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("read dockerfile: %v", err))
+	} else {
+		problems = fromsProblems(
+			spec, spec.Dockerfile, insts, f.specBuildArgs(spec), p,
+		)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if mode == fromsCheckError {
+		return fmt.Errorf(
+			"froms of %s do not match its dockerfile:\n  %s",
+			name, strings.Join(problems, "\n  "),
+		)
+	}
+	for _, problem := range problems {
+		out.log.Printf("warning: %s", problem)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package wanda
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustParseDockerfile(t *testing.T, content string) []*dockerfileInstruction {
+	t.Helper()
+	insts, err := parseDockerfile(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("parseDockerfile: %v", err)
+	}
+	return insts
+}
+
+func TestDockerfileImageRefs(t *testing.T) {
+	insts := mustParseDockerfile(t, strings.Join([]string{
+		"ARG BASE",
+		"ARG TOOLS=tools:1",
+		"FROM ${BASE} AS base",
+		"ARG TOOLS",
+		"COPY --from=$TOOLS /bin/tool /bin/tool",
+		"FROM base AS second",
+		"COPY --from=0 /a /a",
+		"COPY --from=busybox:1.36 /bin/sh /bin/sh",
+		"RUN --mount=type=bind,from=cache-img,target=/c ls /c",
+		"FROM alpine-$TARGETARCH",
+	}, "\n"))
+
+	refs := dockerfileImageRefs(
+		insts,
+		map[string]string{"BASE": "cr.ray.io/rayproject/base"},
+		&platform{OS: "linux", Arch: "arm64"},
+		nil,
+	)
+
+	want := []*dockerfileImageRef{
+		{Ref: "cr.ray.io/rayproject/base", Line: 3},
+		{Ref: "tools:1", Line: 5},
+		{Ref: "busybox:1.36", Line: 8},
+		{Ref: "cache-img", Line: 9},
+		{Ref: "alpine-arm64", Line: 10},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		for _, r := range refs {
+			t.Logf("%+v", r)
+		}
+		t.Errorf("dockerfileImageRefs() mismatch")
+	}
+}
+
+func TestFromsProblems(t *testing.T) {
+	host := &platform{OS: "linux", Arch: "amd64"}
+	insts := mustParseDockerfile(t, strings.Join([]string{
+		"ARG BASE",
+		"FROM $BASE",
+		"COPY --from=busybox /bin/sh /bin/sh",
+		"FROM scratch",
+		"FROM mybase",
+	}, "\n"))
+
+	t.Run("all declared", func(t *testing.T) {
+		spec := &Spec{Froms: []string{
+			"cr.ray.io/rayproject/base",
+			"docker.io/library/busybox:latest",
+			"@mybase",
+		}}
+		args := map[string]string{"BASE": "cr.ray.io/rayproject/base"}
+		if got := fromsProblems(spec, "Dockerfile", insts, args, host); got != nil {
+			t.Errorf("fromsProblems() = %q, want nil", got)
+		}
+	})
+
+	t.Run("missing and unused", func(t *testing.T) {
+		spec := &Spec{Froms: []string{"cr.ray.io/rayproject/base", "ubuntu:22.04", "@mybase"}}
+		args := map[string]string{"BASE": "cr.ray.io/rayproject/base"}
+		got := fromsProblems(spec, "Dockerfile", insts, args, host)
+		want := []string{
+			`Dockerfile:3: image "busybox" is not declared in froms`,
+			`froms entry "ubuntu:22.04" is not used by Dockerfile`,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("fromsProblems() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("unresolved", func(t *testing.T) {
+		spec := &Spec{Froms: []string{"cr.ray.io/rayproject/base", "busybox", "@mybase", "extra"}}
+		got := fromsProblems(spec, "Dockerfile", insts, nil, host)
+		want := []string{
+			`Dockerfile:2: cannot check image "": no value for BASE`,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("fromsProblems() = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestCheckFroms(t *testing.T) {
+	spec := &Spec{
+		Name:       "dep-middle",
+		Dockerfile: "Dockerfile.dep-middle",
+		Froms:      []string{"cr.ray.io/rayproject/dep-base", "ubuntu:22.04"},
+	}
+
+	for _, test := range []struct {
+		mode    string
+		wantErr bool
+	}{
+		{mode: "", wantErr: false},
+		{mode: "warn", wantErr: false},
+		{mode: "off", wantErr: false},
+		{mode: "error", wantErr: true},
+		{mode: "bogus", wantErr: true},
+	} {
+		forge, err := NewForge(&ForgeConfig{WorkDir: "testdata", FromsCheck: test.mode})
+		if err != nil {
+			t.Fatalf("make forge: %v", err)
+		}
+		err = forge.checkFroms(spec, nil, defaultBuildOutput())
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("checkFroms() in mode %q = %v, want error %v", test.mode, err, test.wantErr)
+		}
+	}
+
+	spec.Froms = []string{"cr.ray.io/rayproject/dep-base"}
+	forge, err := NewForge(&ForgeConfig{WorkDir: "testdata", FromsCheck: "error"})
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+	if err := forge.checkFroms(spec, nil, defaultBuildOutput()); err != nil {
+		t.Errorf("checkFroms() with matching froms = %v, want nil", err)
+	}
+}
+
+func TestCheckFroms_platform(t *testing.T) {
+	workDir := t.TempDir()
+	content := "ARG TARGETARCH\nFROM cr.ray.io/rayproject/base-${TARGETARCH}\n"
+	if err := os.WriteFile(filepath.Join(workDir, "Dockerfile"), []byte(content), 0644); err != nil {
+		t.Fatalf("write dockerfile: %v", err)
+	}
+	spec := &Spec{
+		Name:       "multi",
+		Dockerfile: "Dockerfile",
+		Froms:      []string{"cr.ray.io/rayproject/base-arm64"},
+		Platforms:  []string{"linux/arm64"},
+	}
+
+	forge, err := NewForge(&ForgeConfig{WorkDir: workDir, FromsCheck: "error"})
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+	arm64 := &platform{OS: "linux", Arch: "arm64"}
+	if err := forge.checkFroms(spec, arm64, defaultBuildOutput()); err != nil {
+		t.Errorf("checkFroms(linux/arm64) = %v, want nil", err)
+	}
+	amd64 := &platform{OS: "linux", Arch: "amd64"}
+	err = forge.checkFroms(spec, amd64, defaultBuildOutput())
+	if err == nil || !strings.Contains(err.Error(), "multi-linux-amd64") {
+		t.Errorf("checkFroms(linux/amd64) = %v, want error for multi-linux-amd64", err)
+	}
+}
@@ -0,0 +1,473 @@
+package wanda
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
+	crane "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// GCConfig is a configuration for garbage-collecting the work repository.
+// Tags are deleted when they are older than either of the limits.
+type GCConfig struct {
+	// MaxAgeDays is the number of days after which an image expires.
+	MaxAgeDays int
+
+	// MaxEpochs is the number of cache epochs, counting the current one,
+	// after which an image expires. Epochs are counted in the epoch policy
+	// that the image was built with; images of specs with an explicit epoch
+	// count default epochs, and images with the "never" policy only expire
+	// by age.
+	MaxEpochs int
+
+	// DryRun only reports what would be deleted.
+	DryRun bool
+}
+
+func (c *GCConfig) check() error {
+	if c.MaxAgeDays <= 0 && c.MaxEpochs <= 0 {
+		return fmt.Errorf("needs a max age in days or epochs")
+	}
+	return nil
+}
+
+// gcCutoff returns the time before which images built with the given
+// cache epoch policy expire.
+func (c *GCConfig) gcCutoff(now time.Time, policy string) time.Time {
+	var cutoff time.Time
+	if c.MaxAgeDays > 0 {
+		cutoff = now.Add(-time.Duration(c.MaxAgeDays) * 24 * time.Hour)
+	}
+	if c.MaxEpochs > 0 && policy != epochNever {
+		if t := epochCutoff(now, c.MaxEpochs, policy); t.After(cutoff) {
+			cutoff = t
+		}
+	}
+	return cutoff
+}
+
+// epochCutoff returns the start of the oldest of the n most recent cache
+// epochs of the given policy. Policies other than daily, weekly and
+// monthly count default epochs. Epochs start at whole hours.
+func epochCutoff(now time.Time, n int, policy string) time.Time {
+	epochAt := func(t time.Time) string {
+		switch policy {
+		case epochDaily, epochWeekly, epochMonthly:
+			return epochForPolicy(policy, t)
+		}
+		return defaultCacheEpoch(func() time.Time { return t })
+	}
+
+	t := now.Truncate(time.Hour)
+	epoch := epochAt(t)
+	for seen := 1; ; {
+		prev := t.Add(-time.Hour)
+		if e := epochAt(prev); e != epoch {
+			if seen == n {
+				return t
+			}
+			seen++
+			epoch = e
+		}
+		t = prev
+	}
+}
+
+// gcImage is an image (or image index) that tags in the work repository
+// point to.
+type gcImage struct {
+	digest  crane.Hash
+	created time.Time // Zero if unknown.
+
+	// epochPolicy is the cache epoch policy that the image was built with,
+	// from its labels. Empty if it is not labeled.
+	epochPolicy string
+
+	// spec is the name of the spec that the image was built from, from its
+	// labels. Empty if it is not labeled.
+	spec string
+
+	// blobs are the sizes of the manifests, configs and layers of the image.
+	blobs map[crane.Hash]int64
+}
+
+func (img *gcImage) addImage(i crane.Image) error {
+	m, err := i.Manifest()
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	img.blobs[m.Config.Digest] = m.Config.Size
+	for _, l := range m.Layers {
+		img.blobs[l.Digest] = l.Size
+	}
+
+	config, err := i.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	if policy := config.Config.Labels[labelEpochPolicy]; policy != "" {
+		img.epochPolicy = policy
+	}
+	if spec := config.Config.Labels[labelSpec]; spec != "" {
+		img.spec = spec
+	}
+	// Images built with SOURCE_DATE_EPOCH=0 do not have a useful time.
+	if created := config.Created.Time; created.Unix() > 0 && created.After(img.created) {
+		img.created = created
+	}
+	return nil
+}
+
+func (f *Forge) inspectGCImage(ctx context.Context, ref cranename.Reference) (*gcImage, error) {
+	desc, err := remote.Get(ref, f.remoteOptsFor(ctx, nil)...)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &gcImage{
+		digest: desc.Digest,
+		blobs:  map[crane.Hash]int64{desc.Digest: desc.Size},
+	}
+	if !desc.MediaType.IsIndex() {
+		i, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		if err := img.addImage(i); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("read index manifest: %w", err)
+	}
+	img.spec = m.Annotations[labelSpec]
+	for _, child := range m.Manifests {
+		if !child.MediaType.IsImage() {
+			continue
+		}
+		img.blobs[child.Digest] = child.Size
+		i, err := idx.Image(child.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("read image %s: %w", child.Digest, err)
+		}
+		if err := img.addImage(i); err != nil {
+			return nil, fmt.Errorf("image %s: %w", child.Digest, err)
+		}
+	}
+	return img, nil
+}
+
+// gcTagSubject returns the digest of the image that a tag is attached to,
+// for cosign signature tags ("sha256-<hex>.sig"), signer tags
+// ("sha256-<hex>.<id>.sig") and referrers tag schema tags ("sha256-<hex>").
+// These tags are deleted along with their subject.
+func gcTagSubject(tag string) (crane.Hash, bool) {
+	alg, rest, ok := strings.Cut(tag, "-")
+	if !ok || alg != "sha256" {
+		return crane.Hash{}, false
+	}
+	hex, _, _ := strings.Cut(rest, ".")
+	h, err := crane.NewHash(alg + ":" + hex)
+	if err != nil {
+		return crane.Hash{}, false
+	}
+	return h, true
+}
+
+// gcTagBuildID returns the build ID of a work tag of an image built from
+// spec. Work tags are written by ForgeConfig.workTag as "<build>-<spec>", or
+// "<build>-<spec>-<os>-<arch>" for the image of one platform. It returns ""
+// for cache tags, tags attached to an image, and tags that are not in that
+// form, such as the tags of local builds, which have no build ID.
+func gcTagBuildID(tag, spec string) string {
+	if spec == "" || strings.HasPrefix(tag, "z-") {
+		return ""
+	}
+	if _, ok := gcTagSubject(tag); ok {
+		return ""
+	}
+	if buildID, ok := strings.CutSuffix(tag, "-"+spec); ok {
+		return buildID
+	}
+	i := strings.LastIndex(tag, "-"+spec+"-")
+	if i <= 0 {
+		return ""
+	}
+	// The rest is the "<os>-<arch>" of the platform.
+	if goos, arch, ok := strings.Cut(tag[i+len(spec)+2:], "-"); !ok ||
+		goos == "" || arch == "" || strings.Contains(arch, "-") {
+		return ""
+	}
+	return tag[:i]
+}
+
+// gcReport is the result of garbage-collecting the work repository.
+type gcReport struct {
+	Tags    []string     // Expired tags that are deleted, sorted.
+	Images  []crane.Hash // Manifests that are deleted.
+	Kept    []string     // Expired tags kept because a live tag shares their image.
+	Undated []string     // Tags kept because their images have no creation time.
+	Bytes   int64        // Size of the blobs that no live tag uses anymore.
+	Created map[string]time.Time
+}
+
+// gc finds the expired tags in the work repository and deletes their
+// images, unless it is a dry run.
+//
+// A cache tag expires when its image is created before the cutoff of its
+// epoch policy. A work tag expires when every image of its build has
+// expired, so that all the images of a build are kept or deleted together.
+// Images are deleted by digest, which removes all of their tags, so an
+// image is only deleted when all of its tags have expired. Signatures and
+// referrers of an image are deleted with it.
+func (f *Forge) gc(ctx context.Context, config *GCConfig, now time.Time) (*gcReport, error) {
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+
+	repo, err := cranename.NewRepository(f.config.workRepo())
+	if err != nil {
+		return nil, fmt.Errorf("parse work repo: %w", err)
+	}
+	tags, err := remote.List(repo, f.remoteOptsFor(ctx, nil)...)
+	if err != nil {
+		return nil, fmt.Errorf("list tags of %s: %w", repo, err)
+	}
+	sort.Strings(tags)
+
+	images := make(map[crane.Hash]*gcImage)
+	tagImages := make(map[string]*gcImage)
+	for _, tag := range tags {
+		img, err := f.inspectGCImage(ctx, repo.Tag(tag))
+		if err != nil {
+			return nil, fmt.Errorf("inspect %s: %w", tag, err)
+		}
+		if seen, ok := images[img.digest]; ok {
+			img = seen
+		} else {
+			images[img.digest] = img
+		}
+		tagImages[tag] = img
+	}
+
+	imageExpired := func(img *gcImage) bool {
+		cutoff := config.gcCutoff(now, img.epochPolicy)
+		return !img.created.IsZero() && img.created.Before(cutoff)
+	}
+
+	buildID := func(tag string) string {
+		return gcTagBuildID(tag, tagImages[tag].spec)
+	}
+
+	// A build is live as long as any of its images has not expired. Images
+	// without a creation time, such as images built with SOURCE_DATE_EPOCH,
+	// go with the other images of their build.
+	liveBuilds := make(map[string]bool)
+	datedBuilds := make(map[string]bool)
+	for tag, img := range tagImages {
+		id := buildID(tag)
+		if id == "" || img.created.IsZero() {
+			continue
+		}
+		datedBuilds[id] = true
+		if !imageExpired(img) {
+			liveBuilds[id] = true
+		}
+	}
+
+	expired := func(tag string) bool {
+		if id := buildID(tag); id != "" {
+			return datedBuilds[id] && !liveBuilds[id]
+		} else if !strings.HasPrefix(tag, "z-") {
+			return false
+		}
+		return imageExpired(tagImages[tag])
+	}
+
+	// Tags attached to an image are left out until it is known whether
+	// their subject is deleted.
+	subjects := make(map[string]crane.Hash)
+	for _, tag := range tags {
+		if d, ok := gcTagSubject(tag); ok {
+			subjects[tag] = d
+		}
+	}
+
+	live := make(map[crane.Hash]bool)
+	for _, tag := range tags {
+		if _, ok := subjects[tag]; !ok && !expired(tag) {
+			live[tagImages[tag].digest] = true
+		}
+	}
+
+	report := &gcReport{Created: make(map[string]time.Time)}
+	deleted := make(map[crane.Hash]bool)
+	for _, tag := range tags {
+		if _, ok := subjects[tag]; ok {
+			continue
+		}
+		if !expired(tag) {
+			// Tags without a creation time never expire, so they are
+			// reported for manual cleanup.
+			undated := strings.HasPrefix(tag, "z-") && tagImages[tag].created.IsZero()
+			if id := buildID(tag); id != "" {
+				undated = !datedBuilds[id]
+			}
+			if undated {
+				report.Undated = append(report.Undated, tag)
+			}
+			continue
+		}
+		img := tagImages[tag]
+		report.Created[tag] = img.created
+		if live[img.digest] {
+			report.Kept = append(report.Kept, tag)
+			continue
+		}
+		report.Tags = append(report.Tags, tag)
+		deleted[img.digest] = true
+	}
+
+	// An attached tag goes with its subject: it is deleted when its subject
+	// is deleted or no longer exists, and kept otherwise.
+	var attached []string
+	for _, tag := range tags {
+		subject, ok := subjects[tag]
+		if !ok {
+			continue
+		}
+		if subjectImg, ok := images[subject]; ok {
+			if !deleted[subject] {
+				live[tagImages[tag].digest] = true
+				continue
+			}
+			report.Created[tag] = subjectImg.created
+		} else {
+			exists, err := f.imageExists(ctx, repo.Digest(subject.String()))
+			if err != nil {
+				return nil, fmt.Errorf("check subject of %s: %w", tag, err)
+			}
+			if exists {
+				live[tagImages[tag].digest] = true
+				continue
+			}
+		}
+		attached = append(attached, tag)
+	}
+	for _, tag := range attached {
+		if d := tagImages[tag].digest; !live[d] {
+			report.Tags = append(report.Tags, tag)
+			deleted[d] = true
+		}
+	}
+	sort.Strings(report.Tags)
+
+	liveBlobs := make(map[crane.Hash]bool)
+	for d, img := range images {
+		if live[d] {
+			for b := range img.blobs {
+				liveBlobs[b] = true
+			}
+		}
+	}
+	deadBlobs := make(map[crane.Hash]int64)
+	for d := range deleted {
+		for b, size := range images[d].blobs {
+			if !liveBlobs[b] {
+				deadBlobs[b] = size
+			}
+		}
+	}
+	for d := range deleted {
+		report.Images = append(report.Images, d)
+	}
+	sort.Slice(report.Images, func(i, j int) bool {
+		return report.Images[i].String() < report.Images[j].String()
+	})
+	for _, size := range deadBlobs {
+		report.Bytes += size
+	}
+
+	if config.DryRun {
+		return report, nil
+	}
+	for _, d := range report.Images {
+		if err := remote.Delete(repo.Digest(d.String()), f.remoteOptsFor(ctx, nil)...); err != nil {
+			return nil, fmt.Errorf("delete %s: %w", d, err)
+		}
+	}
+	return report, nil
+}
+
+// imageExists reports whether the manifest at ref exists.
+func (f *Forge) imageExists(ctx context.Context, ref cranename.Reference) (bool, error) {
+	_, err := remote.Head(ref, f.remoteOptsFor(ctx, nil)...)
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GC deletes the expired cache and work tags in the work repository, and
+// writes what it deleted, or would delete in a dry run, to w. With a local
+// registry, the blobs that are no longer used are removed from its
+// directory.
+func GC(ctx context.Context, config *ForgeConfig, gcConfig *GCConfig, w io.Writer) error {
+	if config.LocalRegistry != "" {
+		c, stop, err := withLocalRegistry(config)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		config = c
+	}
+
+	forge, err := NewForge(config)
+	if err != nil {
+		return fmt.Errorf("make forge: %w", err)
+	}
+
+	report, err := forge.gc(ctx, gcConfig, time.Now())
+	if err != nil {
+		return err
+	}
+
+	verb := "deleted"
+	if gcConfig.DryRun {
+		verb = "would delete"
+	}
+	for _, tag := range report.Tags {
+		created := report.Created[tag]
+		if created.IsZero() {
+			fmt.Fprintf(w, "%s %s\n", verb, tag)
+			continue
+		}
+		fmt.Fprintf(w, "%s %s (created %s)\n", verb, tag, created.Format(time.DateOnly))
+	}
+	for _, tag := range report.Kept {
+		fmt.Fprintf(w, "kept %s: image is still used by a live tag\n", tag)
+	}
+	for _, tag := range report.Undated {
+		fmt.Fprintf(w, "kept %s: image has no creation time, delete it manually\n", tag)
+	}
+	fmt.Fprintf(
+		w, "%s %d tags in %d images, reclaiming %d bytes\n",
+		verb, len(report.Tags), len(report.Images), report.Bytes,
+	)
+	return nil
+}
@@ -0,0 +1,399 @@
+package wanda
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestEpochCutoff(t *testing.T) {
+	// Wednesday 2025-01-15 12:30 in SFO, in epoch "202503a", which started
+	// on Sunday 2025-01-12.
+	now := time.Date(2025, 1, 15, 12, 30, 0, 0, sfoAround)
+
+	for _, test := range []struct {
+		n    int
+		want time.Time
+	}{
+		{1, time.Date(2025, 1, 12, 0, 0, 0, 0, sfoAround)},
+		{2, time.Date(2025, 1, 9, 0, 0, 0, 0, sfoAround)},
+		{3, time.Date(2025, 1, 5, 0, 0, 0, 0, sfoAround)},
+	} {
+		got := epochCutoff(now, test.n, "")
+		if !got.Equal(test.want) {
+			t.Errorf("epochCutoff(%d) = %v, want %v", test.n, got, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		policy string
+		n      int
+		want   time.Time
+	}{
+		{epochDaily, 2, time.Date(2025, 1, 14, 0, 0, 0, 0, sfoAround)},
+		{epochWeekly, 1, time.Date(2025, 1, 13, 0, 0, 0, 0, sfoAround)},
+		{epochMonthly, 2, time.Date(2024, 12, 1, 0, 0, 0, 0, sfoAround)},
+		{"v2", 1, time.Date(2025, 1, 12, 0, 0, 0, 0, sfoAround)},
+	} {
+		got := epochCutoff(now, test.n, test.policy)
+		if !got.Equal(test.want) {
+			t.Errorf("epochCutoff(%d, %q) = %v, want %v", test.n, test.policy, got, test.want)
+		}
+	}
+}
+
+func TestGCCutoff(t *testing.T) {
+	now := time.Date(2025, 1, 15, 12, 30, 0, 0, sfoAround)
+
+	if err := (&GCConfig{}).check(); err == nil {
+		t.Errorf("check() without limits should fail")
+	}
+
+	config := &GCConfig{MaxAgeDays: 7, MaxEpochs: 1}
+	// The epoch limit is more recent, so it wins.
+	got := config.gcCutoff(now, "")
+	if want := time.Date(2025, 1, 12, 0, 0, 0, 0, sfoAround); !got.Equal(want) {
+		t.Errorf("gcCutoff() = %v, want %v", got, want)
+	}
+	// Images that never change epochs only expire by age.
+	got = config.gcCutoff(now, epochNever)
+	if want := now.Add(-7 * 24 * time.Hour); !got.Equal(want) {
+		t.Errorf("gcCutoff(never) = %v, want %v", got, want)
+	}
+}
+
+func pushGCImage(t *testing.T, repo, tag string, created time.Time) cranev1.Hash {
+	t.Helper()
+	return pushGCImageWithLabels(t, repo, tag, created, nil)
+}
+
+// pushGCWorkImage pushes an image built from spec, tagged with tag.
+func pushGCWorkImage(t *testing.T, repo, tag, spec string, created time.Time) cranev1.Hash {
+	t.Helper()
+	return pushGCImageWithLabels(t, repo, tag, created, map[string]string{labelSpec: spec})
+}
+
+func pushGCImageWithLabels(
+	t *testing.T, repo, tag string, created time.Time, labels map[string]string,
+) cranev1.Hash {
+	t.Helper()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+	img, err = mutate.CreatedAt(img, cranev1.Time{Time: created})
+	if err != nil {
+		t.Fatalf("set created: %v", err)
+	}
+	if len(labels) > 0 {
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			t.Fatalf("read config: %v", err)
+		}
+		cfg = cfg.DeepCopy()
+		cfg.Config.Labels = labels
+		if img, err = mutate.ConfigFile(img, cfg); err != nil {
+			t.Fatalf("set labels: %v", err)
+		}
+	}
+	ref, err := name.NewTag(repo + ":" + tag)
+	if err != nil {
+		t.Fatalf("parse tag: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("push image %q: %v", tag, err)
+	}
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatalf("image digest: %v", err)
+	}
+	return d
+}
+
+func TestGC(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	repo := fmt.Sprintf("%s/work", server.Listener.Addr().String())
+
+	now := time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-10 * 24 * time.Hour)
+	recent := now.Add(-24 * time.Hour)
+
+	digests := map[string]cranev1.Hash{
+		"z-old":       pushGCWorkImage(t, repo, "z-old", "shared", old),
+		"z-new":       pushGCImage(t, repo, "z-new", recent),
+		"b1-hello":    pushGCWorkImage(t, repo, "b1-hello", "hello", old),
+		"b2-hello":    pushGCWorkImage(t, repo, "b2-hello", "hello", old),
+		"b2-world":    pushGCWorkImage(t, repo, "b2-world", "world", recent),
+		"b3-shared":   pushGCWorkImage(t, repo, "b3-shared", "shared", old),
+		"z-reproduce": pushGCImage(t, repo, "z-reproduce", time.Unix(0, 0)),
+
+		"b5-hello-linux-arm64": pushGCWorkImage(t, repo, "b5-hello-linux-arm64", "hello", old),
+		"b6-hello":             pushGCWorkImage(t, repo, "b6-hello", "hello", time.Unix(0, 0)),
+
+		// Tags of local builds have no build ID, and are never deleted.
+		"hello":             pushGCWorkImage(t, repo, "hello", "hello", old),
+		"hello-test":        pushGCWorkImage(t, repo, "hello-test", "hello-test", old),
+		"hello-linux-arm64": pushGCWorkImage(t, repo, "hello-linux-arm64", "hello", old),
+	}
+
+	// An old cache tag that points to the same image as a live work tag.
+	desc, err := remote.Get(mustNewTag(t, repo+":z-old"))
+	if err != nil {
+		t.Fatalf("get z-old: %v", err)
+	}
+	pushGCWorkImage(t, repo, "b4-other", "other", recent)
+	if err := remote.Tag(mustNewTag(t, repo+":b4-shared"), desc); err != nil {
+		t.Fatalf("tag b4-shared: %v", err)
+	}
+
+	forge, err := NewForge(&ForgeConfig{WorkDir: "testdata", WorkRepo: repo})
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+
+	config := &GCConfig{MaxAgeDays: 7, DryRun: true}
+	report, err := forge.gc(t.Context(), config, now)
+	if err != nil {
+		t.Fatalf("gc dry run: %v", err)
+	}
+	wantTags := []string{"b1-hello", "b3-shared", "b5-hello-linux-arm64"}
+	if !reflect.DeepEqual(report.Tags, wantTags) {
+		t.Errorf("gc() tags = %q, want %q", report.Tags, wantTags)
+	}
+	if want := []string{"z-old"}; !reflect.DeepEqual(report.Kept, want) {
+		t.Errorf("gc() kept = %q, want %q", report.Kept, want)
+	}
+	if want := []string{"b6-hello", "z-reproduce"}; !reflect.DeepEqual(report.Undated, want) {
+		t.Errorf("gc() undated = %q, want %q", report.Undated, want)
+	}
+	if len(report.Images) != 3 {
+		t.Errorf("gc() images = %v, want 3", report.Images)
+	}
+	// Each random image has a 1024 byte layer, plus a config and manifest.
+	if report.Bytes <= 2*1024 {
+		t.Errorf("gc() reclaimed %d bytes, want more than %d", report.Bytes, 2*1024)
+	}
+
+	exists := func(tag string) bool {
+		_, err := remote.Head(mustNewDigest(t, repo, digests[tag]))
+		return err == nil
+	}
+	for tag := range digests {
+		if !exists(tag) {
+			t.Errorf("dry run deleted %s", tag)
+		}
+	}
+
+	config.DryRun = false
+	if _, err := forge.gc(t.Context(), config, now); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	for tag := range digests {
+		deleted := tag == "b1-hello" || tag == "b3-shared" || tag == "b5-hello-linux-arm64"
+		if got := !exists(tag); got != deleted {
+			t.Errorf("%s deleted = %v, want %v", tag, got, deleted)
+		}
+	}
+}
+
+func TestGC_output(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	repo := fmt.Sprintf("%s/work", server.Listener.Addr().String())
+
+	pushGCImage(t, repo, "z-old", time.Now().Add(-30*24*time.Hour))
+	pushGCImage(t, repo, "z-new", time.Now())
+
+	buf := new(bytes.Buffer)
+	config := &ForgeConfig{WorkDir: "testdata", WorkRepo: repo}
+	if err := GC(t.Context(), config, &GCConfig{MaxEpochs: 4, DryRun: true}, buf); err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "would delete z-old") || strings.Contains(out, "z-new") {
+		t.Errorf("GC() output = %q", out)
+	}
+	if !strings.Contains(out, "would delete 1 tags in 1 images") {
+		t.Errorf("GC() output = %q, want summary", out)
+	}
+}
+
+func mustNewTag(t *testing.T, s string) name.Tag {
+	t.Helper()
+	tag, err := name.NewTag(s)
+	if err != nil {
+		t.Fatalf("parse tag %q: %v", s, err)
+	}
+	return tag
+}
+
+func mustNewDigest(t *testing.T, repo string, d cranev1.Hash) name.Digest {
+	t.Helper()
+	ref, err := name.NewDigest(repo + "@" + d.String())
+	if err != nil {
+		t.Fatalf("parse digest: %v", err)
+	}
+	return ref
+}
+
+func TestGCTagSubject(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+	for _, tag := range []string{"sha256-" + hex, "sha256-" + hex + ".sig", "sha256-" + hex + ".att"} {
+		d, ok := gcTagSubject(tag)
+		if !ok || d.String() != "sha256:"+hex {
+			t.Errorf("gcTagSubject(%q) = %v, %t, want sha256:%s", tag, d, ok, hex)
+		}
+		if id := gcTagBuildID(tag, "hello"); id != "" {
+			t.Errorf("gcTagBuildID(%q) = %q, want empty", tag, id)
+		}
+	}
+	for _, tag := range []string{"z-" + hex, "b1-hello", "sha256-abc", "hello"} {
+		if d, ok := gcTagSubject(tag); ok {
+			t.Errorf("gcTagSubject(%q) = %v, want not attached", tag, d)
+		}
+	}
+}
+
+func TestGCTagBuildID(t *testing.T) {
+	for _, test := range []struct {
+		tag  string
+		spec string
+		want string
+	}{
+		{"b1-hello", "hello", "b1"},
+		{"b1-hello-test", "hello-test", "b1"},
+		{"b1-hello-linux-arm64", "hello", "b1"},
+		{"b1-hello-test-linux-amd64", "hello-test", "b1"},
+		{"hello", "hello", ""},
+		{"hello-test", "hello-test", ""},
+		{"hello-linux-arm64", "hello", ""},
+		{"b1-hello", "world", ""},
+		{"b1-hello", "", ""},
+		{"z-" + strings.Repeat("ab", 32), "hello", ""},
+	} {
+		if got := gcTagBuildID(test.tag, test.spec); got != test.want {
+			t.Errorf("gcTagBuildID(%q, %q) = %q, want %q", test.tag, test.spec, got, test.want)
+		}
+	}
+}
+
+func TestGC_attachedTags(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	repo := fmt.Sprintf("%s/work", server.Listener.Addr().String())
+
+	now := time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC)
+	oldDigest := pushGCImage(t, repo, "z-old", now.Add(-10*24*time.Hour))
+	newDigest := pushGCImage(t, repo, "z-new", now.Add(-24*time.Hour))
+
+	signing := &cacheSigning{}
+	key, _ := writeTestKeys(t, t.TempDir(), "cosign")
+	var err error
+	if signing.signer, err = readSigningKey(key); err != nil {
+		t.Fatalf("read key: %v", err)
+	}
+	for _, tag := range []string{"z-old", "z-new"} {
+		ref := mustNewTag(t, repo+":"+tag)
+		desc, err := remote.Head(ref)
+		if err != nil {
+			t.Fatalf("get %s: %v", tag, err)
+		}
+		if err := signing.sign(ref, desc.Digest); err != nil {
+			t.Fatalf("sign %s: %v", tag, err)
+		}
+	}
+
+	// Referrers tag schema tags, including one whose subject is gone.
+	goneHex := strings.Repeat("cd", 32)
+	oldReferrers := "sha256-" + oldDigest.Hex
+	newReferrers := "sha256-" + newDigest.Hex
+	pushGCImage(t, repo, oldReferrers, time.Unix(0, 0))
+	pushGCImage(t, repo, newReferrers, time.Unix(0, 0))
+	pushGCImage(t, repo, "sha256-"+goneHex+".sig", time.Unix(0, 0))
+
+	forge, err := NewForge(&ForgeConfig{WorkDir: "testdata", WorkRepo: repo})
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+	report, err := forge.gc(t.Context(), &GCConfig{MaxAgeDays: 7}, now)
+	if err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	oldSigner, err := signerTag(mustNewTag(t, repo+":z-old"), oldDigest, &signing.signer.PublicKey)
+	if err != nil {
+		t.Fatalf("signer tag: %v", err)
+	}
+	wantTags := []string{
+		oldReferrers,
+		oldSigner.TagStr(),
+		"sha256-" + oldDigest.Hex + ".sig",
+		"sha256-" + goneHex + ".sig",
+		"z-old",
+	}
+	if !reflect.DeepEqual(report.Tags, wantTags) {
+		t.Errorf("gc() tags = %q, want %q", report.Tags, wantTags)
+	}
+
+	// The test registry keeps tags of deleted manifests, so check the
+	// digests that the tags point to.
+	for _, test := range []struct {
+		tag     string
+		deleted bool
+	}{
+		{"z-new", false},
+		{newReferrers, false},
+		{"sha256-" + newDigest.Hex + ".sig", false},
+		{"z-old", true},
+		{oldReferrers, true},
+		{"sha256-" + oldDigest.Hex + ".sig", true},
+		{oldSigner.TagStr(), true},
+	} {
+		desc, err := remote.Head(mustNewTag(t, repo+":"+test.tag))
+		if err != nil {
+			t.Fatalf("get %s: %v", test.tag, err)
+		}
+		_, err = remote.Head(mustNewDigest(t, repo, desc.Digest))
+		if got := err != nil; got != test.deleted {
+			t.Errorf("%s deleted = %v, want %v", test.tag, got, test.deleted)
+		}
+	}
+}
+
+func TestGC_epochPolicies(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	repo := fmt.Sprintf("%s/work", server.Listener.Addr().String())
+
+	// Wednesday 2025-01-15 12:00 in SFO, in default epoch "202503a".
+	now := time.Date(2025, 1, 15, 12, 0, 0, 0, sfoAround)
+	twoDaysAgo := now.Add(-2 * 24 * time.Hour)
+	pushGCImage(t, repo, "z-default", twoDaysAgo)
+	pushGCImageWithLabels(t, repo, "z-daily", twoDaysAgo, map[string]string{labelEpochPolicy: epochDaily})
+	pushGCImageWithLabels(t, repo, "z-monthly", now.AddDate(0, 0, -10), map[string]string{labelEpochPolicy: epochMonthly})
+	pushGCImageWithLabels(t, repo, "z-never", now.AddDate(-1, 0, 0), map[string]string{labelEpochPolicy: epochNever})
+
+	forge, err := NewForge(&ForgeConfig{WorkDir: "testdata", WorkRepo: repo})
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+	report, err := forge.gc(t.Context(), &GCConfig{MaxEpochs: 1, DryRun: true}, now)
+	if err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if want := []string{"z-daily"}; !reflect.DeepEqual(report.Tags, want) {
+		t.Errorf("gc() tags = %q, want %q", report.Tags, want)
+	}
+}
@@ -0,0 +1,180 @@
+package wanda
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// graphNode is a spec in the printed dependency graph.
+type graphNode struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Layer int    `json:"layer"`
+
+	// Deps are the names of the wanda-built images this spec builds from.
+	Deps []string `json:"deps,omitempty"`
+
+	// Externals are the base images that are not built by wanda.
+	Externals []string `json:"externals,omitempty"`
+}
+
+// graphView is the printable form of a depGraph.
+type graphView struct {
+	Root  string       `json:"root"`
+	Nodes []*graphNode `json:"nodes"`
+}
+
+// newGraphView collects the specs reachable from the root of g, in build
+// order. Paths are shown relative to baseDir when they are inside it.
+func newGraphView(g *depGraph, baseDir string) *graphView {
+	layerOf := make(map[string]int)
+	for i, layer := range g.Layers {
+		for _, name := range layer {
+			layerOf[name] = i
+		}
+	}
+
+	v := &graphView{Root: g.Root}
+	for _, name := range g.Order {
+		rs := g.Specs[name]
+		node := &graphNode{
+			Name:  name,
+			Path:  displayPath(rs.Path, baseDir),
+			Layer: layerOf[name],
+		}
+		for _, from := range rs.Spec.Froms {
+			if dep := localDepName(from, g.namePrefix); dep != "" {
+				if _, ok := layerOf[dep]; ok {
+					node.Deps = append(node.Deps, dep)
+					continue
+				}
+			}
+			if isDockerScratch(from) {
+				continue
+			}
+			node.Externals = append(node.Externals, from)
+		}
+		v.Nodes = append(v.Nodes, node)
+	}
+	return v
+}
+
+func displayPath(p, baseDir string) string {
+	if baseDir == "" {
+		return p
+	}
+	rel, err := filepath.Rel(baseDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return p
+	}
+	return filepath.ToSlash(rel)
+}
+
+// externals returns all external base images in the graph, sorted.
+func (v *graphView) externals() []string {
+	set := make(map[string]struct{})
+	for _, n := range v.Nodes {
+		for _, e := range n.Externals {
+			set[e] = struct{}{}
+		}
+	}
+	var list []string
+	for e := range set {
+		list = append(list, e)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (v *graphView) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (v *graphView) writeDOT(w io.Writer) error {
+	b := new(strings.Builder)
+	b.WriteString("digraph wanda {\n")
+	for _, n := range v.Nodes {
+		label := fmt.Sprintf("%s\nlayer %d\n%s", n.Name, n.Layer, n.Path)
+		attrs := ""
+		if n.Name == v.Root {
+			attrs = ", penwidth=2"
+		}
+		fmt.Fprintf(b, "  %q [label=%q%s];\n", n.Name, label, attrs)
+	}
+	for _, e := range v.externals() {
+		fmt.Fprintf(b, "  %q [shape=box, style=dashed];\n", e)
+	}
+	for _, n := range v.Nodes {
+		for _, dep := range n.Deps {
+			fmt.Fprintf(b, "  %q -> %q;\n", n.Name, dep)
+		}
+		for _, e := range n.Externals {
+			fmt.Fprintf(b, "  %q -> %q [style=dashed];\n", n.Name, e)
+		}
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaidLabel escapes s for use in a quoted mermaid node label.
+func mermaidLabel(s string) string {
+	return strings.ReplaceAll(s, `"`, "#quot;")
+}
+
+func (v *graphView) writeMermaid(w io.Writer) error {
+	ids := make(map[string]string)
+
+	b := new(strings.Builder)
+	b.WriteString("graph TD\n")
+	for i, n := range v.Nodes {
+		id := fmt.Sprintf("n%d", i)
+		ids[n.Name] = id
+		label := fmt.Sprintf("%s<br/>layer %d<br/>%s", n.Name, n.Layer, n.Path)
+		fmt.Fprintf(b, "  %s[\"%s\"]\n", id, mermaidLabel(label))
+	}
+	for i, e := range v.externals() {
+		id := fmt.Sprintf("e%d", i)
+		ids[e] = id
+		fmt.Fprintf(b, "  %s([\"%s\"])\n", id, mermaidLabel(e))
+	}
+	for _, n := range v.Nodes {
+		for _, dep := range n.Deps {
+			fmt.Fprintf(b, "  %s --> %s\n", ids[n.Name], ids[dep])
+		}
+		for _, e := range n.Externals {
+			fmt.Fprintf(b, "  %s -.-> %s\n", ids[n.Name], ids[e])
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Graph writes the dependency graph reachable from the given spec file to w.
+// format is one of "dot", "mermaid" or "json".
+func Graph(specFile string, config *ForgeConfig, format string, w io.Writer) error {
+	s, err := newBuildSession(specFile, config)
+	if err != nil {
+		return err
+	}
+
+	v := newGraphView(s.graph, s.forge.workDir)
+	switch format {
+	case "dot", "":
+		return v.writeDOT(w)
+	case "mermaid":
+		return v.writeMermaid(w)
+	case "json":
+		return v.writeJSON(w)
+	default:
+		return fmt.Errorf("unknown graph format %q", format)
+	}
+}
@@ -0,0 +1,134 @@
+package wanda
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeGraphSpecs(t *testing.T) (dir, specsFile string) {
+	t.Helper()
+	dir = t.TempDir()
+	specsFile = writeWandaSpecs(t, dir, []string{"."})
+
+	writeSpec(t, dir, "base.wanda.yaml", strings.Join([]string{
+		"name: base",
+		`froms: ["ubuntu:22.04"]`,
+		"dockerfile: Dockerfile",
+	}, "\n"))
+	writeSpec(t, dir, "py.wanda.yaml", strings.Join([]string{
+		"name: py",
+		`froms: ["cr.ray.io/rayproject/base"]`,
+		"dockerfile: Dockerfile",
+	}, "\n"))
+	writeSpec(t, dir, "cu.wanda.yaml", strings.Join([]string{
+		"name: cu",
+		`froms: ["cr.ray.io/rayproject/base", "nvidia/cuda:12.1"]`,
+		"dockerfile: Dockerfile",
+	}, "\n"))
+	writeSpec(t, dir, "top.wanda.yaml", strings.Join([]string{
+		"name: top",
+		`froms: ["cr.ray.io/rayproject/py", "cr.ray.io/rayproject/cu", "scratch"]`,
+		"dockerfile: Dockerfile",
+	}, "\n"))
+	return dir, specsFile
+}
+
+func TestNewGraphView(t *testing.T) {
+	dir, specsFile := writeGraphSpecs(t)
+
+	g, err := buildDepGraph(filepath.Join(dir, "top.wanda.yaml"), noopLookup, testPrefix, specsFile)
+	if err != nil {
+		t.Fatalf("buildDepGraph: %v", err)
+	}
+
+	v := newGraphView(g, dir)
+	want := &graphView{
+		Root: "top",
+		Nodes: []*graphNode{
+			{Name: "base", Path: "base.wanda.yaml", Layer: 0, Externals: []string{"ubuntu:22.04"}},
+			{Name: "cu", Path: "cu.wanda.yaml", Layer: 1, Deps: []string{"base"}, Externals: []string{"nvidia/cuda:12.1"}},
+			{Name: "py", Path: "py.wanda.yaml", Layer: 1, Deps: []string{"base"}},
+			{Name: "top", Path: "top.wanda.yaml", Layer: 2, Deps: []string{"py", "cu"}},
+		},
+	}
+	if !reflect.DeepEqual(v, want) {
+		got, _ := json.Marshal(v)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("got %s, want %s", got, wantJSON)
+	}
+
+	if got, want := v.externals(), []string{"nvidia/cuda:12.1", "ubuntu:22.04"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("externals() = %v, want %v", got, want)
+	}
+}
+
+func TestGraph_formats(t *testing.T) {
+	dir, specsFile := writeGraphSpecs(t)
+	config := &ForgeConfig{
+		WorkDir:        dir,
+		NamePrefix:     testPrefix,
+		WandaSpecsFile: specsFile,
+	}
+	specPath := filepath.Join(dir, "top.wanda.yaml")
+
+	t.Run("json", func(t *testing.T) {
+		var buf strings.Builder
+		if err := Graph(specPath, config, "json", &buf); err != nil {
+			t.Fatalf("Graph: %v", err)
+		}
+		v := new(graphView)
+		if err := json.Unmarshal([]byte(buf.String()), v); err != nil {
+			t.Fatalf("unmarshal %q: %v", buf.String(), err)
+		}
+		if v.Root != "top" || len(v.Nodes) != 4 {
+			t.Errorf("got root %q with %d nodes, want top with 4", v.Root, len(v.Nodes))
+		}
+	})
+
+	t.Run("dot", func(t *testing.T) {
+		var buf strings.Builder
+		if err := Graph(specPath, config, "dot", &buf); err != nil {
+			t.Fatalf("Graph: %v", err)
+		}
+		got := buf.String()
+		for _, want := range []string{
+			"digraph wanda {",
+			`"top" -> "py";`,
+			`"cu" -> "base";`,
+			`"cu" -> "nvidia/cuda:12.1" [style=dashed];`,
+			`"base" [label="base\nlayer 0\nbase.wanda.yaml"];`,
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("dot output missing %q:\n%s", want, got)
+			}
+		}
+	})
+
+	t.Run("mermaid", func(t *testing.T) {
+		var buf strings.Builder
+		if err := Graph(specPath, config, "mermaid", &buf); err != nil {
+			t.Fatalf("Graph: %v", err)
+		}
+		got := buf.String()
+		for _, want := range []string{
+			"graph TD\n",
+			`n0["base<br/>layer 0<br/>base.wanda.yaml"]`,
+			`e1(["ubuntu:22.04"])`,
+			"n3 --> n2",
+			"n0 -.-> e1",
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("mermaid output missing %q:\n%s", want, got)
+			}
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if err := Graph(specPath, config, "svg", new(strings.Builder)); err == nil {
+			t.Error("Graph with unknown format: got nil error")
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package wanda
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// hashCacheVersion is the version of the file format of the hash cache. A
+// cache file of another version is discarded.
+const hashCacheVersion = 1
+
+// hashCacheRacyWindow is how recently a file can have been modified for
+// its hash to not be cached. A file can still change within the mtime
+// granularity of the file system after it is hashed, without changing its
+// stat.
+const hashCacheRacyWindow = 2 * time.Second
+
+// hashCacheMaxAge is how long an entry of the hash cache is kept after the
+// last run that used it, so that the cache does not grow without bound
+// with files that were deleted or are not built anymore.
+const hashCacheMaxAge = 14 * 24 * time.Hour
+
+// hashCacheUseGranularity is how often the last use of an entry is updated,
+// so that a run that only has cache hits does not rewrite the cache file.
+const hashCacheUseGranularity = 24 * time.Hour
+
+// fileHashKey is the stat of a file that its cached hash is valid for.
+type fileHashKey struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // In nanoseconds since the Unix epoch.
+	Inode   uint64 `json:"inode,omitempty"`
+	Mode    uint32 `json:"mode"`
+}
+
+func newFileHashKey(stat os.FileInfo) fileHashKey {
+	return fileHashKey{
+		Size:    stat.Size(),
+		ModTime: stat.ModTime().UnixNano(),
+		Inode:   fileInode(stat),
+		Mode:    uint32(stat.Mode()),
+	}
+}
+
+type fileHashEntry struct {
+	fileHashKey
+	Digest string `json:"digest"`
+	Used   int64  `json:"used"` // Last use, in seconds since the Unix epoch.
+}
+
+type hashCacheFile struct {
+	Version int                       `json:"version"`
+	Files   map[string]*fileHashEntry `json:"files"`
+}
+
+// fileHashCache is an on-disk cache of the content digests of build context
+// files, keyed by their path. A cached digest is only used while the size,
+// mtime, inode and mode of the file stay the same, so an unchanged file is
+// not read again.
+type fileHashCache struct {
+	file string
+	now  time.Time // Time of the run, which entries are marked as used at.
+
+	mu    sync.Mutex
+	files map[string]*fileHashEntry
+	dirty bool
+}
+
+// loadFileHashCache loads the hash cache from file. A missing or unreadable
+// cache file gives an empty cache; it is written out on the next save.
+// Entries that no run has used for hashCacheMaxAge are dropped.
+func loadFileHashCache(file string) (*fileHashCache, error) {
+	c := &fileHashCache{
+		file:  file,
+		now:   time.Now(),
+		files: make(map[string]*fileHashEntry),
+	}
+
+	bs, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read hash cache: %w", err)
+	}
+
+	cf := new(hashCacheFile)
+	if err := json.Unmarshal(bs, cf); err != nil || cf.Version != hashCacheVersion {
+		return c, nil // Rebuilt from scratch.
+	}
+	if cf.Files != nil {
+		c.files = cf.Files
+	}
+	c.prune(c.now.Add(-hashCacheMaxAge))
+	return c, nil
+}
+
+// prune drops the entries that were last used before the given time.
+func (c *fileHashCache) prune(before time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path, e := range c.files {
+		if e.Used < before.Unix() {
+			delete(c.files, path)
+			c.dirty = true
+		}
+	}
+}
+
+// digest returns the content digest of the regular file at path, which
+// has the given stat. The digest is cached when c is not nil.
+func (c *fileHashCache) digest(path string, stat os.FileInfo) (string, error) {
+	if c == nil {
+		return hashFile(path)
+	}
+
+	key := newFileHashKey(stat)
+	used := c.now.Unix()
+	c.mu.Lock()
+	e, ok := c.files[path]
+	if ok && e.fileHashKey == key {
+		if time.Duration(used-e.Used)*time.Second >= hashCacheUseGranularity {
+			e.Used = used
+			c.dirty = true
+		}
+		c.mu.Unlock()
+		return e.Digest, nil
+	}
+	c.mu.Unlock()
+
+	digest, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	if time.Since(stat.ModTime()) < hashCacheRacyWindow {
+		return digest, nil
+	}
+
+	c.mu.Lock()
+	c.files[path] = &fileHashEntry{fileHashKey: key, Digest: digest, Used: used}
+	c.dirty = true
+	c.mu.Unlock()
+	return digest, nil
+}
+
+// save writes the cache to its file if it has new entries. The file is
+// replaced atomically, so that concurrent runs do not corrupt it.
+func (c *fileHashCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+
+	bs, err := json.Marshal(&hashCacheFile{Version: hashCacheVersion, Files: c.files})
+	if err != nil {
+		return fmt.Errorf("marshal hash cache: %w", err)
+	}
+
+	dir := filepath.Dir(c.file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create hash cache dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(c.file)+".*")
+	if err != nil {
+		return fmt.Errorf("create hash cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write hash cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write hash cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.file); err != nil {
+		return fmt.Errorf("replace hash cache: %w", err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// hashFile returns the sha256 digest of the content of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("open file %q: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("read file %q: %w", path, err)
+	}
+	return sha256DigestString(h), nil
+}
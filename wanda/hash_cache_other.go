@@ -0,0 +1,9 @@
+//go:build !unix
+
+package wanda
+
+import "os"
+
+// fileInode returns 0, as there are no inode numbers in the stat of files
+// on this OS. Cached hashes are then keyed by size, mtime and mode only.
+func fileInode(os.FileInfo) uint64 { return 0 }
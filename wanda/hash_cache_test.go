@@ -0,0 +1,204 @@
+package wanda
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFileHashCache(t *testing.T) {
+	tmp := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+
+	files := map[string]string{
+		"a.txt":      "hello\n",
+		"b/b.txt":    "world\n",
+		"b/c/run.sh": "#!/bin/sh\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(tmp, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(filepath.Join(tmp, "b/c/run.sh"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("a.txt", filepath.Join(tmp, "link")); err != nil {
+			t.Fatal(err)
+		}
+		files["link"] = ""
+	}
+
+	cacheFile := filepath.Join(tmp, "cache", "hashes.json")
+	digest := func(cached bool) string {
+		t.Helper()
+		ts := newTarStream()
+		for name := range files {
+			ts.addFile(name, nil, filepath.Join(tmp, filepath.FromSlash(name)))
+		}
+		if cached {
+			c, err := loadFileHashCache(cacheFile)
+			if err != nil {
+				t.Fatalf("load hash cache: %v", err)
+			}
+			ts.hashes = c
+		}
+		d, err := ts.digest()
+		if err != nil {
+			t.Fatalf("digest: %v", err)
+		}
+		return d
+	}
+
+	want := digest(false)
+	if got := digest(true); got != want {
+		t.Errorf("digest with an empty cache = %s, want %s", got, want)
+	}
+
+	c, err := loadFileHashCache(cacheFile)
+	if err != nil {
+		t.Fatalf("load hash cache: %v", err)
+	}
+	if len(c.files) != 3 {
+		t.Errorf("cache has %d files, want the 3 regular files", len(c.files))
+	}
+	if got := digest(true); got != want {
+		t.Errorf("digest with a full cache = %s, want %s", got, want)
+	}
+
+	// Content that changes without changing the stat is not read again.
+	a := filepath.Join(tmp, "a.txt")
+	if err := os.WriteFile(a, []byte("HELLO\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(a, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if got := digest(true); got != want {
+		t.Errorf("digest with the stat unchanged = %s, want cached %s", got, want)
+	}
+
+	// A new mtime invalidates the cached hash.
+	newer := old.Add(time.Minute)
+	if err := os.Chtimes(a, newer, newer); err != nil {
+		t.Fatal(err)
+	}
+	want = digest(false)
+	if got := digest(true); got != want {
+		t.Errorf("digest after touch = %s, want %s", got, want)
+	}
+}
+
+func TestFileHashCache_racy(t *testing.T) {
+	tmp := t.TempDir()
+	f := filepath.Join(tmp, "new.txt")
+	if err := os.WriteFile(f, []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadFileHashCache(filepath.Join(tmp, "hashes.json"))
+	if err != nil {
+		t.Fatalf("load hash cache: %v", err)
+	}
+	got, err := c.digest(f, stat)
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	if want := sha256Digest([]byte("new\n")); got != want {
+		t.Errorf("digest = %s, want %s", got, want)
+	}
+	if len(c.files) != 0 {
+		t.Errorf("just modified file is cached: %v", c.files)
+	}
+}
+
+func TestLoadFileHashCache_corrupt(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hashes.json")
+	if err := os.WriteFile(file, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadFileHashCache(file)
+	if err != nil {
+		t.Fatalf("load hash cache: %v", err)
+	}
+	if len(c.files) != 0 {
+		t.Errorf("corrupt cache has %d files, want 0", len(c.files))
+	}
+}
+
+func TestFileHashCache_prune(t *testing.T) {
+	tmp := t.TempDir()
+	f := filepath.Join(tmp, "a.txt")
+	if err := os.WriteFile(f, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(f, old, old); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacheFile := filepath.Join(tmp, "hashes.json")
+	c, err := loadFileHashCache(cacheFile)
+	if err != nil {
+		t.Fatalf("load hash cache: %v", err)
+	}
+	if _, err := c.digest(f, stat); err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	stale := time.Now().Add(-hashCacheMaxAge - time.Hour).Unix()
+	c.files["/gone.txt"] = &fileHashEntry{Digest: "sha256:gone", Used: stale}
+	c.files["/stale.txt"] = &fileHashEntry{Digest: "sha256:stale", Used: stale}
+	if err := c.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	c, err = loadFileHashCache(cacheFile)
+	if err != nil {
+		t.Fatalf("load hash cache: %v", err)
+	}
+	if _, ok := c.files["/gone.txt"]; ok {
+		t.Errorf("stale entry is not pruned")
+	}
+	if _, ok := c.files[f]; !ok {
+		t.Fatalf("entry used in this run is pruned")
+	}
+
+	// A hit marks an old entry as used in this run.
+	c.files[f].Used = stale + 1
+	c.now = time.Now()
+	if _, err := c.digest(f, stat); err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	if got := c.files[f].Used; got != c.now.Unix() {
+		t.Errorf("used = %d after a hit, want %d", got, c.now.Unix())
+	}
+	if err := c.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	c, err = loadFileHashCache(cacheFile)
+	if err != nil {
+		t.Fatalf("load hash cache: %v", err)
+	}
+	if len(c.files) != 1 || c.files[f] == nil {
+		t.Errorf("cache files = %v, want only %s", c.files, f)
+	}
+}
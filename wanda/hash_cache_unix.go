@@ -0,0 +1,16 @@
+//go:build unix
+
+package wanda
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of the file of stat.
+func fileInode(stat os.FileInfo) uint64 {
+	if st, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
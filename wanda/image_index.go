@@ -0,0 +1,103 @@
+package wanda
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
+	crane "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Index assembles the images built for each platform of a multi-platform
+// spec file into a single OCI image index. The index is pushed under the
+// work tag of the spec and all of the spec's tags.
+//
+// The per-platform images must already be built and pushed to the work
+// repo, usually by running Build for each platform.
+func Index(ctx context.Context, specFile string, config *ForgeConfig) error {
+	s, err := newBuildSession(specFile, config)
+	if err != nil {
+		return err
+	}
+
+	spec := s.graph.Specs[s.graph.Root].Spec
+	if _, err := s.forge.assembleIndex(ctx, spec); err != nil {
+		return fmt.Errorf("assemble index for %s: %w", spec.Name, err)
+	}
+	return nil
+}
+
+// assembleIndex pushes an image index that references the work image of
+// every platform of spec. It returns the digest of the index.
+func (f *Forge) assembleIndex(ctx context.Context, spec *Spec) (crane.Hash, error) {
+	if len(spec.Platforms) == 0 {
+		return crane.Hash{}, fmt.Errorf("spec has no platforms")
+	}
+	if !f.isRemote() {
+		return crane.Hash{}, fmt.Errorf("image index requires a work repo")
+	}
+
+	platforms, err := parsePlatforms(spec.Platforms)
+	if err != nil {
+		return crane.Hash{}, err
+	}
+
+	var index crane.ImageIndex = mutate.IndexMediaType(
+		empty.Index, types.OCIImageIndex,
+	)
+	for _, p := range platforms {
+		tag := f.workTag(p.imageName(spec.Name))
+		ref, err := cranename.NewTag(tag)
+		if err != nil {
+			return crane.Hash{}, fmt.Errorf("parse work tag %q: %w", tag, err)
+		}
+		img, err := remote.Image(ref, f.remoteOptsFor(ctx, p)...)
+		if err != nil {
+			return crane.Hash{}, fmt.Errorf("fetch %s image %s: %w", p, tag, err)
+		}
+
+		cranePlatform := p.cranePlatform()
+		if config, err := img.ConfigFile(); err == nil {
+			if config.OS != p.OS || config.Architecture != p.Arch {
+				log.Printf(
+					"warning: image %s is for %s/%s, want %s",
+					tag, config.OS, config.Architecture, p,
+				)
+			}
+			cranePlatform.Variant = config.Variant
+		}
+
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: crane.Descriptor{
+				Platform: &cranePlatform,
+			},
+		})
+	}
+
+	index = mutate.Annotations(index, f.indexAnnotations(ctx, spec)).(crane.ImageIndex)
+
+	indexDigest, err := index.Digest()
+	if err != nil {
+		return crane.Hash{}, fmt.Errorf("compute index digest: %w", err)
+	}
+
+	tags := append([]string{f.workTag(spec.Name)}, spec.Tags...)
+	for _, tag := range tags {
+		ref, err := cranename.NewTag(tag)
+		if err != nil {
+			return crane.Hash{}, fmt.Errorf("parse tag %q: %w", tag, err)
+		}
+		log.Printf("push image index %s as %s", indexDigest, tag)
+		if err := remote.WriteIndex(ref, index, f.remoteOptsFor(ctx, nil)...); err != nil {
+			return crane.Hash{}, fmt.Errorf("push index to %s: %w", tag, err)
+		}
+	}
+
+	return indexDigest, nil
+}
@@ -0,0 +1,166 @@
+package wanda
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func pushPlatformImage(t *testing.T, tag string, p *platform) cranev1.Hash {
+	t.Helper()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	config.OS = p.OS
+	config.Architecture = p.Arch
+	img, err = mutate.ConfigFile(img, config)
+	if err != nil {
+		t.Fatalf("set config: %v", err)
+	}
+
+	ref, err := name.NewTag(tag)
+	if err != nil {
+		t.Fatalf("parse tag %q: %v", tag, err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("push image %q: %v", tag, err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("image digest: %v", err)
+	}
+	return digest
+}
+
+func TestAssembleIndex(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	config := &ForgeConfig{
+		WorkDir:   "testdata",
+		WorkRepo:  fmt.Sprintf("%s/work", addr),
+		BuildID:   "abc123",
+		GitCommit: "0123abcd",
+	}
+	forge, err := NewForge(config)
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+
+	userTag := fmt.Sprintf("%s/user/multi:latest", addr)
+	spec := &Spec{
+		Name:      "multi",
+		Platforms: []string{"linux/amd64", "linux/arm64"},
+		Tags:      []string{userTag},
+	}
+
+	want := make(map[string]cranev1.Hash)
+	for _, s := range spec.Platforms {
+		p, err := parsePlatform(s)
+		if err != nil {
+			t.Fatalf("parse platform: %v", err)
+		}
+		tag := config.workTag(p.imageName(spec.Name))
+		want[s] = pushPlatformImage(t, tag, p)
+	}
+
+	indexDigest, err := forge.assembleIndex(t.Context(), spec)
+	if err != nil {
+		t.Fatalf("assemble index: %v", err)
+	}
+
+	for _, tag := range []string{config.workTag("multi"), userTag} {
+		ref, err := name.NewTag(tag)
+		if err != nil {
+			t.Fatalf("parse tag %q: %v", tag, err)
+		}
+		index, err := remote.Index(ref)
+		if err != nil {
+			t.Fatalf("read index %q: %v", tag, err)
+		}
+
+		digest, err := index.Digest()
+		if err != nil {
+			t.Fatalf("index digest: %v", err)
+		}
+		if digest != indexDigest {
+			t.Errorf("%q has digest %s, want %s", tag, digest, indexDigest)
+		}
+
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			t.Fatalf("read index manifest: %v", err)
+		}
+		if manifest.Annotations[labelSpec] != "multi" ||
+			manifest.Annotations[labelRevision] != "0123abcd" {
+			t.Errorf("%q has annotations %v", tag, manifest.Annotations)
+		}
+
+		got := make(map[string]cranev1.Hash)
+		for _, m := range manifest.Manifests {
+			if m.Platform == nil {
+				t.Fatalf("manifest %s has no platform", m.Digest)
+			}
+			got[m.Platform.OS+"/"+m.Platform.Architecture] = m.Digest
+		}
+		if len(got) != len(want) {
+			t.Errorf("%q has manifests %v, want %v", tag, got, want)
+		}
+		for p, d := range want {
+			if got[p] != d {
+				t.Errorf("%q %s manifest = %s, want %s", tag, p, got[p], d)
+			}
+		}
+	}
+}
+
+func TestAssembleIndex_missingPlatformImage(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	config := &ForgeConfig{
+		WorkDir:  "testdata",
+		WorkRepo: fmt.Sprintf("%s/work", addr),
+	}
+	forge, err := NewForge(config)
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+
+	spec := &Spec{
+		Name:      "multi",
+		Platforms: []string{"linux/amd64", "linux/arm64"},
+	}
+	amd64 := &platform{OS: "linux", Arch: "amd64"}
+	pushPlatformImage(t, config.workTag(amd64.imageName(spec.Name)), amd64)
+
+	if _, err := forge.assembleIndex(t.Context(), spec); err == nil {
+		t.Error("assemble index with missing arm64 image: got nil error")
+	}
+}
+
+func TestAssembleIndex_localMode(t *testing.T) {
+	forge, err := NewForge(&ForgeConfig{WorkDir: "testdata"})
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+	spec := &Spec{Name: "multi", Platforms: []string{"linux/amd64"}}
+	if _, err := forge.assembleIndex(t.Context(), spec); err == nil {
+		t.Error("assemble index in local mode: got nil error")
+	}
+}
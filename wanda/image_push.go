@@ -0,0 +1,44 @@
+package wanda
+
+import (
+	"context"
+	"fmt"
+)
+
+// pushImage pushes a newly built image to the work repo with workTag and,
+// unless caching is disabled or the cache is read-only, with cacheTag. The
+// cache image is signed and, if enabled, the provenance of the build is
+// pushed along with it.
+func (f *Forge) pushImage(
+	ctx context.Context, d containerEngine, b *provenanceBuild,
+	workTag, cacheTag string, out *buildOutput,
+) error {
+	if err := f.pushTag(ctx, d, workTag, out); err != nil {
+		return fmt.Errorf("push docker: %w", err)
+	}
+
+	// Save cache result too.
+	if !b.spec.DisableCaching && !f.config.ReadOnlyCache {
+		if err := f.pushTag(ctx, d, cacheTag, out); err != nil {
+			return fmt.Errorf("push cache: %w", err)
+		}
+		if err := f.signCacheImage(ctx, cacheTag, out); err != nil {
+			return fmt.Errorf("sign cache image: %w", err)
+		}
+	}
+
+	if f.config.Provenance {
+		if err := f.pushProvenance(ctx, workTag, b, out); err != nil {
+			return fmt.Errorf("push provenance: %w", err)
+		}
+	}
+	return nil
+}
+
+// pushTag pushes tag to the registry with the container engine, retrying
+// transient failures.
+func (f *Forge) pushTag(ctx context.Context, d containerEngine, tag string, out *buildOutput) error {
+	return f.retry.do(ctx, "push "+tag, out.log, func() error {
+		return d.push(ctx, tag)
+	})
+}
@@ -0,0 +1,315 @@
+package wanda
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// lintProblem is a problem found in a spec file.
+type lintProblem struct {
+	Path    string
+	Message string
+}
+
+// linter checks the spec files in the spec directories. Unlike discovery,
+// which skips spec files that it cannot use, it reports every problem that
+// would make a spec fail to build or not be found as a dependency.
+type linter struct {
+	baseDir    string // Paths in messages are shown relative to it.
+	workDir    string
+	namePrefix string
+	lookup     lookupFunc
+
+	problems []*lintProblem
+	seen     map[lintProblem]bool
+
+	// specs maps the names of the specs to the files that define them.
+	specs map[string][]string
+	// deps maps the names of the specs to the wanda-built images they are
+	// built from.
+	deps map[string][]string
+}
+
+func newLinter(baseDir, workDir, namePrefix string, lookup lookupFunc) *linter {
+	return &linter{
+		baseDir:    baseDir,
+		workDir:    workDir,
+		namePrefix: namePrefix,
+		lookup:     lookup,
+		seen:       make(map[lintProblem]bool),
+		specs:      make(map[string][]string),
+		deps:       make(map[string][]string),
+	}
+}
+
+// addf adds a problem of the spec file at path. The same problem is only
+// added once, even if it is found in every matrix combination of a spec.
+func (l *linter) addf(path, format string, args ...any) {
+	p := lintProblem{Path: path, Message: fmt.Sprintf(format, args...)}
+	if l.seen[p] {
+		return
+	}
+	l.seen[p] = true
+	l.problems = append(l.problems, &p)
+}
+
+// lintDir checks all the spec files under dir.
+func (l *linter) lintDir(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		l.addf(dir, "spec directory: %v", err)
+		return nil
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			l.addf(path, "%v", err)
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".wanda.yaml") {
+			return nil
+		}
+		l.lintFile(path)
+		return nil
+	})
+}
+
+// lintFile checks the spec file at path, in every matrix combination.
+func (l *linter) lintFile(path string) {
+	spec, err := parseSpecFile(path)
+	if err != nil {
+		l.addf(path, "%v", err)
+		return
+	}
+	specs, err := spec.expandMatrix(l.lookup)
+	if err != nil {
+		l.addf(path, "%v", err)
+		return
+	}
+	for _, s := range specs {
+		l.lintSpec(path, s)
+	}
+}
+
+// lintSpec checks a spec expanded from the spec file at path.
+func (l *linter) lintSpec(path string, spec *Spec) {
+	var unset []string
+	for _, s := range spec.varFields() {
+		unset = append(unset, findUnexpandedVars(s)...)
+	}
+	if len(unset) > 0 {
+		sort.Strings(unset)
+		l.addf(path, "variables not set: %s", strings.Join(slices.Compact(unset), ", "))
+	}
+
+	if spec.Name == "" {
+		l.addf(path, "name is not set")
+	} else if !strings.Contains(spec.Name, "$") {
+		if !slices.Contains(l.specs[spec.Name], path) {
+			l.specs[spec.Name] = append(l.specs[spec.Name], path)
+		}
+		l.deps[spec.Name] = localDeps(spec, l.namePrefix)
+	}
+
+	if spec.Dockerfile == "" {
+		l.addf(path, "dockerfile is not set")
+	} else if !strings.Contains(spec.Dockerfile, "$") {
+		l.checkFile(path, "dockerfile", spec.Dockerfile)
+	}
+
+	for _, src := range spec.Srcs {
+		if strings.HasPrefix(src, "!") || strings.Contains(src, "$") {
+			continue
+		}
+		l.checkSrc(path, src)
+	}
+
+	for i, a := range spec.Artifacts {
+		if err := a.Validate(); err != nil {
+			l.addf(path, "artifact %d: %v", i, err)
+		}
+	}
+
+	if spec.ContextOwner != "" && !strings.Contains(spec.ContextOwner, "$") {
+		if _, err := parseContextOwner(spec.ContextOwner); err != nil {
+			l.addf(path, "%v", err)
+		}
+	}
+
+	if _, err := parsePlatforms(spec.Platforms); err != nil {
+		l.addf(path, "platforms: %v", err)
+	}
+
+	for id, s := range spec.Secrets {
+		if err := s.Validate(id); err != nil {
+			l.addf(path, "%v", err)
+		}
+	}
+}
+
+// checkFile checks that the file at src, relative to the work dir, exists.
+func (l *linter) checkFile(path, what, src string) {
+	if _, err := os.Stat(filepath.Join(l.workDir, filepath.FromSlash(src))); err != nil {
+		if os.IsNotExist(err) {
+			l.addf(path, "%s %s does not exist", what, src)
+		} else {
+			l.addf(path, "%s %s: %v", what, src, err)
+		}
+	}
+}
+
+// checkSrc checks that src selects files in the work dir.
+func (l *linter) checkSrc(path, src string) {
+	files, err := listSrcFilesSingle(l.workDir, src)
+	if err != nil {
+		l.addf(path, "src %s: %v", src, err)
+		return
+	}
+	if len(files) == 0 {
+		l.addf(path, "src %s matches no files", src)
+		return
+	}
+	if !isFilePathGlob(src) && !strings.HasSuffix(src, "/") {
+		l.checkFile(path, "src", files[0])
+	}
+}
+
+// checkNames reports the spec names that are defined by more than one spec
+// file, and the dependency cycles between the specs.
+func (l *linter) checkNames() {
+	names := make([]string, 0, len(l.specs))
+	for name := range l.specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		paths := l.specs[name]
+		if len(paths) < 2 {
+			continue
+		}
+		for _, path := range paths {
+			var others []string
+			for _, p := range paths {
+				if p != path {
+					others = append(others, displayPath(p, l.baseDir))
+				}
+			}
+			l.addf(path, "name %q is also used by %s", name, strings.Join(others, ", "))
+		}
+	}
+
+	for _, cycle := range l.cycles(names) {
+		l.addf(l.specs[cycle[0]][0], "dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+}
+
+// cycles returns the dependency cycles between the specs, each starting
+// and ending with the same spec.
+func (l *linter) cycles(names []string) [][]string {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var stack []string
+	var cycles [][]string
+
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range l.deps[name] {
+			if _, ok := l.specs[dep]; !ok {
+				continue // An external image.
+			}
+			switch state[dep] {
+			case visiting:
+				i := slices.Index(stack, dep)
+				cycle := slices.Clone(stack[i:])
+				cycles = append(cycles, append(cycle, dep))
+			case 0:
+				visit(dep)
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+	}
+	for _, name := range names {
+		if state[name] == 0 {
+			visit(name)
+		}
+	}
+	return cycles
+}
+
+// varFields returns the fields of the spec that variables are expanded in.
+func (s *Spec) varFields() []string {
+	fields := []string{s.Name, s.Dockerfile, s.Target, s.ContextOwner, s.CacheEpoch}
+	fields = slices.Concat(
+		fields, s.Tags, s.Froms, s.Srcs, s.BuildArgs, s.BuildHintArgs, s.Platforms,
+	)
+	for _, a := range s.Artifacts {
+		fields = append(fields, a.Src, a.Dst)
+	}
+	for _, secret := range s.Secrets {
+		if secret != nil {
+			fields = append(fields, secret.Env, secret.Src)
+		}
+	}
+	return fields
+}
+
+// Lint checks every spec file in the spec directories listed by the
+// wandaspecs file, and writes the problems found to w, one per line with
+// the path of the spec file. It returns an error if there are any.
+func Lint(config *ForgeConfig, w io.Writer) error {
+	lookup, err := newEnvLookup(config.EnvFile)
+	if err != nil {
+		return err
+	}
+
+	wandaSpecsFile := config.wandaSpecsFile()
+	specDirs, err := readWandaSpecs(wandaSpecsFile)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", wandaSpecsFile, err)
+	}
+	if len(specDirs) == 0 {
+		return fmt.Errorf("no spec directories listed in %s", wandaSpecsFile)
+	}
+
+	baseDir, err := filepath.Abs(filepath.Dir(wandaSpecsFile))
+	if err != nil {
+		return fmt.Errorf("abs path for %s: %w", wandaSpecsFile, err)
+	}
+	workDir, err := filepath.Abs(filepath.FromSlash(config.WorkDir))
+	if err != nil {
+		return fmt.Errorf("abs path for work dir: %w", err)
+	}
+
+	l := newLinter(baseDir, workDir, config.NamePrefix, lookup)
+	for _, dir := range specDirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(baseDir, dir)
+		}
+		if err := l.lintDir(dir); err != nil {
+			return fmt.Errorf("lint %s: %w", dir, err)
+		}
+	}
+	l.checkNames()
+
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		return l.problems[i].Path < l.problems[j].Path
+	})
+	for _, p := range l.problems {
+		fmt.Fprintf(w, "%s: %s\n", displayPath(p.Path, l.baseDir), p.Message)
+	}
+	if len(l.problems) > 0 {
+		return fmt.Errorf("found %d problems in wanda specs", len(l.problems))
+	}
+	return nil
+}
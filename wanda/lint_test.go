@@ -0,0 +1,121 @@
+package wanda
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	tmpDir := t.TempDir()
+	specsDir := filepath.Join(tmpDir, "specs")
+	if err := os.Mkdir(specsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSpec(t, tmpDir, "Dockerfile", "FROM scratch\n")
+	writeSpec(t, tmpDir, "hello.txt", "hello\n")
+
+	specs := map[string][]string{
+		"good.wanda.yaml": {
+			"name: good",
+			"dockerfile: Dockerfile",
+			"srcs: [hello.txt]",
+		},
+		"typo.wanda.yaml": {
+			"name: typo",
+			"dockerfile: Dockerfile",
+			"src: [hello.txt]",
+		},
+		"unset.wanda.yaml": {
+			"name: unset",
+			"dockerfile: Dockerfile",
+			"build_args: [VERSION=$LINT_TEST_VERSION]",
+		},
+		"missing.wanda.yaml": {
+			"name: missing",
+			"dockerfile: missing.Dockerfile",
+			"srcs: [missing.txt, \"*.md\"]",
+		},
+		"dup1.wanda.yaml": {
+			"name: dup",
+			"dockerfile: Dockerfile",
+		},
+		"dup2.wanda.yaml": {
+			"name: dup",
+			"dockerfile: Dockerfile",
+		},
+		"bad.wanda.yaml": {
+			"name: bad",
+			"dockerfile: Dockerfile",
+			"context_owner: root",
+			"artifacts:",
+			"  - src: relative/path",
+			"    dst: out",
+		},
+		"a.wanda.yaml": {
+			"name: a",
+			"froms: [" + testPrefix + "b]",
+			"dockerfile: Dockerfile",
+		},
+		"b.wanda.yaml": {
+			"name: b",
+			"froms: [" + testPrefix + "a]",
+			"dockerfile: Dockerfile",
+		},
+	}
+	for name, lines := range specs {
+		writeSpec(t, specsDir, name, strings.Join(lines, "\n"))
+	}
+
+	config := &ForgeConfig{
+		WorkDir:        tmpDir,
+		NamePrefix:     testPrefix,
+		WandaSpecsFile: writeWandaSpecs(t, tmpDir, []string{"specs"}),
+	}
+
+	var buf strings.Builder
+	err := Lint(config, &buf)
+	if err == nil {
+		t.Fatal("lint: got nil error, want problems")
+	}
+
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{
+		"specs/a.wanda.yaml: dependency cycle: a -> b -> a",
+		"specs/bad.wanda.yaml: artifact 0: artifact src must be absolute path: \"relative/path\"",
+		"specs/bad.wanda.yaml: context_owner \"root\": expected uid:gid format",
+		"specs/dup1.wanda.yaml: name \"dup\" is also used by specs/dup2.wanda.yaml",
+		"specs/dup2.wanda.yaml: name \"dup\" is also used by specs/dup1.wanda.yaml",
+		"specs/missing.wanda.yaml: dockerfile missing.Dockerfile does not exist",
+		"specs/missing.wanda.yaml: src missing.txt does not exist",
+		"specs/missing.wanda.yaml: src *.md matches no files",
+		"specs/typo.wanda.yaml: decode spec: yaml: unmarshal errors:\n  line 3: field src not found in type wanda.Spec",
+		"specs/unset.wanda.yaml: variables not set: $LINT_TEST_VERSION",
+	}
+	want = strings.Split(strings.Join(want, "\n"), "\n")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lint output:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLint_clean(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeSpec(t, tmpDir, "Dockerfile", "FROM scratch\n")
+	writeSpec(t, tmpDir, "hello.wanda.yaml", strings.Join([]string{
+		"name: hello-$PY",
+		"dockerfile: Dockerfile",
+		"matrix:",
+		"  PY: [\"3.10\", \"3.12\"]",
+	}, "\n"))
+
+	config := &ForgeConfig{
+		WorkDir:        tmpDir,
+		WandaSpecsFile: writeWandaSpecs(t, tmpDir, []string{"."}),
+	}
+	var buf strings.Builder
+	if err := Lint(config, &buf); err != nil {
+		t.Errorf("lint: %v\n%s", err, buf.String())
+	}
+}
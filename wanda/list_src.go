@@ -85,13 +85,17 @@ func cleanPath(s string) string {
 //   - if src's basename contains a '*' or '?', it is treated as a glob pattern,
 //     and will select all the files that match the pattern in the directory.
 //     it only matches files in a single directory.
+//   - if src has a glob in a directory segment or a "**" segment, it is
+//     matched against the paths of all the files under the leading
+//     directories without globs; see srcPattern. With a trailing '/', it
+//     selects all the files in the matching directories.
 //   - otherwise, it is treated as a single file.
 //
 // workDir is an OS filepath; src is a source path.
 //
 // The returned files are relative to the work directory.
 func listSrcFilesSingle(workDir, src string) ([]string, error) {
-	if strings.HasSuffix(src, "/") { // a directory
+	if strings.HasSuffix(src, "/") && !isFilePathGlob(src) { // a directory
 		cleanSrc := cleanPath(strings.TrimSuffix(src, "/"))
 		dir := filepath.Join(workDir, filepath.FromSlash(cleanSrc))
 		files, err := walkFilesInDir(dir)
@@ -123,6 +127,10 @@ func listSrcFilesSingle(workDir, src string) ([]string, error) {
 		return []string{srcClean}, nil
 	}
 
+	if strings.HasSuffix(src, "/") || isFilePathGlob(dir) || strings.Contains(base, "**") {
+		return listSrcFilesPattern(workDir, src)
+	}
+
 	// This is a glob pattern.
 	dirFilePath := filepath.FromSlash(dir)
 
@@ -146,16 +154,72 @@ func listSrcFilesSingle(workDir, src string) ([]string, error) {
 	return files, nil
 }
 
+// listSrcFilesPattern lists the files that match src as a srcPattern
+// anchored to the work directory.
+func listSrcFilesPattern(workDir, src string) ([]string, error) {
+	p, err := newSrcPattern(src)
+	if err != nil {
+		return nil, err
+	}
+	p.anchored = true // srcs are always relative to the work directory.
+
+	root := p.root()
+	files, err := walkFilesInDir(filepath.Join(workDir, filepath.FromSlash(root)))
+	if err != nil {
+		return nil, fmt.Errorf("walk files in dir %q: %w", root, err)
+	}
+
+	var matched []string
+	for _, file := range files {
+		rel, err := filepath.Rel(workDir, file)
+		if err != nil {
+			return nil, fmt.Errorf("rel file %q: %w", file, err)
+		}
+		rel = filepath.ToSlash(rel)
+
+		// Unlike excludes, an include pattern without a trailing '/' only
+		// selects files, not the content of matching directories.
+		var ok bool
+		if p.dirOnly {
+			ok = p.match(rel)
+		} else {
+			ok = p.matchNames(strings.Split(rel, "/"))
+		}
+		if ok {
+			matched = append(matched, rel)
+		}
+	}
+	return matched, nil
+}
+
 // listSrcFiles lists the files in the given sources.
-// It goes through all the sources, run them with listSrcFilesSingle,
-// and then merge the results.
+// It goes through all the sources in order, run them with
+// listSrcFilesSingle, and then merge the results. A source starting with
+// '!' is a gitignore-style pattern that excludes the files selected by the
+// sources before it. Files matched by the ignore patterns are left out,
+// except for the Dockerfile, which is always included.
+//
+// The returned files are sorted, so that the result does not depend on the
+// order in which the files are found.
 func listSrcFiles(
-	workDir string, srcs []string, dockerFile string,
+	workDir string, srcs []string, dockerFile string, ignores []*srcPattern,
 ) ([]string, error) {
 	fileMap := make(map[string]struct{})
-	fileMap[dockerFile] = struct{}{}
 
 	for _, src := range srcs {
+		if strings.HasPrefix(src, "!") {
+			p, err := newSrcPattern(src)
+			if err != nil {
+				return nil, fmt.Errorf("exclude src %q: %w", src, err)
+			}
+			for file := range fileMap {
+				if p.match(file) {
+					delete(fileMap, file)
+				}
+			}
+			continue
+		}
+
 		files, err := listSrcFilesSingle(workDir, src)
 		if err != nil {
 			return nil, fmt.Errorf("list src files for %q: %w", src, err)
@@ -165,6 +229,15 @@ func listSrcFiles(
 		}
 	}
 
+	if len(ignores) > 0 {
+		for file := range fileMap {
+			if srcIgnored(file, ignores) {
+				delete(fileMap, file)
+			}
+		}
+	}
+	fileMap[dockerFile] = struct{}{}
+
 	var files []string
 	for file := range fileMap {
 		files = append(files, file)
@@ -0,0 +1,439 @@
+package wanda
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	crane "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// localRegistryRepo is the work repository in the built-in local registry.
+const localRegistryRepo = "rayci-work"
+
+// manifestRecord is a manifest change in the journal of a local registry.
+type manifestRecord struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// localRegistry is an OCI registry served on a local port for the duration
+// of a local build. Blobs are stored in a directory on disk. Manifests are
+// kept in memory by the registry, so every change to them is also appended
+// to a journal in the directory, which is replayed on start; this keeps the
+// cache across builds.
+//
+// On start and on close, the journal is rewritten to only the manifests
+// that are left, and the blobs that none of them use are removed, so that
+// the directory only grows with what the registry has; gc deletes the rest.
+// The directory is used by one registry at a time.
+type localRegistry struct {
+	handler  http.Handler
+	blobsDir string
+
+	listener net.Listener
+	server   *http.Server
+
+	mu          sync.Mutex
+	journal     *os.File
+	journalFile string
+
+	// manifests are the manifests in the registry by their request path,
+	// as the journal has them.
+	manifests map[string]*manifestRecord
+}
+
+const localRegistryJournal = "manifests.jsonl"
+
+// checkLocalRegistryHost checks that the container engine can reach the
+// local registry, which only listens on the loopback address of this host.
+// That is only the case for an engine on the same Linux host: Docker
+// Desktop and podman machine run the engine in a VM, and a remote engine
+// runs elsewhere.
+func checkLocalRegistryHost(goos string, getenv func(string) string) error {
+	if goos != "linux" {
+		return fmt.Errorf(
+			"local registry only works on linux, where the container engine runs on the same host; not on %s",
+			goos,
+		)
+	}
+	for _, env := range []string{"DOCKER_HOST", "CONTAINER_HOST"} {
+		if host := getenv(env); host != "" && !strings.HasPrefix(host, "unix://") {
+			return fmt.Errorf(
+				"local registry only works with a container engine on this host, not %s=%s",
+				env, host,
+			)
+		}
+	}
+	return nil
+}
+
+func startLocalRegistry(dir string) (*localRegistry, error) {
+	blobsDir := filepath.Join(dir, "blobs")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return nil, fmt.Errorf("create blobs dir: %w", err)
+	}
+
+	r := &localRegistry{
+		handler: registry.New(
+			registry.WithBlobHandler(registry.NewDiskBlobHandler(blobsDir)),
+			registry.Logger(log.New(io.Discard, "", 0)),
+		),
+		blobsDir:    blobsDir,
+		journalFile: filepath.Join(dir, localRegistryJournal),
+		manifests:   make(map[string]*manifestRecord),
+	}
+
+	if err := r.replay(r.journalFile); err != nil {
+		return nil, fmt.Errorf("replay %s: %w", r.journalFile, err)
+	}
+	if err := r.tidy(); err != nil {
+		return nil, err
+	}
+	journal, err := os.OpenFile(r.journalFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	r.journal = journal
+
+	// Docker treats registries on loopback addresses as insecure, so it can
+	// push to the registry over plain HTTP. Only an engine on this host can
+	// reach it; see checkLocalRegistryHost.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	r.listener = listener
+	r.server = &http.Server{Handler: r}
+	go r.server.Serve(listener)
+
+	return r, nil
+}
+
+// addr returns the host:port that the registry is served on.
+func (r *localRegistry) addr() string { return r.listener.Addr().String() }
+
+// workRepo returns the work repository in the registry.
+func (r *localRegistry) workRepo() string {
+	return r.addr() + "/" + localRegistryRepo
+}
+
+func (r *localRegistry) close() error {
+	err := r.server.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if journalErr := r.journal.Close(); journalErr != nil {
+		return errors.Join(err, journalErr)
+	}
+	return errors.Join(err, r.tidy())
+}
+
+// apply records the manifest change rec in r.manifests, the way that the
+// registry applies it: a manifest put by tag is also stored by its digest.
+func (r *localRegistry) apply(rec *manifestRecord) {
+	switch rec.Method {
+	case http.MethodPut:
+		r.manifests[rec.Path] = rec
+		byDigest := *rec
+		byDigest.Path = path.Join(path.Dir(rec.Path), manifestDigest(rec.Body))
+		r.manifests[byDigest.Path] = &byDigest
+	case http.MethodDelete:
+		delete(r.manifests, rec.Path)
+	}
+}
+
+// manifestDigest returns the digest of a manifest.
+func manifestDigest(body []byte) string {
+	h, _, err := crane.SHA256(bytes.NewReader(body))
+	if err != nil {
+		return "" // Reading from memory does not fail.
+	}
+	return h.String()
+}
+
+// tidy rewrites the journal with only the manifests that the registry has,
+// and removes the blobs that none of them use.
+func (r *localRegistry) tidy() error {
+	var paths []string
+	for p := range r.manifests {
+		paths = append(paths, p)
+	}
+	// An index can only be put after the manifests in it.
+	sort.Slice(paths, func(i, j int) bool {
+		ii := types.MediaType(r.manifests[paths[i]].ContentType).IsIndex()
+		ij := types.MediaType(r.manifests[paths[j]].ContentType).IsIndex()
+		if ii != ij {
+			return ij
+		}
+		return paths[i] < paths[j]
+	})
+
+	tmp := r.journalFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create journal: %w", err)
+	}
+	enc := json.NewEncoder(f)
+	used := make(map[string]bool)
+	for _, p := range paths {
+		rec := r.manifests[p]
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return fmt.Errorf("write journal: %w", err)
+		}
+		m := new(manifestBlobs)
+		if err := json.Unmarshal(rec.Body, m); err != nil {
+			f.Close()
+			return fmt.Errorf("decode manifest %s: %w", p, err)
+		}
+		used[m.Config.Digest] = true
+		for _, l := range m.Layers {
+			used[l.Digest] = true
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := os.Rename(tmp, r.journalFile); err != nil {
+		return fmt.Errorf("replace journal: %w", err)
+	}
+
+	// Blobs are stored at <algorithm>/<hex> in the blobs dir.
+	algs, err := os.ReadDir(r.blobsDir)
+	if err != nil {
+		return fmt.Errorf("read blobs dir: %w", err)
+	}
+	for _, alg := range algs {
+		dir := filepath.Join(r.blobsDir, alg.Name())
+		blobs, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("read blobs dir: %w", err)
+		}
+		for _, b := range blobs {
+			if used[alg.Name()+":"+b.Name()] {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, b.Name())); err != nil {
+				return fmt.Errorf("remove unused blob: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// manifestBlobs are the blobs that an image manifest uses. An index only
+// has manifests in it, which are not blobs.
+type manifestBlobs struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string `json:"digest"`
+	} `json:"layers"`
+}
+
+// isDigestPath reports whether the manifest request path p is by digest,
+// rather than by tag.
+func isDigestPath(p string) bool {
+	return strings.Contains(path.Base(p), ":")
+}
+
+// isManifestChange reports whether req puts or deletes a manifest.
+func isManifestChange(req *http.Request) bool {
+	if req.Method != http.MethodPut && req.Method != http.MethodDelete {
+		return false
+	}
+	elems := strings.Split(req.URL.Path, "/")
+	return len(elems) >= 5 && elems[1] == "v2" && elems[len(elems)-2] == "manifests"
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (r *localRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !isManifestChange(req) {
+		r.handler.ServeHTTP(w, req)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Hold the lock while serving, so that the journal has the changes in
+	// the order that the registry applied them.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	r.handler.ServeHTTP(sw, req)
+	if sw.status/100 != 2 {
+		return
+	}
+
+	r.record(&manifestRecord{
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		ContentType: req.Header.Get("Content-Type"),
+		Body:        body,
+	})
+
+	// Like other registries, and unlike the registry package, deleting a
+	// manifest by digest also deletes its tags, so that gc removes them.
+	if req.Method != http.MethodDelete || !isDigestPath(req.URL.Path) {
+		return
+	}
+	deleted := path.Base(req.URL.Path)
+	var tags []string
+	for p, rec := range r.manifests {
+		if path.Dir(p) == path.Dir(req.URL.Path) && !isDigestPath(p) &&
+			manifestDigest(rec.Body) == deleted {
+			tags = append(tags, p)
+		}
+	}
+	sort.Strings(tags)
+	for _, p := range tags {
+		tagReq, err := http.NewRequest(http.MethodDelete, p, nil)
+		if err != nil {
+			log.Printf("local registry: delete %s: %v", p, err)
+			continue
+		}
+		dw := &discardWriter{header: make(http.Header), status: http.StatusOK}
+		r.handler.ServeHTTP(dw, tagReq)
+		if dw.status/100 == 2 {
+			r.record(&manifestRecord{Method: http.MethodDelete, Path: p})
+		}
+	}
+}
+
+// record appends the manifest change rec to the journal. r.mu is held.
+func (r *localRegistry) record(rec *manifestRecord) {
+	r.apply(rec)
+	if err := json.NewEncoder(r.journal).Encode(rec); err != nil {
+		log.Printf("local registry: write journal: %v", err)
+	}
+}
+
+// discardWriter is a response writer for replayed requests.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(status int)      { w.status = status }
+
+// replay applies the manifest changes in the journal file to the registry.
+func (r *localRegistry) replay(file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		rec := new(manifestRecord)
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return fmt.Errorf("decode record: %w", err)
+		}
+		req, err := http.NewRequest(rec.Method, rec.Path, bytes.NewReader(rec.Body))
+		if err != nil {
+			return fmt.Errorf("make request: %w", err)
+		}
+		if rec.ContentType != "" {
+			req.Header.Set("Content-Type", rec.ContentType)
+		}
+
+		w := &discardWriter{header: make(http.Header), status: http.StatusOK}
+		r.handler.ServeHTTP(w, req)
+		if w.status/100 != 2 {
+			// Blobs might have been removed from the directory.
+			log.Printf("local registry: skip %s %s: status %d", rec.Method, rec.Path, w.status)
+			continue
+		}
+		r.apply(rec)
+	}
+	return scanner.Err()
+}
+
+// withLocalRegistry starts the built-in local registry of config, and
+// returns a copy of config that uses it as the work repo, along with a
+// function that stops the registry.
+func withLocalRegistry(config *ForgeConfig) (*ForgeConfig, func(), error) {
+	if config.WorkRepo != "" || config.RayCI {
+		return nil, nil, fmt.Errorf("local registry only works in local mode without a work repo")
+	}
+
+	r, err := startLocalRegistry(config.LocalRegistry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("start local registry: %w", err)
+	}
+	log.Printf("serving local registry from %s on %s", config.LocalRegistry, r.addr())
+
+	c := *config
+	c.WorkRepo = r.workRepo()
+	stop := func() {
+		if err := r.close(); err != nil {
+			log.Printf("stop local registry: %v", err)
+		}
+	}
+	return &c, stop, nil
+}
+
+// pullCacheHit pulls the image of a cache hit in the local registry into
+// docker, and tags it with the local tags in tags, so that the image is
+// available locally like a freshly built one.
+func (f *Forge) pullCacheHit(
+	ctx context.Context, workTag string, tags []string, out *buildOutput,
+) error {
+	d := f.newEngine()
+	d.setOutput(out)
+	if err := d.pull(ctx, workTag, workTag); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, f.config.WorkRepo+":") {
+			continue
+		}
+		out.log.Printf("tag output as %s", tag)
+		if err := d.tag(ctx, workTag, tag); err != nil {
+			return fmt.Errorf("tag %s: %w", tag, err)
+		}
+	}
+	return nil
+}
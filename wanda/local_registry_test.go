@@ -0,0 +1,238 @@
+package wanda
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestLocalRegistry(t *testing.T) {
+	dir := t.TempDir()
+
+	r, err := startLocalRegistry(dir)
+	if err != nil {
+		t.Fatalf("start local registry: %v", err)
+	}
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("image digest: %v", err)
+	}
+	other, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+
+	cacheTag := mustNewTag(t, r.workRepo()+":z-abc")
+	if err := remote.Write(cacheTag, img); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+	desc, err := remote.Get(cacheTag)
+	if err != nil {
+		t.Fatalf("get cache tag: %v", err)
+	}
+	if err := remote.Tag(mustNewTag(t, r.workRepo()+":b1-hello"), desc); err != nil {
+		t.Fatalf("tag work tag: %v", err)
+	}
+
+	otherTag := mustNewTag(t, r.workRepo()+":z-other")
+	if err := remote.Write(otherTag, other); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+	otherDigest, err := other.Digest()
+	if err != nil {
+		t.Fatalf("image digest: %v", err)
+	}
+	if err := remote.Delete(mustNewDigest(t, r.workRepo(), otherDigest)); err != nil {
+		t.Fatalf("delete image: %v", err)
+	}
+
+	if err := r.close(); err != nil {
+		t.Fatalf("close local registry: %v", err)
+	}
+
+	// A new registry on the same directory has the same content.
+	r, err = startLocalRegistry(dir)
+	if err != nil {
+		t.Fatalf("restart local registry: %v", err)
+	}
+	defer r.close()
+
+	for _, tag := range []string{"z-abc", "b1-hello"} {
+		ref, err := name.NewTag(r.workRepo() + ":" + tag)
+		if err != nil {
+			t.Fatalf("parse tag: %v", err)
+		}
+		got, err := remote.Image(ref)
+		if err != nil {
+			t.Fatalf("get %s after restart: %v", tag, err)
+		}
+		gotDigest, err := got.Digest()
+		if err != nil {
+			t.Fatalf("image digest: %v", err)
+		}
+		if gotDigest != digest {
+			t.Errorf("%s digest = %s, want %s", tag, gotDigest, digest)
+		}
+		// Layers are served from the blobs on disk.
+		layers, err := got.Layers()
+		if err != nil {
+			t.Fatalf("image layers: %v", err)
+		}
+		for _, l := range layers {
+			rc, err := l.Compressed()
+			if err != nil {
+				t.Fatalf("read layer of %s: %v", tag, err)
+			}
+			rc.Close()
+		}
+	}
+
+	if _, err := remote.Head(mustNewDigest(t, r.workRepo(), otherDigest)); err == nil {
+		t.Errorf("deleted image is back after restart")
+	}
+}
+
+func TestLocalRegistry_tidy(t *testing.T) {
+	dir := t.TempDir()
+
+	r, err := startLocalRegistry(dir)
+	if err != nil {
+		t.Fatalf("start local registry: %v", err)
+	}
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("image digest: %v", err)
+	}
+	kept, err := random.Image(512, 1)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+
+	if err := remote.Write(mustNewTag(t, r.workRepo()+":z-abc"), img); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+	if err := remote.Write(mustNewTag(t, r.workRepo()+":z-kept"), kept); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+	if err := remote.Delete(mustNewDigest(t, r.workRepo(), digest)); err != nil {
+		t.Fatalf("delete image: %v", err)
+	}
+	// Deleting by digest deletes the tag too.
+	if _, err := remote.Head(mustNewTag(t, r.workRepo()+":z-abc")); err == nil {
+		t.Errorf("tag of deleted image still exists")
+	}
+
+	if err := r.close(); err != nil {
+		t.Fatalf("close local registry: %v", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("image layers: %v", err)
+	}
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatalf("layer digest: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "blobs", d.Algorithm, d.Hex)); !os.IsNotExist(err) {
+			t.Errorf("blob %s of deleted image is not removed: %v", d, err)
+		}
+	}
+	keptLayers, err := kept.Layers()
+	if err != nil {
+		t.Fatalf("image layers: %v", err)
+	}
+	d, err := keptLayers[0].Digest()
+	if err != nil {
+		t.Fatalf("layer digest: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "blobs", d.Algorithm, d.Hex)); err != nil {
+		t.Errorf("blob %s of kept image: %v", d, err)
+	}
+
+	// The journal only has the tag and digest of the kept image.
+	journal, err := os.ReadFile(filepath.Join(dir, localRegistryJournal))
+	if err != nil {
+		t.Fatalf("read journal: %v", err)
+	}
+	if n := bytes.Count(journal, []byte("\n")); n != 2 {
+		t.Errorf("journal has %d records, want 2:\n%s", n, journal)
+	}
+
+	r, err = startLocalRegistry(dir)
+	if err != nil {
+		t.Fatalf("restart local registry: %v", err)
+	}
+	defer r.close()
+	if _, err := remote.Image(mustNewTag(t, r.workRepo()+":z-kept")); err != nil {
+		t.Errorf("get kept image after restart: %v", err)
+	}
+}
+
+func TestCheckLocalRegistryHost(t *testing.T) {
+	env := func(envs map[string]string) func(string) string {
+		return func(k string) string { return envs[k] }
+	}
+	for _, test := range []struct {
+		goos    string
+		envs    map[string]string
+		wantErr bool
+	}{
+		{goos: "linux"},
+		{goos: "linux", envs: map[string]string{"DOCKER_HOST": "unix:///var/run/docker.sock"}},
+		{goos: "darwin", wantErr: true},
+		{goos: "windows", wantErr: true},
+		{goos: "linux", envs: map[string]string{"DOCKER_HOST": "tcp://10.0.0.1:2376"}, wantErr: true},
+		{goos: "linux", envs: map[string]string{"CONTAINER_HOST": "ssh://core@vm/run/podman.sock"}, wantErr: true},
+	} {
+		err := checkLocalRegistryHost(test.goos, env(test.envs))
+		if got := err != nil; got != test.wantErr {
+			t.Errorf("checkLocalRegistryHost(%q, %v) = %v, want error %t", test.goos, test.envs, err, test.wantErr)
+		}
+	}
+}
+
+func TestWithLocalRegistry(t *testing.T) {
+	config := &ForgeConfig{WorkDir: "testdata", LocalRegistry: t.TempDir()}
+
+	c, stop, err := withLocalRegistry(config)
+	if err != nil {
+		t.Fatalf("withLocalRegistry: %v", err)
+	}
+	defer stop()
+
+	if !c.isRemote() {
+		t.Errorf("config with local registry is not remote")
+	}
+	if config.WorkRepo != "" {
+		t.Errorf("withLocalRegistry changed the original config")
+	}
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+	if err := remote.Write(mustNewTag(t, c.workTag("hello")), img); err != nil {
+		t.Fatalf("push to local registry: %v", err)
+	}
+
+	config.WorkRepo = "localhost:5000/work"
+	if _, _, err := withLocalRegistry(config); err == nil {
+		t.Errorf("withLocalRegistry with a work repo should fail")
+	}
+}
@@ -0,0 +1,256 @@
+package wanda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// lockFileName is the name of the lockfile, which is kept next to the
+// .wandaspecs file by default.
+const lockFileName = "wanda.lock"
+
+// lockedImage pins an external base image for a platform.
+type lockedImage struct {
+	From     string `json:"from"`
+	Platform string `json:"platform"`
+
+	// Digest is the digest of the image manifest for the platform.
+	Digest string `json:"digest"`
+
+	// ConfigID is the digest of the image config, which is the image ID
+	// that goes into the input digests of the specs.
+	ConfigID string `json:"config_id"`
+}
+
+// lockFile pins the external base images of all the specs in the spec
+// directories, so that they resolve the same way on every run, without
+// going to the registry.
+type lockFile struct {
+	Images []*lockedImage `json:"images"`
+}
+
+// defaultLockPlatforms are the platforms that the external base images of
+// specs without platforms are locked for. Such specs are built for the host
+// platform, so these are the platforms of the hosts that build them.
+var defaultLockPlatforms = []string{"linux/amd64", "linux/arm64"}
+
+// lockPlatform returns the platform that an image built for p is locked
+// under. A nil p is the host platform.
+func lockPlatform(p *platform) string {
+	if p == nil {
+		p = hostPlatform()
+	}
+	return p.String()
+}
+
+func (l *lockFile) find(from string, p *platform) *lockedImage {
+	plat := lockPlatform(p)
+	for _, img := range l.Images {
+		if img.From == from && img.Platform == plat {
+			return img
+		}
+	}
+	return nil
+}
+
+func readLockFile(file string) (*lockFile, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	l := new(lockFile)
+	if err := json.Unmarshal(bs, l); err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %w", file, err)
+	}
+	return l, nil
+}
+
+func (l *lockFile) write(file string) error {
+	bs, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal lockfile: %w", err)
+	}
+	return os.WriteFile(file, append(bs, '\n'), 0644)
+}
+
+// source returns the image source of the locked image, pinned by its
+// manifest digest.
+func (img *lockedImage) source() (*imageSource, error) {
+	ref, err := cranename.ParseReference(img.From)
+	if err != nil {
+		return nil, fmt.Errorf("parse reference %s: %w", img.From, err)
+	}
+	return &imageSource{
+		name: img.From,
+		id:   img.ConfigID,
+		src:  ref.Context().Digest(img.Digest).String(),
+	}, nil
+}
+
+// isExternalFrom reports whether from is a base image that is pulled from
+// a registry: not scratch, not a local image and not built by wanda.
+func isExternalFrom(from, namePrefix string) bool {
+	if isDockerScratch(from) || strings.HasPrefix(from, "@") {
+		return false
+	}
+	return namePrefix == "" || !strings.HasPrefix(from, namePrefix)
+}
+
+// lockTargets returns the external base images of specs to lock, with an
+// entry for every platform they are built for, sorted by from and platform.
+// Specs without platforms are built for the host platform, which can be any
+// of defaultLockPlatforms.
+func lockTargets(specs specIndex, namePrefix string) ([]*lockedImage, error) {
+	seen := make(map[lockedImage]bool)
+	var targets []*lockedImage
+	for _, rs := range specs {
+		spec := rs.Spec
+
+		platforms := defaultLockPlatforms
+		if len(spec.Platforms) > 0 {
+			ps, err := parsePlatforms(spec.Platforms)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", rs.Path, err)
+			}
+			platforms = nil
+			for _, p := range ps {
+				platforms = append(platforms, p.String())
+			}
+		}
+
+		for _, from := range spec.Froms {
+			if !isExternalFrom(from, namePrefix) {
+				continue
+			}
+			if vars := findUnexpandedVars(from); len(vars) > 0 {
+				log.Printf("warning: not locking %s of %s: unset variables", from, rs.Path)
+				continue
+			}
+			for _, p := range platforms {
+				key := lockedImage{From: from, Platform: p}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				targets = append(targets, &key)
+			}
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].From != targets[j].From {
+			return targets[i].From < targets[j].From
+		}
+		return targets[i].Platform < targets[j].Platform
+	})
+	return targets, nil
+}
+
+// resolveExternal resolves an external base image for platform p, from the
+// lockfile in locked mode, or otherwise from the registry.
+func (f *Forge) resolveExternal(
+	ctx context.Context, from string, p *platform, opts ...remote.Option,
+) (*imageSource, error) {
+	if f.locked == nil {
+		return f.resolveRemote(ctx, from, from, opts...)
+	}
+	img := f.locked.find(from, p)
+	if img != nil {
+		return img.source()
+	}
+
+	var locked []string
+	for _, img := range f.locked.Images {
+		if img.From == from {
+			locked = append(locked, img.Platform)
+		}
+	}
+	if len(locked) == 0 {
+		return nil, fmt.Errorf(
+			"lockfile %s is stale: %s is not locked; run wanda lock",
+			f.config.lockFile(), from,
+		)
+	}
+	if p == nil {
+		return nil, fmt.Errorf(
+			"lockfile %s does not have %s for the host platform %s, only for %s; "+
+				"specs without platforms are locked for %s",
+			f.config.lockFile(), from, lockPlatform(p), strings.Join(locked, ", "),
+			strings.Join(defaultLockPlatforms, ", "),
+		)
+	}
+	return nil, fmt.Errorf(
+		"lockfile %s is stale: %s is not locked for %s, only for %s; run wanda lock",
+		f.config.lockFile(), from, lockPlatform(p), strings.Join(locked, ", "),
+	)
+}
+
+// lock resolves the manifest digests and config IDs of targets from the
+// registry.
+func (f *Forge) lock(ctx context.Context, targets []*lockedImage) error {
+	for _, img := range targets {
+		p, err := parsePlatform(img.Platform)
+		if err != nil {
+			return err
+		}
+		src, err := f.resolveRemote(ctx, img.From, img.From, f.remoteOptsFor(ctx, p)...)
+		if err != nil {
+			return fmt.Errorf("resolve %s for %s: %w", img.From, img.Platform, err)
+		}
+		d, err := cranename.NewDigest(src.src)
+		if err != nil {
+			return fmt.Errorf("parse digest of %s: %w", img.From, err)
+		}
+		img.Digest = d.DigestStr()
+		img.ConfigID = src.id
+	}
+	return nil
+}
+
+// Lock resolves the external base images of all the specs in the spec
+// directories listed by the wandaspecs file, and writes their manifest
+// digests and config IDs to the lockfile. Images are locked for every
+// platform of multi-platform specs, and for defaultLockPlatforms otherwise.
+// Builds and digests with config.Locked then resolve external base images
+// only from the lockfile.
+func Lock(ctx context.Context, config *ForgeConfig, w io.Writer) error {
+	lookup, err := newEnvLookup(config.EnvFile)
+	if err != nil {
+		return err
+	}
+	specs, err := discoverAllSpecs(config.wandaSpecsFile(), lookup)
+	if err != nil {
+		return err
+	}
+	targets, err := lockTargets(specs, config.NamePrefix)
+	if err != nil {
+		return err
+	}
+
+	// Images are always resolved from the registry when locking.
+	c := *config
+	c.Locked = false
+	forge, err := NewForge(&c)
+	if err != nil {
+		return fmt.Errorf("make forge: %w", err)
+	}
+	if err := forge.lock(ctx, targets); err != nil {
+		return err
+	}
+
+	file := config.lockFile()
+	if err := (&lockFile{Images: targets}).write(file); err != nil {
+		return fmt.Errorf("write lockfile: %w", err)
+	}
+	fmt.Fprintf(w, "locked %d images in %s\n", len(targets), file)
+	return nil
+}
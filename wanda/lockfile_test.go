@@ -0,0 +1,174 @@
+package wanda
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestLockTargets(t *testing.T) {
+	specs := specIndex{
+		"app": {Path: "app.wanda.yaml", Spec: &Spec{
+			Name:  "app",
+			Froms: []string{"ubuntu:22.04", testPrefix + "base", "@local", "scratch"},
+		}},
+		"multi": {Path: "multi.wanda.yaml", Spec: &Spec{
+			Name:      "multi",
+			Froms:     []string{"ubuntu:22.04", "python:3.12"},
+			Platforms: []string{"linux/arm64", "linux/amd64"},
+		}},
+		"unset": {Path: "unset.wanda.yaml", Spec: &Spec{
+			Name:  "unset",
+			Froms: []string{"python:$PY_VERSION"},
+		}},
+	}
+
+	targets, err := lockTargets(specs, testPrefix)
+	if err != nil {
+		t.Fatalf("lockTargets: %v", err)
+	}
+	var got []string
+	for _, img := range targets {
+		got = append(got, img.From+" "+img.Platform)
+	}
+
+	want := []string{
+		"python:3.12 linux/amd64",
+		"python:3.12 linux/arm64",
+		"ubuntu:22.04 linux/amd64",
+		"ubuntu:22.04 linux/arm64",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lockTargets() = %q, want %q", got, want)
+	}
+}
+
+func TestLock(t *testing.T) {
+	server := httptest.NewServer(registry.New(
+		registry.Logger(log.New(io.Discard, "", 0)),
+	))
+	base := server.Listener.Addr().String() + "/ubuntu:22.04"
+
+	pushBase := func() string {
+		t.Helper()
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatalf("create random image: %v", err)
+		}
+		if err := remote.Write(mustNewTag(t, base), img); err != nil {
+			t.Fatalf("push image: %v", err)
+		}
+		id, err := img.ConfigName()
+		if err != nil {
+			t.Fatalf("config name: %v", err)
+		}
+		return id.String()
+	}
+	baseID := pushBase()
+
+	tmpDir := t.TempDir()
+	writeSpec(t, tmpDir, "Dockerfile", "FROM "+base+"\n")
+	specFile := writeSpec(t, tmpDir, "app.wanda.yaml", strings.Join([]string{
+		"name: app",
+		"froms: [" + base + "]",
+		"dockerfile: Dockerfile",
+	}, "\n"))
+
+	config := &ForgeConfig{
+		WorkDir:        tmpDir,
+		NamePrefix:     testPrefix,
+		WandaSpecsFile: writeWandaSpecs(t, tmpDir, []string{"."}),
+	}
+
+	digest := func(config *ForgeConfig) (string, error) {
+		var buf strings.Builder
+		err := Digest(t.Context(), specFile, config, &buf)
+		return strings.TrimSpace(buf.String()), err
+	}
+	unlocked, err := digest(config)
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+
+	var out strings.Builder
+	if err := Lock(t.Context(), config, &out); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	lockPath := filepath.Join(tmpDir, lockFileName)
+	if want := "locked 2 images in " + lockPath + "\n"; out.String() != want {
+		t.Errorf("lock output = %q, want %q", out.String(), want)
+	}
+
+	l, err := readLockFile(lockPath)
+	if err != nil {
+		t.Fatalf("read lockfile: %v", err)
+	}
+	if len(l.Images) != 2 {
+		t.Fatalf("lockfile has %d images, want 2", len(l.Images))
+	}
+	for i, img := range l.Images {
+		if img.From != base || img.ConfigID != baseID || img.Platform != defaultLockPlatforms[i] ||
+			!strings.HasPrefix(img.Digest, "sha256:") {
+			t.Errorf("locked image = %+v, want %s on %s with id %s", img, base, defaultLockPlatforms[i], baseID)
+		}
+	}
+
+	// The tag moves, and the server goes away: the locked digest stays the
+	// same, without the network.
+	pushBase()
+	server.Close()
+
+	lockedConfig := *config
+	lockedConfig.Locked = true
+	locked, err := digest(&lockedConfig)
+	if err != nil {
+		t.Fatalf("locked digest: %v", err)
+	}
+	if locked != unlocked {
+		t.Errorf("locked digest = %s, want %s", locked, unlocked)
+	}
+
+	// A from that is not in the lockfile makes it stale.
+	writeSpec(t, tmpDir, "app.wanda.yaml", strings.Join([]string{
+		"name: app",
+		"froms: [" + base + "-slim]",
+		"dockerfile: Dockerfile",
+	}, "\n"))
+	writeSpec(t, tmpDir, "Dockerfile", "FROM "+base+"-slim\n")
+	if _, err := digest(&lockedConfig); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("locked digest with new from = %v, want stale lockfile error", err)
+	}
+}
+
+func TestResolveExternal_lockedPlatform(t *testing.T) {
+	f := &Forge{
+		config: &ForgeConfig{WorkDir: t.TempDir()},
+		locked: &lockFile{Images: []*lockedImage{{
+			From:     "ubuntu:22.04",
+			Platform: "linux/s390x",
+			Digest:   "sha256:" + strings.Repeat("ab", 32),
+			ConfigID: "sha256:" + strings.Repeat("cd", 32),
+		}}},
+	}
+
+	if _, err := f.resolveExternal(t.Context(), "ubuntu:22.04", &platform{OS: "linux", Arch: "s390x"}); err != nil {
+		t.Errorf("resolve locked platform: %v", err)
+	}
+	_, err := f.resolveExternal(t.Context(), "ubuntu:22.04", nil)
+	if err == nil || !strings.Contains(err.Error(), "host platform") ||
+		!strings.Contains(err.Error(), "only for linux/s390x") {
+		t.Errorf("resolve for the host platform = %v, want host platform mismatch error", err)
+	}
+	_, err = f.resolveExternal(t.Context(), "python:3.12", nil)
+	if err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("resolve unlocked image = %v, want stale lockfile error", err)
+	}
+}
@@ -0,0 +1,250 @@
+package wanda
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Reasons for the entries of a plan.
+const (
+	planCacheHit       = "cache hit"
+	planMissingTag     = "missing cache tag"
+	planDisableCaching = "disable_caching"
+	planRebuildFlag    = "-rebuild"
+)
+
+// planEntry is what a build would do for a spec, or for one platform of a
+// multi-platform spec.
+type planEntry struct {
+	Name     string
+	Platform string
+
+	// Digest is the input digest of the image. It is empty when the image
+	// builds from an upstream image that is rebuilt, as the digest then
+	// depends on the image that is yet to be built.
+	Digest string
+
+	Hit    bool
+	Reason string
+
+	// Unknown is set when the cache tag could not be checked. The build
+	// would count it as a miss, and so does the plan.
+	Unknown bool
+}
+
+// planner plans the builds of a dependency graph, in build order.
+type planner struct {
+	forge *Forge
+	graph *depGraph
+
+	// rebuilt is the set of specs that would be rebuilt.
+	rebuilt map[string]bool
+}
+
+// plan plans the build of every spec in the graph.
+func (p *planner) plan(ctx context.Context) ([]*planEntry, error) {
+	var entries []*planEntry
+	for _, name := range p.graph.Order {
+		spec := p.graph.Specs[name].Spec
+
+		platforms := []*platform{nil}
+		if len(spec.Platforms) > 0 {
+			var err error
+			platforms, err = p.forge.selectPlatforms(spec)
+			if err != nil {
+				return nil, fmt.Errorf("plan %s: %w", name, err)
+			}
+		}
+
+		for _, plat := range platforms {
+			e, err := p.planPlatform(ctx, spec, plat)
+			if err != nil {
+				if plat != nil {
+					return nil, fmt.Errorf("plan %s on %s: %w", name, plat, err)
+				}
+				return nil, fmt.Errorf("plan %s: %w", name, err)
+			}
+			if !e.Hit {
+				p.rebuilt[name] = true
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// planPlatform plans the build of spec for platform plat.
+func (p *planner) planPlatform(ctx context.Context, spec *Spec, plat *platform) (*planEntry, error) {
+	e := &planEntry{Name: spec.Name}
+	if plat != nil {
+		e.Platform = plat.String()
+	}
+
+	// A rebuilt upstream image gets a new image ID, which changes the
+	// digest of every image built from it.
+	for _, dep := range localDeps(spec, p.graph.namePrefix) {
+		if p.rebuilt[dep] {
+			e.Reason = fmt.Sprintf("upstream %s is rebuilt", dep)
+			return e, nil
+		}
+	}
+
+	digest, err := p.forge.digestSpec(ctx, spec, plat)
+	if err != nil {
+		return nil, err
+	}
+	e.Digest = digest
+
+	switch {
+	case spec.DisableCaching:
+		e.Reason = planDisableCaching
+		return e, nil
+	case p.forge.config.Rebuild:
+		e.Reason = planRebuildFlag
+		return e, nil
+	}
+
+	src, err := p.forge.lookupCache(ctx, p.forge.cacheTag(digest), plat)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		e.Unknown = true
+		e.Reason = fmt.Sprintf("miss, error: %v", err)
+		return e, nil
+	}
+	if src == nil {
+		e.Reason = planMissingTag
+		return e, nil
+	}
+	e.Hit = true
+	e.Reason = planCacheHit
+
+	// Images built from this one resolve it as the cache hit.
+	p.forge.plannedFroms[plannedFromKey(spec.Name, plat)] = src
+	return e, nil
+}
+
+// plannedFromKey is the key of the image of spec name built for plat in
+// Forge.plannedFroms. A nil plat is the host platform.
+func plannedFromKey(name string, plat *platform) string {
+	if plat == nil {
+		plat = hostPlatform()
+	}
+	return name + " " + plat.String()
+}
+
+// lookupCache looks up the image at cacheTag without tagging it. It returns
+// nil if there is no such image. Transient registry errors are retried like
+// in a build.
+func (f *Forge) lookupCache(ctx context.Context, cacheTag string, p *platform) (*imageSource, error) {
+	if !f.isRemote() {
+		info, err := f.engine.inspectImage(ctx, cacheTag)
+		if err != nil {
+			return nil, fmt.Errorf("check cache image: %w", err)
+		}
+		if info == nil {
+			return nil, nil
+		}
+		return &imageSource{id: info.ID, local: cacheTag}, nil
+	}
+
+	ct, err := cranename.NewTag(cacheTag)
+	if err != nil {
+		return nil, fmt.Errorf("parse cache tag %q: %w", cacheTag, err)
+	}
+
+	opts := f.remoteOptsFor(ctx, p)
+	var desc *remote.Descriptor
+	err = f.retry.do(ctx, "get "+cacheTag, log.Default(), func() error {
+		var err error
+		desc, err = remote.Get(ct, opts...)
+		return err
+	})
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("check cache image: %w", err)
+	}
+	if err := f.verifyCacheImage(ctx, ct, desc.Digest); err != nil {
+		log.Printf("cache image %s is untrusted: %v", desc.Digest, err)
+		return nil, nil
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return nil, fmt.Errorf("read cache image %s: %w", cacheTag, err)
+	}
+	id, err := img.ConfigName()
+	if err != nil {
+		return nil, fmt.Errorf("get config name/id for %s: %w", cacheTag, err)
+	}
+	return &imageSource{
+		id:  id.String(),
+		src: ct.Context().Digest(desc.Digest.String()).String(),
+	}, nil
+}
+
+// Plan writes what a build of the given spec file would do to w, without
+// building anything. Every spec in the dependency graph is digested in build
+// order, and its cache tag is looked up in the work repo. Specs that would
+// be rebuilt are listed with the reason. Specs whose cache tag cannot be
+// checked are listed as unknown, and counted as rebuilds like a build would.
+func Plan(ctx context.Context, specFile string, config *ForgeConfig, w io.Writer) error {
+	if config.LocalRegistry != "" {
+		c, stop, err := withLocalRegistry(config)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		config = c
+	}
+
+	s, err := newBuildSession(specFile, config)
+	if err != nil {
+		return err
+	}
+
+	s.forge.plannedFroms = make(map[string]*imageSource)
+	p := &planner{
+		forge:   s.forge,
+		graph:   s.graph,
+		rebuilt: make(map[string]bool),
+	}
+	entries, err := p.plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	var hits, unknowns int
+	for _, e := range entries {
+		verb := "rebuild"
+		if e.Hit {
+			verb = "hit"
+			hits++
+		} else if e.Unknown {
+			verb = "unknown"
+			unknowns++
+		}
+		name := e.Name
+		if e.Platform != "" {
+			name += " (" + e.Platform + ")"
+		}
+		digest := e.Digest
+		if digest == "" {
+			digest = "-"
+		}
+		fmt.Fprintf(w, "%s %s %s (%s)\n", verb, name, digest, e.Reason)
+	}
+	fmt.Fprintf(w, "%d cache hits, %d rebuilds", hits, len(entries)-hits)
+	if unknowns > 0 {
+		fmt.Fprintf(w, " (%d unknown)", unknowns)
+	}
+	fmt.Fprintln(w)
+	return nil
+}
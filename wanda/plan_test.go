@@ -0,0 +1,204 @@
+package wanda
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	cranev1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestPlan(t *testing.T) {
+	server := httptest.NewServer(registry.New(
+		registry.Logger(log.New(io.Discard, "", 0)),
+	))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	writeSpec(t, tmpDir, "base.Dockerfile", "FROM scratch\nCOPY base.txt /\n")
+	writeSpec(t, tmpDir, "base.txt", "base\n")
+	writeSpec(t, tmpDir, "base.wanda.yaml", strings.Join([]string{
+		"name: base",
+		"dockerfile: base.Dockerfile",
+		"srcs: [base.txt]",
+	}, "\n"))
+	writeSpec(t, tmpDir, "app.Dockerfile", "FROM "+testPrefix+"base\nCOPY app.txt /\n")
+	writeSpec(t, tmpDir, "app.txt", "app\n")
+	appFile := writeSpec(t, tmpDir, "app.wanda.yaml", strings.Join([]string{
+		"name: app",
+		"froms: [" + testPrefix + "base]",
+		"dockerfile: app.Dockerfile",
+		"srcs: [app.txt]",
+	}, "\n"))
+
+	config := &ForgeConfig{
+		WorkDir:        tmpDir,
+		WorkRepo:       server.Listener.Addr().String() + "/work",
+		NamePrefix:     testPrefix,
+		BuildID:        "b1",
+		WandaSpecsFile: writeWandaSpecs(t, tmpDir, []string{"."}),
+	}
+
+	plan := func() []string {
+		t.Helper()
+		var buf strings.Builder
+		if err := Plan(t.Context(), appFile, config, &buf); err != nil {
+			t.Fatalf("plan: %v", err)
+		}
+		return strings.Split(strings.TrimSpace(buf.String()), "\n")
+	}
+
+	got := plan()
+	want := []string{
+		"rebuild base " + fieldOf(got[0], 2) + " (missing cache tag)",
+		"rebuild app - (upstream base is rebuilt)",
+		"0 cache hits, 2 rebuilds",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("plan = %q, want %q", got, want)
+	}
+	baseDigest := fieldOf(got[0], 2)
+
+	pushRandom := func(tag string) cranev1.Image {
+		t.Helper()
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatalf("create random image: %v", err)
+		}
+		if err := remote.Write(mustNewTag(t, tag), img); err != nil {
+			t.Fatalf("push image: %v", err)
+		}
+		return img
+	}
+
+	// The work tag of base still has the image of an older build; the plan
+	// must digest app with the cache hit of base instead.
+	pushRandom(config.workTag("base"))
+	baseImg := pushRandom(config.cacheTag(baseDigest))
+
+	got = plan()
+	if len(got) != 3 {
+		t.Fatalf("plan = %q, want 3 lines", got)
+	}
+	if want := "hit base " + baseDigest + " (cache hit)"; got[0] != want {
+		t.Errorf("base = %q, want %q", got[0], want)
+	}
+	appDigest := fieldOf(got[1], 2)
+	if want := "rebuild app " + appDigest + " (missing cache tag)"; got[1] != want {
+		t.Errorf("app = %q, want %q", got[1], want)
+	}
+
+	// A build tags the cache hit of base as its work tag, and app is then
+	// digested the same way as in the plan.
+	if err := remote.Write(mustNewTag(t, config.workTag("base")), baseImg); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+	var buf strings.Builder
+	if err := Digest(t.Context(), appFile, config, &buf); err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	if d := strings.TrimSpace(buf.String()); d != appDigest {
+		t.Errorf("planned app digest = %s, want %s", appDigest, d)
+	}
+
+	pushRandom(config.cacheTag(appDigest))
+	got = plan()
+	if want := "2 cache hits, 0 rebuilds"; got[2] != want {
+		t.Errorf("summary = %q, want %q", got[2], want)
+	}
+
+	config.Rebuild = true
+	got = plan()
+	want = []string{
+		"rebuild base " + baseDigest + " (-rebuild)",
+		"rebuild app - (upstream base is rebuilt)",
+		"0 cache hits, 2 rebuilds",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("plan with rebuild = %q, want %q", got, want)
+	}
+}
+
+func TestPlan_disableCaching(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeSpec(t, tmpDir, "Dockerfile", "FROM scratch\nCOPY hello.txt /\n")
+	writeSpec(t, tmpDir, "hello.txt", "hello\n")
+	specFile := writeSpec(t, tmpDir, "hello.wanda.yaml", strings.Join([]string{
+		"name: hello",
+		"dockerfile: Dockerfile",
+		"srcs: [hello.txt]",
+		"disable_caching: true",
+	}, "\n"))
+
+	config := &ForgeConfig{
+		WorkDir:        tmpDir,
+		WorkRepo:       "localhost:5000/work",
+		WandaSpecsFile: writeWandaSpecs(t, tmpDir, []string{"."}),
+	}
+	var buf strings.Builder
+	if err := Plan(t.Context(), specFile, config, &buf); err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(got) != 2 || !strings.HasSuffix(got[0], " (disable_caching)") {
+		t.Errorf("plan = %q, want hello rebuilt for disable_caching", got)
+	}
+}
+
+func TestPlan_registryError(t *testing.T) {
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	writeSpec(t, tmpDir, "Dockerfile", "FROM scratch\nCOPY hello.txt /\n")
+	writeSpec(t, tmpDir, "hello.txt", "hello\n")
+	specFile := writeSpec(t, tmpDir, "hello.wanda.yaml", strings.Join([]string{
+		"name: hello",
+		"dockerfile: Dockerfile",
+		"srcs: [hello.txt]",
+	}, "\n"))
+
+	config := &ForgeConfig{
+		WorkDir:        tmpDir,
+		WorkRepo:       server.Listener.Addr().String() + "/work",
+		WandaSpecsFile: writeWandaSpecs(t, tmpDir, []string{"."}),
+		RetryAttempts:  2,
+		RetryBackoff:   time.Millisecond,
+	}
+	var buf strings.Builder
+	if err := Plan(t.Context(), specFile, config, &buf); err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(got) != 2 || !strings.HasPrefix(got[0], "unknown hello ") ||
+		!strings.Contains(got[0], "(miss, error: ") {
+		t.Errorf("plan = %q, want hello unknown with the error", got)
+	}
+	if want := "0 cache hits, 1 rebuilds (1 unknown)"; len(got) == 2 && got[1] != want {
+		t.Errorf("summary = %q, want %q", got[1], want)
+	}
+}
+
+// fieldOf returns the i-th space separated field of s.
+func fieldOf(s string, i int) string {
+	fields := strings.Fields(s)
+	if i >= len(fields) {
+		return ""
+	}
+	return fields[i]
+}
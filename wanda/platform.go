@@ -0,0 +1,146 @@
+package wanda
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+
+	crane "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// platform is a target platform of a container image, such as linux/arm64.
+type platform struct {
+	OS   string
+	Arch string
+}
+
+// hostPlatform returns the platform that images are built for by default.
+func hostPlatform() *platform {
+	return &platform{OS: targetOS(), Arch: runtime.GOARCH}
+}
+
+// parsePlatform parses an "os/arch" string.
+func parsePlatform(s string) (*platform, error) {
+	osName, arch, ok := strings.Cut(s, "/")
+	if !ok || osName == "" || arch == "" || strings.Contains(arch, "/") {
+		return nil, fmt.Errorf("platform %q: expected os/arch format", s)
+	}
+	return &platform{OS: osName, Arch: arch}, nil
+}
+
+// parsePlatforms parses the platforms of a spec, rejecting duplicates.
+func parsePlatforms(platforms []string) ([]*platform, error) {
+	var result []*platform
+	seen := make(map[string]bool)
+	for _, s := range platforms {
+		p, err := parsePlatform(s)
+		if err != nil {
+			return nil, err
+		}
+		if seen[p.String()] {
+			return nil, fmt.Errorf("duplicate platform %q", s)
+		}
+		seen[p.String()] = true
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+func (p *platform) String() string { return p.OS + "/" + p.Arch }
+
+// imageName returns the name of the image of spec name built for p.
+// e.g. "forge" built for linux/arm64 is "forge-linux-arm64".
+func (p *platform) imageName(name string) string {
+	return name + "-" + p.OS + "-" + p.Arch
+}
+
+func (p *platform) cranePlatform() crane.Platform {
+	return crane.Platform{OS: p.OS, Architecture: p.Arch}
+}
+
+// remoteOptsFor returns the remote options for registry requests made
+// under ctx, resolving images for p. A nil p means the host platform.
+func (f *Forge) remoteOptsFor(ctx context.Context, p *platform) []remote.Option {
+	opts := append(slices.Clone(f.remoteOpts), remote.WithContext(ctx))
+	if p == nil {
+		return opts
+	}
+	// Later options override the host platform set in NewForge.
+	return append(opts, remote.WithPlatform(p.cranePlatform()))
+}
+
+// selectPlatforms returns the platforms of a multi-platform spec that are
+// built in this run. If the config selects a platform, only that one is
+// built; otherwise all the spec's platforms are.
+func (f *Forge) selectPlatforms(spec *Spec) ([]*platform, error) {
+	platforms, err := parsePlatforms(spec.Platforms)
+	if err != nil {
+		return nil, err
+	}
+	if f.config.Platform == "" {
+		return platforms, nil
+	}
+
+	want, err := parsePlatform(f.config.Platform)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range platforms {
+		if *p == *want {
+			return []*platform{p}, nil
+		}
+	}
+	return nil, fmt.Errorf(
+		"platform %s is not one of the platforms of %s: %s",
+		want, spec.Name, strings.Join(spec.Platforms, ", "),
+	)
+}
+
+// buildPlatforms builds a multi-platform spec once for every selected
+// platform. It reports whether all of the builds were cache hits.
+func (f *Forge) buildPlatforms(ctx context.Context, spec *Spec, out *buildOutput) (bool, error) {
+	platforms, err := f.selectPlatforms(spec)
+	if err != nil {
+		return false, err
+	}
+
+	allHit := true
+	for _, p := range platforms {
+		out.log.Printf("building %s for %s", spec.Name, p)
+		hit, err := f.buildPlatform(ctx, spec, p, out)
+		if err != nil {
+			return false, fmt.Errorf("build for %s: %w", p, err)
+		}
+		allHit = allHit && hit
+	}
+	return allHit, nil
+}
+
+// artifactsImageTag returns the work tag of the image to extract the
+// artifacts of spec from. For a multi-platform spec, this is the only
+// platform built, or otherwise the host platform.
+func (f *Forge) artifactsImageTag(spec *Spec) (string, error) {
+	if len(spec.Platforms) == 0 {
+		return f.workTag(spec.Name), nil
+	}
+
+	platforms, err := f.selectPlatforms(spec)
+	if err != nil {
+		return "", err
+	}
+	if len(platforms) == 1 {
+		return f.workTag(platforms[0].imageName(spec.Name)), nil
+	}
+	host := hostPlatform()
+	for _, p := range platforms {
+		if *p == *host {
+			return f.workTag(p.imageName(spec.Name)), nil
+		}
+	}
+	return "", fmt.Errorf(
+		"%s is not built for host platform %s; select a platform", spec.Name, host,
+	)
+}
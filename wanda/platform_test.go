@@ -0,0 +1,124 @@
+package wanda
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want *platform
+	}{
+		{"linux/amd64", &platform{OS: "linux", Arch: "amd64"}},
+		{"linux/arm64", &platform{OS: "linux", Arch: "arm64"}},
+		{"windows/amd64", &platform{OS: "windows", Arch: "amd64"}},
+	} {
+		got, err := parsePlatform(test.in)
+		if err != nil {
+			t.Errorf("parsePlatform(%q): %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parsePlatform(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+		if got.String() != test.in {
+			t.Errorf("String() = %q, want %q", got.String(), test.in)
+		}
+	}
+
+	for _, bad := range []string{"", "linux", "/amd64", "linux/", "linux/arm/v7"} {
+		if _, err := parsePlatform(bad); err == nil {
+			t.Errorf("parsePlatform(%q): got nil error", bad)
+		}
+	}
+}
+
+func TestParsePlatforms_duplicate(t *testing.T) {
+	if _, err := parsePlatforms([]string{"linux/amd64", "linux/amd64"}); err == nil {
+		t.Error("parsePlatforms with duplicates: got nil error")
+	}
+}
+
+func TestPlatformImageName(t *testing.T) {
+	p := &platform{OS: "linux", Arch: "arm64"}
+	if got, want := p.imageName("forge"), "forge-linux-arm64"; got != want {
+		t.Errorf("imageName() = %q, want %q", got, want)
+	}
+}
+
+func TestSelectPlatforms(t *testing.T) {
+	spec := &Spec{
+		Name:      "multi",
+		Platforms: []string{"linux/amd64", "linux/arm64"},
+	}
+
+	all, err := (&Forge{config: &ForgeConfig{}}).selectPlatforms(spec)
+	if err != nil {
+		t.Fatalf("select all platforms: %v", err)
+	}
+	if len(all) != 2 {
+		t.Errorf("got %d platforms, want 2", len(all))
+	}
+
+	f := &Forge{config: &ForgeConfig{Platform: "linux/arm64"}}
+	one, err := f.selectPlatforms(spec)
+	if err != nil {
+		t.Fatalf("select arm64: %v", err)
+	}
+	want := []*platform{{OS: "linux", Arch: "arm64"}}
+	if !reflect.DeepEqual(one, want) {
+		t.Errorf("got %+v, want %+v", one, want)
+	}
+
+	f = &Forge{config: &ForgeConfig{Platform: "windows/amd64"}}
+	if _, err := f.selectPlatforms(spec); err == nil {
+		t.Error("select platform not in spec: got nil error")
+	}
+}
+
+func TestBuildInputCore_platform(t *testing.T) {
+	ts := newTarStream()
+	ts.addFile("Dockerfile.hello", nil, "testdata/Dockerfile.hello")
+
+	hostCore, err := newBuildInput(ts, nil).makeCore("Dockerfile.hello", nil)
+	if err != nil {
+		t.Fatalf("make host core: %v", err)
+	}
+	hostDigest, err := hostCore.digest()
+	if err != nil {
+		t.Fatalf("host digest: %v", err)
+	}
+
+	digests := make(map[string]string)
+	for _, p := range []*platform{
+		{OS: "linux", Arch: "amd64"},
+		{OS: "linux", Arch: "arm64"},
+	} {
+		in := newBuildInput(ts, nil)
+		in.platform = p
+		core, err := in.makeCore("Dockerfile.hello", nil)
+		if err != nil {
+			t.Fatalf("make core for %s: %v", p, err)
+		}
+		d, err := core.digest()
+		if err != nil {
+			t.Fatalf("digest for %s: %v", p, err)
+		}
+		digests[p.String()] = d
+	}
+
+	if digests["linux/amd64"] == digests["linux/arm64"] {
+		t.Errorf("same digest for amd64 and arm64: %q", digests["linux/amd64"])
+	}
+
+	// The host platform shares the cache with the explicit platform.
+	host := hostPlatform().String()
+	if d, ok := digests[host]; ok && d != hostDigest {
+		t.Errorf("%s digest = %q, want host digest %q", host, d, hostDigest)
+	}
+	if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" && hostCore.Platform != "" {
+		t.Errorf("host core platform = %q, want empty", hostCore.Platform)
+	}
+}
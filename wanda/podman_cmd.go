@@ -0,0 +1,133 @@
+package wanda
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// podmanCmd runs podman, which builds images with buildah and needs no
+// daemon, so that images can also be built on rootless runners. Its CLI
+// mostly follows docker's; the differences are handled here.
+type podmanCmd struct {
+	*dockerCmd
+}
+
+func newPodmanCmd(bin string) *podmanCmd {
+	if bin == "" {
+		bin = "podman"
+	}
+	return &podmanCmd{dockerCmd: &dockerCmd{
+		bin: bin,
+		envs: cmdEnvs(
+			"HOME",
+			"USER",
+			"PATH",
+			"XDG_RUNTIME_DIR",
+			"REGISTRY_AUTH_FILE",
+			"CONTAINERS_CONF",
+			"CONTAINERS_REGISTRIES_CONF",
+			"CONTAINERS_STORAGE_CONF",
+			"AWS_REGION",
+		),
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+		logger: log.Default(),
+	}}
+}
+
+// inspectImage returns the image with the given tag, or nil if it is not in
+// the local store. podman image inspect fails the same way for a missing
+// image as for other errors, so podman image exists tells them apart.
+func (c *podmanCmd) inspectImage(ctx context.Context, tag string) (*dockerImageInfo, error) {
+	err := c.run(ctx, "image", "exists", tag)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	info, err := c.dockerCmd.inspectImage(ctx, tag)
+	if err != nil || info == nil {
+		return info, err
+	}
+	// podman leaves out the algorithm of image IDs, docker does not.
+	if !strings.HasPrefix(info.ID, "sha256:") {
+		info.ID = "sha256:" + info.ID
+	}
+	return info, nil
+}
+
+// build builds the image with podman build. podman cannot read the build
+// context as a tar stream from stdin, so it is written out to a temporary
+// directory first.
+func (c *podmanCmd) build(
+	ctx context.Context, in *buildInput, core *buildInputCore, hints *buildInputHints,
+) error {
+	if core.ContextOwner != "" {
+		return fmt.Errorf("context_owner is not supported by podman")
+	}
+
+	if err := c.pullFroms(ctx, in, core); err != nil {
+		return err
+	}
+
+	contextDir, err := os.MkdirTemp("", "wanda-context-")
+	if err != nil {
+		return fmt.Errorf("create context dir: %w", err)
+	}
+	defer os.RemoveAll(contextDir)
+
+	if in.context != nil {
+		if err := writeContextDir(in.context, contextDir); err != nil {
+			return fmt.Errorf("write build context: %w", err)
+		}
+	}
+
+	flags, secretEnvs := buildFlags(enginePodman, in, core, hints)
+	args := slices.Concat([]string{"build"}, flags, []string{contextDir})
+
+	c.logger.Printf("podman %s", strings.Join(redactSecretArgs(args), " "))
+
+	buildCmd := c.cmd(ctx, args...)
+	buildCmd.Env = slices.Concat(buildCmd.Env, secretEnvs)
+	return buildCmd.Run()
+}
+
+// writeContextDir writes the files of the build context stream ts into dir,
+// as they would be extracted from the tar stream.
+func writeContextDir(ts *tarStream, dir string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	r := newWriterToReader(ts)
+	defer r.r.Close() // Stops writing the stream on an early return.
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("file %q is outside of the build context", hdr.Name)
+		}
+		if err := extractTarEntry(root, hdr, tr, filepath.FromSlash(hdr.Name), nil); err != nil {
+			return fmt.Errorf("write %s: %w", hdr.Name, err)
+		}
+	}
+}
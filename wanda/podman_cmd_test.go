@@ -0,0 +1,160 @@
+package wanda
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckEngine(t *testing.T) {
+	for _, name := range []string{"", "docker", "podman"} {
+		if err := checkEngine(name); err != nil {
+			t.Errorf("checkEngine(%q): %v", name, err)
+		}
+	}
+	if err := checkEngine("nerdctl"); err == nil {
+		t.Error("checkEngine(nerdctl): got nil error")
+	}
+
+	if _, err := NewForge(&ForgeConfig{Engine: "nerdctl"}); err == nil {
+		t.Error("NewForge with unknown engine: got nil error")
+	}
+}
+
+func TestForgeNewEngine(t *testing.T) {
+	f := &Forge{config: &ForgeConfig{Engine: enginePodman}}
+	p, ok := f.newEngine().(*podmanCmd)
+	if !ok {
+		t.Fatalf("newEngine() = %T, want *podmanCmd", f.newEngine())
+	}
+	if p.bin != "podman" {
+		t.Errorf("podman bin = %q, want podman", p.bin)
+	}
+
+	f = &Forge{config: &ForgeConfig{}}
+	if _, ok := f.newEngine().(*dockerCmd); !ok {
+		t.Errorf("newEngine() = %T, want *dockerCmd", f.newEngine())
+	}
+}
+
+func TestWriteContextDir(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(src, "run.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	readme := filepath.Join(src, "README")
+	if err := os.WriteFile(readme, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTarStream()
+	ts.addFile("bin/run.sh", nil, script)
+	ts.addFile("docs/README", nil, readme)
+
+	dir := filepath.Join(tmp, "context")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeContextDir(ts, dir); err != nil {
+		t.Fatalf("writeContextDir: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "docs", "README"))
+	if err != nil {
+		t.Fatalf("read README: %v", err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("README = %q, want %q", got, "hello\n")
+	}
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(dir, "bin", "run.sh"))
+		if err != nil {
+			t.Fatalf("stat run.sh: %v", err)
+		}
+		if mode := info.Mode().Perm(); mode != 0755 {
+			t.Errorf("run.sh mode = %o, want 755", mode)
+		}
+	}
+}
+
+func TestPodmanCmdBuild_contextOwner(t *testing.T) {
+	cmd := newPodmanCmd("")
+	in := newBuildInput(newTarStream(), nil)
+	core := &buildInputCore{ContextOwner: "1000:1000"}
+
+	err := cmd.build(t.Context(), in, core, nil)
+	if err == nil || !strings.Contains(err.Error(), "context_owner") {
+		t.Errorf("build() = %v, want context_owner error", err)
+	}
+}
+
+func TestPodmanCmdBuild_args(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the podman binary")
+	}
+	tmp := t.TempDir()
+	argsFile := filepath.Join(tmp, "args")
+	bin := filepath.Join(tmp, "podman")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > " + argsFile + "\n"
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := newPodmanCmd(bin)
+	in := newBuildInput(newTarStream(), nil)
+	in.addTag("cr.ray.io/rayproject/hello")
+	core := &buildInputCore{Dockerfile: "Dockerfile", Target: "final"}
+	if err := cmd.build(t.Context(), in, core, nil); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	bs, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read podman args: %v", err)
+	}
+	args := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	want := []string{
+		"build",
+		"-f", "Dockerfile",
+		"--target", "final",
+		"-t", "cr.ray.io/rayproject/hello",
+	}
+	if len(args) != len(want)+1 || !slices.Equal(args[:len(want)], want) {
+		t.Fatalf("podman args = %q, want %q and the context dir", args, want)
+	}
+	if slices.Contains(args, "--add-host") {
+		t.Errorf("podman args = %q, has docker's --add-host", args)
+	}
+	if !strings.HasPrefix(filepath.Base(args[len(want)]), "wanda-context-") {
+		t.Errorf("podman context dir = %q, want a temporary dir", args[len(want)])
+	}
+}
+
+func TestPodmanCmdInspectImage_missing(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses false as the podman binary")
+	}
+	bin, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip("false not found")
+	}
+	cmd := newPodmanCmd(bin)
+
+	info, err := cmd.inspectImage(t.Context(), "missing:latest")
+	if err != nil {
+		t.Fatalf("inspectImage: %v", err)
+	}
+	if info != nil {
+		t.Errorf("inspectImage() = %+v, want nil", info)
+	}
+}
@@ -0,0 +1,357 @@
+package wanda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
+	crane "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Labels and annotations that wanda puts on the images it builds.
+const (
+	labelRevision    = "org.opencontainers.image.revision"
+	labelInputDigest = "io.ray.wanda.input-digest"
+	labelSpec        = "io.ray.wanda.spec"
+	labelEpochPolicy = "io.ray.wanda.cache-epoch-policy"
+)
+
+// Media and predicate types of provenance attestations.
+const (
+	inTotoStatementType  = "https://in-toto.io/Statement/v1"
+	inTotoMediaType      = "application/vnd.in-toto+json"
+	slsaPredicateType    = "https://slsa.dev/provenance/v1"
+	wandaBuildType       = "https://github.com/ray-project/rayci/wanda/v1"
+	wandaBuilderID       = "https://github.com/ray-project/rayci/wanda"
+	ociEmptyMediaType    = "application/vnd.oci.empty.v1+json"
+	predicateTypeAnnoKey = "in-toto.io/predicate-type"
+)
+
+// gitCommit is the git commit that images are built from. It is looked up
+// at most once.
+type gitCommit struct {
+	once sync.Once
+	sha  string
+}
+
+// gitCommit returns the git commit of the build: GitCommit in the config,
+// or else the HEAD commit of the work dir. It is empty when neither is
+// known.
+func (f *Forge) gitCommit(ctx context.Context) string {
+	f.commit.once.Do(func() {
+		if f.config.GitCommit != "" {
+			f.commit.sha = f.config.GitCommit
+			return
+		}
+		cmd := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+		cmd.Dir = f.workDir
+		out, err := cmd.Output()
+		if err != nil {
+			return // Not a git checkout, or no git; leave it out.
+		}
+		f.commit.sha = strings.TrimSpace(string(out))
+	})
+	return f.commit.sha
+}
+
+// imageLabels returns the labels of the image of spec built from the input
+// with the given digest. Labels are not part of the build input, so they
+// never change the digest.
+//
+// The cache epoch policy is only labeled when it names a policy, so that
+// gc can count the epochs of the image in it.
+func (f *Forge) imageLabels(ctx context.Context, spec *Spec, inputDigest string) map[string]string {
+	labels := map[string]string{
+		labelInputDigest: inputDigest,
+		labelSpec:        spec.Name,
+	}
+	switch policy := f.cacheEpoch(spec).Policy; policy {
+	case epochDaily, epochWeekly, epochMonthly, epochNever:
+		labels[labelEpochPolicy] = policy
+	}
+	if commit := f.gitCommit(ctx); commit != "" {
+		labels[labelRevision] = commit
+	}
+	return labels
+}
+
+// indexAnnotations returns the annotations of the image index of spec.
+func (f *Forge) indexAnnotations(ctx context.Context, spec *Spec) map[string]string {
+	annotations := map[string]string{labelSpec: spec.Name}
+	if commit := f.gitCommit(ctx); commit != "" {
+		annotations[labelRevision] = commit
+	}
+	return annotations
+}
+
+// labelArgs returns the docker build flags that set labels, in key order.
+func labelArgs(labels map[string]string) []string {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, k := range keys {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", k, labels[k]))
+	}
+	return args
+}
+
+// inTotoStatement is an in-toto attestation statement.
+type inTotoStatement struct {
+	Type          string                `json:"_type"`
+	Subject       []*resourceDescriptor `json:"subject"`
+	PredicateType string                `json:"predicateType"`
+	Predicate     *slsaProvenance       `json:"predicate"`
+}
+
+// resourceDescriptor describes an artifact in a provenance statement.
+type resourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// slsaProvenance is a SLSA v1 provenance predicate.
+type slsaProvenance struct {
+	BuildDefinition *slsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      *slsaRunDetails      `json:"runDetails"`
+}
+
+type slsaBuildDefinition struct {
+	BuildType            string                `json:"buildType"`
+	ExternalParameters   *provenanceParameters `json:"externalParameters"`
+	InternalParameters   *provenanceInternals  `json:"internalParameters"`
+	ResolvedDependencies []*resourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+// provenanceParameters are the inputs of a build that the user controls.
+type provenanceParameters struct {
+	Spec     string `json:"spec"`
+	Platform string `json:"platform,omitempty"`
+	Revision string `json:"revision,omitempty"`
+}
+
+// provenanceInternals are the inputs of a build that wanda resolves.
+type provenanceInternals struct {
+	InputDigest string          `json:"inputDigest"`
+	Input       *buildInputCore `json:"input"`
+}
+
+type slsaRunDetails struct {
+	Builder  *slsaBuilder  `json:"builder"`
+	Metadata *slsaMetadata `json:"metadata"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+type slsaMetadata struct {
+	InvocationID string    `json:"invocationId,omitempty"`
+	StartedOn    time.Time `json:"startedOn"`
+	FinishedOn   time.Time `json:"finishedOn"`
+}
+
+// digestMap turns a "sha256:<hex>" digest into an in-toto digest set.
+func digestMap(d string) map[string]string {
+	algo, hex, ok := strings.Cut(d, ":")
+	if !ok {
+		return map[string]string{"sha256": d}
+	}
+	return map[string]string{algo: hex}
+}
+
+// provenanceBuild is the record of a finished build that provenance is
+// made for.
+type provenanceBuild struct {
+	spec        *Spec
+	platform    *platform
+	core        *buildInputCore
+	inputDigest string
+	started     time.Time
+	finished    time.Time
+}
+
+// newProvenanceStatement returns the SLSA provenance statement of the
+// image with the given digest in repo, built by b.
+func (f *Forge) newProvenanceStatement(
+	ctx context.Context, repo string, image crane.Hash, b *provenanceBuild,
+) *inTotoStatement {
+	params := &provenanceParameters{
+		Spec:     b.spec.Name,
+		Revision: f.gitCommit(ctx),
+	}
+	if b.platform != nil {
+		params.Platform = b.platform.String()
+	}
+
+	var froms []string
+	for from := range b.core.Froms {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+
+	var deps []*resourceDescriptor
+	for _, from := range froms {
+		if isDockerScratch(from) {
+			continue
+		}
+		deps = append(deps, &resourceDescriptor{
+			Name:   from,
+			Digest: digestMap(b.core.Froms[from]),
+		})
+	}
+	if b.core.BuildContext != "" {
+		deps = append(deps, &resourceDescriptor{
+			Name:   "context",
+			Digest: digestMap(b.core.BuildContext),
+		})
+	}
+	if params.Revision != "" {
+		deps = append(deps, &resourceDescriptor{
+			Name:   "source",
+			Digest: map[string]string{"gitCommit": params.Revision},
+		})
+	}
+
+	return &inTotoStatement{
+		Type: inTotoStatementType,
+		Subject: []*resourceDescriptor{{
+			Name:   repo,
+			Digest: digestMap(image.String()),
+		}},
+		PredicateType: slsaPredicateType,
+		Predicate: &slsaProvenance{
+			BuildDefinition: &slsaBuildDefinition{
+				BuildType:          wandaBuildType,
+				ExternalParameters: params,
+				InternalParameters: &provenanceInternals{
+					InputDigest: b.inputDigest,
+					Input:       b.core,
+				},
+				ResolvedDependencies: deps,
+			},
+			RunDetails: &slsaRunDetails{
+				Builder: &slsaBuilder{ID: wandaBuilderID},
+				Metadata: &slsaMetadata{
+					InvocationID: f.config.BuildID,
+					StartedOn:    b.started.UTC(),
+					FinishedOn:   b.finished.UTC(),
+				},
+			},
+		},
+	}
+}
+
+// artifactManifest is an OCI image manifest of an artifact that refers to
+// a subject image.
+type artifactManifest struct {
+	SchemaVersion int64              `json:"schemaVersion"`
+	MediaType     types.MediaType    `json:"mediaType"`
+	ArtifactType  string             `json:"artifactType"`
+	Config        crane.Descriptor   `json:"config"`
+	Layers        []crane.Descriptor `json:"layers"`
+	Subject       *crane.Descriptor  `json:"subject"`
+}
+
+// rawManifest is a manifest that is pushed as is.
+type rawManifest struct {
+	raw       []byte
+	mediaType types.MediaType
+}
+
+func (m *rawManifest) RawManifest() ([]byte, error)        { return m.raw, nil }
+func (m *rawManifest) MediaType() (types.MediaType, error) { return m.mediaType, nil }
+
+// pushProvenance pushes the SLSA provenance of the image at workTag, built
+// by b, as an OCI artifact that refers to the image. Registries without the
+// referrers API get the artifact through the referrers tag schema.
+func (f *Forge) pushProvenance(
+	ctx context.Context, workTag string, b *provenanceBuild, out *buildOutput,
+) error {
+	ref, err := cranename.NewTag(workTag)
+	if err != nil {
+		return fmt.Errorf("parse work tag %q: %w", workTag, err)
+	}
+	desc, err := remote.Head(ref, f.remoteOptsFor(ctx, nil)...)
+	if err != nil {
+		return fmt.Errorf("get pushed image: %w", err)
+	}
+	repo := ref.Context()
+
+	statement := f.newProvenanceStatement(ctx, repo.Name(), desc.Digest, b)
+	bs, err := json.Marshal(statement)
+	if err != nil {
+		return fmt.Errorf("encode provenance: %w", err)
+	}
+
+	config := static.NewLayer([]byte("{}"), ociEmptyMediaType)
+	layer := static.NewLayer(bs, inTotoMediaType)
+	for _, blob := range []crane.Layer{config, layer} {
+		if err := remote.WriteLayer(repo, blob, f.remoteOptsFor(ctx, nil)...); err != nil {
+			return fmt.Errorf("push provenance blob: %w", err)
+		}
+	}
+
+	configDesc, err := blobDescriptor(config, ociEmptyMediaType)
+	if err != nil {
+		return err
+	}
+	layerDesc, err := blobDescriptor(layer, inTotoMediaType)
+	if err != nil {
+		return err
+	}
+	layerDesc.Annotations = map[string]string{predicateTypeAnnoKey: slsaPredicateType}
+
+	manifest := &artifactManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		ArtifactType:  inTotoMediaType,
+		Config:        *configDesc,
+		Layers:        []crane.Descriptor{*layerDesc},
+		Subject: &crane.Descriptor{
+			MediaType: desc.MediaType,
+			Digest:    desc.Digest,
+			Size:      desc.Size,
+		},
+	}
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("encode provenance manifest: %w", err)
+	}
+	digest, _, err := crane.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("digest provenance manifest: %w", err)
+	}
+
+	m := &rawManifest{raw: raw, mediaType: types.OCIManifestSchema1}
+	if err := remote.Put(repo.Digest(digest.String()), m, f.remoteOptsFor(ctx, nil)...); err != nil {
+		return fmt.Errorf("push provenance manifest: %w", err)
+	}
+	out.log.Printf("pushed provenance %s for %s", digest, desc.Digest)
+	return nil
+}
+
+func blobDescriptor(l crane.Layer, mediaType types.MediaType) (*crane.Descriptor, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("digest blob: %w", err)
+	}
+	size, err := l.Size()
+	if err != nil {
+		return nil, fmt.Errorf("size of blob: %w", err)
+	}
+	return &crane.Descriptor{MediaType: mediaType, Digest: digest, Size: size}, nil
+}
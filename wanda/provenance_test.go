@@ -0,0 +1,180 @@
+package wanda
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestLabelArgs(t *testing.T) {
+	got := labelArgs(map[string]string{
+		labelSpec:        "hello",
+		labelInputDigest: "sha256:abc",
+		labelRevision:    "0123abcd",
+	})
+	want := []string{
+		"--label", "io.ray.wanda.input-digest=sha256:abc",
+		"--label", "io.ray.wanda.spec=hello",
+		"--label", "org.opencontainers.image.revision=0123abcd",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("labelArgs() = %q, want %q", got, want)
+	}
+
+	if got := labelArgs(nil); len(got) != 0 {
+		t.Errorf("labelArgs(nil) = %q, want empty", got)
+	}
+}
+
+func TestImageLabels(t *testing.T) {
+	forge, err := NewForge(&ForgeConfig{WorkDir: "testdata", GitCommit: "0123abcd"})
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+
+	got := forge.imageLabels(t.Context(), &Spec{Name: "hello"}, "sha256:abc")
+	want := map[string]string{
+		labelInputDigest: "sha256:abc",
+		labelSpec:        "hello",
+		labelRevision:    "0123abcd",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("imageLabels() = %v, want %v", got, want)
+	}
+
+	got = forge.imageLabels(t.Context(), &Spec{Name: "hello", CacheEpoch: "daily"}, "sha256:abc")
+	if policy := got[labelEpochPolicy]; policy != "daily" {
+		t.Errorf("imageLabels() epoch policy = %q, want %q", policy, "daily")
+	}
+}
+
+func TestPushProvenance(t *testing.T) {
+	for _, referrers := range []bool{true, false} {
+		t.Run(fmt.Sprintf("referrers=%t", referrers), func(t *testing.T) {
+			server := httptest.NewServer(registry.New(
+				registry.WithReferrersSupport(referrers),
+				registry.Logger(log.New(io.Discard, "", 0)),
+			))
+			defer server.Close()
+
+			config := &ForgeConfig{
+				WorkDir:   "testdata",
+				WorkRepo:  fmt.Sprintf("%s/work", server.Listener.Addr().String()),
+				BuildID:   "b1",
+				GitCommit: "0123abcd",
+			}
+			forge, err := NewForge(config)
+			if err != nil {
+				t.Fatalf("make forge: %v", err)
+			}
+
+			img, err := random.Image(256, 1)
+			if err != nil {
+				t.Fatalf("create random image: %v", err)
+			}
+			workTag := config.workTag("hello")
+			if err := remote.Write(mustNewTag(t, workTag), img); err != nil {
+				t.Fatalf("push image: %v", err)
+			}
+			imgDigest, err := img.Digest()
+			if err != nil {
+				t.Fatalf("image digest: %v", err)
+			}
+
+			started := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+			b := &provenanceBuild{
+				spec: &Spec{Name: "hello"},
+				core: &buildInputCore{
+					Dockerfile:   "Dockerfile",
+					Froms:        map[string]string{"ubuntu:22.04": "sha256:1234"},
+					BuildContext: "sha256:5678",
+				},
+				inputDigest: "sha256:9abc",
+				started:     started,
+				finished:    started.Add(time.Minute),
+			}
+			if err := forge.pushProvenance(t.Context(), workTag, b, defaultBuildOutput()); err != nil {
+				t.Fatalf("pushProvenance: %v", err)
+			}
+
+			subject := mustNewDigest(t, config.workRepo(), imgDigest)
+			index, err := remote.Referrers(subject)
+			if err != nil {
+				t.Fatalf("list referrers: %v", err)
+			}
+			manifest, err := index.IndexManifest()
+			if err != nil {
+				t.Fatalf("read referrers: %v", err)
+			}
+			if len(manifest.Manifests) != 1 {
+				t.Fatalf("got %d referrers, want 1", len(manifest.Manifests))
+			}
+
+			ref := mustNewDigest(t, config.workRepo(), manifest.Manifests[0].Digest)
+			artifact, err := remote.Image(ref)
+			if err != nil {
+				t.Fatalf("fetch provenance: %v", err)
+			}
+			layers, err := artifact.Layers()
+			if err != nil {
+				t.Fatalf("provenance layers: %v", err)
+			}
+			if len(layers) != 1 {
+				t.Fatalf("got %d provenance layers, want 1", len(layers))
+			}
+			rc, err := layers[0].Uncompressed()
+			if err != nil {
+				t.Fatalf("read provenance: %v", err)
+			}
+			defer rc.Close()
+
+			statement := new(inTotoStatement)
+			if err := json.NewDecoder(rc).Decode(statement); err != nil {
+				t.Fatalf("decode provenance: %v", err)
+			}
+			if statement.Type != inTotoStatementType ||
+				statement.PredicateType != slsaPredicateType {
+				t.Errorf("statement has type %q and predicate type %q",
+					statement.Type, statement.PredicateType)
+			}
+			wantSubject := []*resourceDescriptor{{
+				Name:   config.workRepo(),
+				Digest: map[string]string{"sha256": imgDigest.Hex},
+			}}
+			if !reflect.DeepEqual(statement.Subject, wantSubject) {
+				t.Errorf("subject = %+v, want %+v", statement.Subject[0], wantSubject[0])
+			}
+
+			def := statement.Predicate.BuildDefinition
+			if def.InternalParameters.InputDigest != "sha256:9abc" {
+				t.Errorf("input digest = %q", def.InternalParameters.InputDigest)
+			}
+			if def.ExternalParameters.Spec != "hello" ||
+				def.ExternalParameters.Revision != "0123abcd" {
+				t.Errorf("external parameters = %+v", def.ExternalParameters)
+			}
+			wantDeps := []*resourceDescriptor{
+				{Name: "ubuntu:22.04", Digest: map[string]string{"sha256": "1234"}},
+				{Name: "context", Digest: map[string]string{"sha256": "5678"}},
+				{Name: "source", Digest: map[string]string{"gitCommit": "0123abcd"}},
+			}
+			if !reflect.DeepEqual(def.ResolvedDependencies, wantDeps) {
+				t.Errorf("resolved dependencies = %+v, want %+v",
+					def.ResolvedDependencies, wantDeps)
+			}
+			metadata := statement.Predicate.RunDetails.Metadata
+			if metadata.InvocationID != "b1" || !metadata.StartedOn.Equal(started) {
+				t.Errorf("metadata = %+v", metadata)
+			}
+		})
+	}
+}
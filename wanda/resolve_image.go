@@ -1,15 +1,17 @@
 package wanda
 
 import (
+	"context"
 	"fmt"
+	"log"
 
 	cranename "github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
-func resolveDockerImage(d *dockerCmd, name, ref string) (*imageSource, error) {
-	info, err := d.inspectImage(ref)
+func resolveDockerImage(ctx context.Context, d containerEngine, name, ref string) (*imageSource, error) {
+	info, err := d.inspectImage(ctx, ref)
 	if err != nil {
 		return nil, fmt.Errorf("inspect image %s: %w", ref, err)
 	}
@@ -75,3 +77,17 @@ func resolveRemoteImage(name, ref string, opts ...remote.Option) (
 		src:  src.String(),
 	}, nil
 }
+
+// resolveRemote resolves a remote image like resolveRemoteImage, retrying
+// transient registry failures.
+func (f *Forge) resolveRemote(ctx context.Context, name, ref string, opts ...remote.Option) (
+	*imageSource, error,
+) {
+	var src *imageSource
+	err := f.retry.do(ctx, "resolve "+ref, log.Default(), func() error {
+		var err error
+		src, err = resolveRemoteImage(name, ref, opts...)
+		return err
+	})
+	return src, err
+}
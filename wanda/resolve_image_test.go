@@ -61,7 +61,7 @@ func TestResolveLocalImage(t *testing.T) {
 	}
 
 	dockerCmd := newDockerCmd(&dockerCmdConfig{})
-	if err := dockerCmd.run("image", "rm", tagStr); err != nil {
+	if err := dockerCmd.run(t.Context(), "image", "rm", tagStr); err != nil {
 		t.Fatal("remove image: ", err)
 	}
 }
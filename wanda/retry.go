@@ -0,0 +1,180 @@
+package wanda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+const (
+	defaultRetryAttempts = 4
+	defaultRetryBackoff  = time.Second
+	maxRetryBackoff      = 30 * time.Second
+)
+
+// retryPolicy retries registry operations that fail with a transient error,
+// with exponential backoff and jitter.
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+
+	wait func(context.Context, time.Duration) error // Replaced in tests.
+}
+
+func newRetryPolicy(config *ForgeConfig) *retryPolicy {
+	p := &retryPolicy{
+		attempts: config.RetryAttempts,
+		backoff:  config.RetryBackoff,
+		wait:     waitContext,
+	}
+	if p.attempts <= 0 {
+		p.attempts = defaultRetryAttempts
+	}
+	if p.backoff <= 0 {
+		p.backoff = defaultRetryBackoff
+	}
+	return p
+}
+
+// delay returns how long to wait before the retry after the given failed
+// attempt, counting from 1. The backoff doubles every attempt up to
+// maxRetryBackoff, and a random half of it is taken off so that concurrent
+// builds do not retry in lockstep.
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff
+	for i := 1; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, max(maxRetryBackoff, p.backoff))
+	return d/2 + rand.N(d/2+1)
+}
+
+// waitContext waits for d, or until ctx is done.
+func waitContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do runs op until it succeeds, fails with an error that is not retryable,
+// or has run for all the attempts of the policy. Retries are logged to
+// logger with what as the name of the operation. It stops retrying when ctx
+// is done.
+func (p *retryPolicy) do(ctx context.Context, what string, logger *log.Logger, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.attempts || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+		d := p.delay(attempt)
+		logger.Printf(
+			"%s: attempt %d of %d failed, retrying in %s: %v",
+			what, attempt, p.attempts, d.Round(time.Millisecond), err,
+		)
+		if p.wait(ctx, d) != nil {
+			return err
+		}
+	}
+}
+
+// isRetryable reports whether err is a transient registry failure: a server
+// error, throttling, a timeout or a dropped connection. Other errors, like
+// failed authentication or a missing image, fail right away.
+func isRetryable(err error) bool {
+	var te *transport.Error
+	if errors.As(err, &te) {
+		return isRetryableStatus(te.StatusCode)
+	}
+
+	var pe *dockerPushError
+	if errors.As(err, &pe) {
+		return pe.retryable()
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// dockerPushError is a failed docker push, with the error output of docker
+// to tell transient failures apart.
+type dockerPushError struct {
+	tag    string
+	err    error
+	output string
+}
+
+func (e *dockerPushError) Error() string {
+	return fmt.Sprintf("push %s: %v", e.tag, e.err)
+}
+
+func (e *dockerPushError) Unwrap() error { return e.err }
+
+// Messages in the docker push output of failures that are not worth a
+// retry, and of transient failures. Fatal messages are checked first.
+var (
+	dockerPushFatal = []string{
+		"unauthorized",
+		"denied",
+		"authentication required",
+		"no basic auth credentials",
+		"not found",
+		"name unknown",
+		"manifest unknown",
+	}
+	dockerPushRetryable = []string{
+		"toomanyrequests",
+		"too many requests",
+		"status: 429",
+		"status: 5",
+		"internal server error",
+		"bad gateway",
+		"service unavailable",
+		"gateway timeout",
+		"timeout",
+		"timed out",
+		"connection reset",
+		"connection refused",
+		"broken pipe",
+		"unexpected eof",
+	}
+)
+
+func (e *dockerPushError) retryable() bool {
+	output := strings.ToLower(e.output)
+	for _, s := range dockerPushFatal {
+		if strings.Contains(output, s) {
+			return false
+		}
+	}
+	for _, s := range dockerPushRetryable {
+		if strings.Contains(output, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package wanda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// faultyRegistry is a registry handler that fails the manifest requests for
+// a tag with the queued status codes before serving them.
+type faultyRegistry struct {
+	h http.Handler
+
+	mu     sync.Mutex
+	tag    string
+	faults []int
+}
+
+func (r *faultyRegistry) fail(tag string, codes ...int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tag = tag
+	r.faults = codes
+}
+
+func (r *faultyRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	code := 0
+	if len(r.faults) > 0 && strings.HasSuffix(req.URL.Path, "/manifests/"+r.tag) {
+		code, r.faults = r.faults[0], r.faults[1:]
+	}
+	r.mu.Unlock()
+
+	if code != 0 {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	r.h.ServeHTTP(w, req)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := newRetryPolicy(&ForgeConfig{RetryBackoff: time.Second})
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{attempt: 1, min: 500 * time.Millisecond, max: time.Second},
+		{attempt: 3, min: 2 * time.Second, max: 4 * time.Second},
+		{attempt: 10, min: 15 * time.Second, max: 30 * time.Second},
+	}
+	for _, test := range tests {
+		for range 20 {
+			d := p.delay(test.attempt)
+			if d < test.min || d > test.max {
+				t.Errorf("delay(%d) = %s, want in [%s, %s]", test.attempt, d, test.min, test.max)
+			}
+		}
+	}
+
+	if p := newRetryPolicy(&ForgeConfig{}); p.attempts != defaultRetryAttempts || p.backoff != defaultRetryBackoff {
+		t.Errorf("default policy = %+v", p)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &transport.Error{StatusCode: http.StatusServiceUnavailable}, want: true},
+		{err: &transport.Error{StatusCode: http.StatusInternalServerError}, want: true},
+		{err: fmt.Errorf("fetch: %w", &transport.Error{StatusCode: http.StatusTooManyRequests}), want: true},
+		{err: &transport.Error{StatusCode: http.StatusUnauthorized}, want: false},
+		{err: &transport.Error{StatusCode: http.StatusForbidden}, want: false},
+		{err: &transport.Error{StatusCode: http.StatusNotFound}, want: false},
+		{err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}, want: true},
+		{err: fmt.Errorf("read: %w", syscall.ECONNRESET), want: true},
+		{err: io.ErrUnexpectedEOF, want: true},
+		{err: errors.New("parse reference"), want: false},
+		{
+			err:  &dockerPushError{output: "received unexpected HTTP status: 502 Bad Gateway"},
+			want: true,
+		},
+		{
+			err:  &dockerPushError{output: "toomanyrequests: Rate exceeded"},
+			want: true,
+		},
+		{
+			err:  &dockerPushError{output: "net/http: TLS handshake timeout"},
+			want: true,
+		},
+		{
+			err:  &dockerPushError{output: "denied: requested access to the resource is denied"},
+			want: false,
+		},
+		{
+			err:  &dockerPushError{output: "unauthorized: authentication required"},
+			want: false,
+		},
+		{
+			err:  &dockerPushError{output: "An image does not exist locally with the tag"},
+			want: false,
+		},
+	}
+	for _, test := range tests {
+		if got := isRetryable(test.err); got != test.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryRegistryFaults(t *testing.T) {
+	faulty := &faultyRegistry{h: registry.New(
+		registry.Logger(log.New(io.Discard, "", 0)),
+	)}
+	server := httptest.NewServer(faulty)
+	defer server.Close()
+
+	config := &ForgeConfig{
+		WorkDir:  "testdata",
+		WorkRepo: server.Listener.Addr().String() + "/work",
+		BuildID:  "b1",
+	}
+	forge, err := NewForge(config)
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+	var sleeps int
+	forge.retry.wait = func(context.Context, time.Duration) error {
+		sleeps++
+		return nil
+	}
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+	cacheTag := config.cacheTag("sha256:abc")
+	workTag := config.workTag("hello")
+	if err := remote.Write(mustNewTag(t, cacheTag), img); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+	cacheTagName := mustNewTag(t, cacheTag).TagStr()
+
+	out := defaultBuildOutput()
+	tests := []struct {
+		name      string
+		faults    []int
+		wantHit   bool
+		wantSleep int
+	}{
+		{name: "throttled", faults: []int{429, 429}, wantHit: true, wantSleep: 2},
+		{name: "unauthorized", faults: []int{401}, wantHit: false, wantSleep: 0},
+		{name: "not found", faults: []int{404, 429}, wantHit: false, wantSleep: 0},
+		{name: "gave up", faults: []int{429, 429, 429, 429}, wantHit: false, wantSleep: 3},
+	}
+	for _, test := range tests {
+		sleeps = 0
+		faulty.fail(cacheTagName, test.faults...)
+		hit, err := forge.checkRemoteCache(t.Context(), newBuildInput(nil, nil), cacheTag, workTag, out)
+		if err != nil {
+			t.Fatalf("%s: checkRemoteCache: %v", test.name, err)
+		}
+		if hit != test.wantHit {
+			t.Errorf("%s: hit = %v, want %v", test.name, hit, test.wantHit)
+		}
+		if sleeps != test.wantSleep {
+			t.Errorf("%s: retried %d times, want %d", test.name, sleeps, test.wantSleep)
+		}
+	}
+
+	sleeps = 0
+	faulty.fail(cacheTagName, 429)
+	src, err := forge.resolveRemote(t.Context(), "base", cacheTag, forge.remoteOpts...)
+	if err != nil {
+		t.Fatalf("resolveRemote: %v", err)
+	}
+	if src.id == "" || sleeps != 1 {
+		t.Errorf("resolveRemote() = %+v after %d retries, want 1 retry", src, sleeps)
+	}
+}
+
+func TestRetryPolicyDo_cancel(t *testing.T) {
+	p := newRetryPolicy(&ForgeConfig{RetryAttempts: 5})
+	ctx, cancel := context.WithCancel(t.Context())
+
+	attempts := 0
+	err := p.do(ctx, "op", log.New(io.Discard, "", 0), func() error {
+		attempts++
+		cancel()
+		return &transport.Error{StatusCode: http.StatusServiceUnavailable}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("do() = %v after %d attempts, want error after 1 attempt", err, attempts)
+	}
+}
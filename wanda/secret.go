@@ -0,0 +1,129 @@
+package wanda
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Secret is a build secret that is mounted into RUN instructions with
+// "--mount=type=secret,id=<id>". Secrets are passed to BuildKit with
+// --secret, so they do not end up in the image, and they do not change the
+// build input digest.
+type Secret struct {
+	// Env is the environment variable that has the value of the secret.
+	// It is looked up like build args, in the env file first.
+	Env string `yaml:"env,omitempty"`
+
+	// Src is the file that has the value of the secret. A relative path is
+	// relative to the work dir.
+	Src string `yaml:"src,omitempty"`
+}
+
+var secretIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Validate checks that the secret has a valid id and exactly one source.
+func (s *Secret) Validate(id string) error {
+	if !secretIDRegexp.MatchString(id) {
+		return fmt.Errorf("invalid secret id %q", id)
+	}
+	if s == nil || (s.Env == "") == (s.Src == "") {
+		return fmt.Errorf("secret %q must have exactly one of env or src", id)
+	}
+	return nil
+}
+
+func secretsExpandVar(secrets map[string]*Secret, lookup lookupFunc) map[string]*Secret {
+	if len(secrets) == 0 {
+		return nil
+	}
+	result := make(map[string]*Secret, len(secrets))
+	for id, s := range secrets {
+		if s == nil {
+			result[id] = nil
+			continue
+		}
+		result[id] = &Secret{
+			Env: expandVar(s.Env, lookup),
+			Src: expandVar(s.Src, lookup),
+		}
+	}
+	return result
+}
+
+// buildSecret is a secret resolved for a build.
+type buildSecret struct {
+	id string
+
+	env   string // Name of the env var passed to docker.
+	value string // Value of env.
+
+	src string // Absolute path of the file.
+}
+
+// arg returns the value of the --secret flag for the secret.
+func (s *buildSecret) arg() string {
+	if s.src != "" {
+		return fmt.Sprintf("id=%s,src=%s", s.id, s.src)
+	}
+	return fmt.Sprintf("id=%s,env=%s", s.id, s.env)
+}
+
+// resolveSecrets checks the secrets of spec, and resolves their values, in
+// the order of their ids.
+func (f *Forge) resolveSecrets(spec *Spec) ([]*buildSecret, error) {
+	var ids []string
+	for id := range spec.Secrets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var secrets []*buildSecret
+	for _, id := range ids {
+		s := spec.Secrets[id]
+		if err := s.Validate(id); err != nil {
+			return nil, err
+		}
+
+		if s.Env != "" {
+			lookup := f.lookup
+			if lookup == nil {
+				lookup = os.LookupEnv
+			}
+			v, ok := lookup(s.Env)
+			if !ok {
+				return nil, fmt.Errorf("secret %q: env var %s is not set", id, s.Env)
+			}
+			secrets = append(secrets, &buildSecret{id: id, env: s.Env, value: v})
+			continue
+		}
+
+		src := filepath.FromSlash(s.Src)
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(f.workDir, src)
+		}
+		if _, err := os.Stat(src); err != nil {
+			return nil, fmt.Errorf("secret %q: %w", id, err)
+		}
+		secrets = append(secrets, &buildSecret{id: id, src: src})
+	}
+	return secrets, nil
+}
+
+// redactSecretArgs returns a copy of the docker command line args with the
+// sources of --secret flags replaced, for logging.
+func redactSecretArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 1; i < len(redacted); i++ {
+		if redacted[i-1] != "--secret" {
+			continue
+		}
+		id, _, _ := strings.Cut(redacted[i], ",")
+		redacted[i] = id + ",<redacted>"
+	}
+	return redacted
+}
@@ -0,0 +1,383 @@
+package wanda
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	cranename "github.com/google/go-containerregistry/pkg/name"
+	crane "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Cache images are signed the way cosign signs images with a key: the
+// signature is a layer of an image tagged "sha256-<hex>.sig" next to the
+// signed image, so that "cosign verify --key" can check them too.
+//
+// Adding a signature to that tag reads, modifies and writes it, so
+// concurrent signers can drop each other's signatures. Each signature is
+// therefore also pushed alone to a tag of its own signer and cache tag,
+// "sha256-<hex>.<id>.sig", which is what wanda verifies.
+const (
+	simpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnno    = "dev.cosignproject.cosign/signature"
+	cosignSignatureType    = "cosign container image signature"
+	cosignSignatureSuffix  = ".sig"
+
+	// signedCacheTag is the key of the optional payload field that has the
+	// cache tag an image was signed for. A signature only verifies the
+	// image under that tag, so that a signed image cannot be re-tagged as
+	// the cache image of another input digest.
+	signedCacheTag = "io.ray.wanda.cache-tag"
+)
+
+// simpleSigning is the payload that is signed for an image.
+type simpleSigning struct {
+	Critical simpleSigningCritical `json:"critical"`
+	Optional map[string]any        `json:"optional"`
+}
+
+type simpleSigningCritical struct {
+	Identity struct {
+		DockerReference string `json:"docker-reference"`
+	} `json:"identity"`
+	Image struct {
+		DockerManifestDigest string `json:"docker-manifest-digest"`
+	} `json:"image"`
+	Type string `json:"type"`
+}
+
+// cacheSigning has the keys that cache images are signed and verified
+// with. Either key can be nil.
+type cacheSigning struct {
+	signer   *ecdsa.PrivateKey
+	verifier *ecdsa.PublicKey
+}
+
+// newCacheSigning loads the signing keys of config. It returns nil if
+// neither key is set. When only SigningKey is set, cache hits are verified
+// with its public key.
+func newCacheSigning(config *ForgeConfig) (*cacheSigning, error) {
+	if config.SigningKey == "" && config.VerifyKey == "" {
+		return nil, nil
+	}
+
+	s := new(cacheSigning)
+	if config.SigningKey != "" {
+		key, err := readSigningKey(config.SigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("read signing key: %w", err)
+		}
+		s.signer = key
+		s.verifier = &key.PublicKey
+	}
+	if config.VerifyKey != "" {
+		key, err := readVerifyKey(config.VerifyKey)
+		if err != nil {
+			return nil, fmt.Errorf("read verify key: %w", err)
+		}
+		s.verifier = key
+	}
+	return s, nil
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	return block, nil
+}
+
+// readSigningKey reads an unencrypted ECDSA private key in PEM format, as
+// SEC 1 or PKCS #8. Encrypted cosign keys are not supported.
+func readSigningKey(file string) (*ecdsa.PrivateKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: %T is not an ECDSA key", file, key)
+		}
+		return ecKey, nil
+	}
+	if strings.HasPrefix(block.Type, "ENCRYPTED") {
+		return nil, fmt.Errorf("%s: encrypted keys are not supported", file)
+	}
+	return nil, fmt.Errorf("%s: unexpected PEM block %q", file, block.Type)
+}
+
+// readVerifyKey reads an ECDSA public key in PEM format, like a cosign.pub
+// file.
+func readVerifyKey(file string) (*ecdsa.PublicKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", file, block.Type)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %T is not an ECDSA key", file, key)
+	}
+	return ecKey, nil
+}
+
+// signatureTag returns the tag of the signatures of the image with the
+// given digest in repo.
+func signatureTag(repo cranename.Repository, digest crane.Hash) cranename.Tag {
+	return repo.Tag(fmt.Sprintf("%s-%s%s", digest.Algorithm, digest.Hex, cosignSignatureSuffix))
+}
+
+// signerTag returns the tag of the signature of the image with the given
+// digest at cacheTag, by the key pub. Only signers with the same key and
+// cache tag write to it, and they write the same signature.
+func signerTag(cacheTag cranename.Tag, digest crane.Hash, pub *ecdsa.PublicKey) (cranename.Tag, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return cranename.Tag{}, fmt.Errorf("marshal public key: %w", err)
+	}
+	h := sha256.New()
+	h.Write(der)
+	h.Write([]byte{0})
+	h.Write([]byte(cacheTag.TagStr()))
+	id := hex.EncodeToString(h.Sum(nil))[:16]
+	return cacheTag.Context().Tag(fmt.Sprintf(
+		"%s-%s.%s%s", digest.Algorithm, digest.Hex, id, cosignSignatureSuffix,
+	)), nil
+}
+
+func simpleSigningPayload(tag cranename.Tag, digest crane.Hash) ([]byte, error) {
+	payload := new(simpleSigning)
+	payload.Critical.Identity.DockerReference = tag.Context().Name()
+	payload.Critical.Image.DockerManifestDigest = digest.String()
+	payload.Critical.Type = cosignSignatureType
+	payload.Optional = map[string]any{signedCacheTag: tag.TagStr()}
+	return json.Marshal(payload)
+}
+
+// sign signs the image with the given digest at the cache tag, and pushes
+// the signature to its signer tag, and to the signatures of the image for
+// cosign. Signatures that the image already has are kept.
+func (s *cacheSigning) sign(cacheTag cranename.Tag, digest crane.Hash, opts ...remote.Option) error {
+	repo := cacheTag.Context()
+	payload, err := simpleSigningPayload(cacheTag, digest)
+	if err != nil {
+		return fmt.Errorf("encode payload: %w", err)
+	}
+	h := sha256.Sum256(payload)
+	sig, err := s.signer.Sign(rand.Reader, h[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("sign payload: %w", err)
+	}
+
+	addendum := mutate.Addendum{
+		Layer:     static.NewLayer(payload, simpleSigningMediaType),
+		MediaType: simpleSigningMediaType,
+		Annotations: map[string]string{
+			cosignSignatureAnno: base64.StdEncoding.EncodeToString(sig),
+		},
+	}
+
+	own, err := signerTag(cacheTag, digest, &s.signer.PublicKey)
+	if err != nil {
+		return err
+	}
+	img, err := mutate.Append(emptySignatures(), addendum)
+	if err != nil {
+		return fmt.Errorf("add signature: %w", err)
+	}
+	if err := remote.Write(own, img, opts...); err != nil {
+		return fmt.Errorf("push signature: %w", err)
+	}
+
+	tag := signatureTag(repo, digest)
+	base, err := remote.Image(tag, opts...)
+	if err != nil {
+		if !isNotFound(err) {
+			return fmt.Errorf("fetch signatures: %w", err)
+		}
+		base = emptySignatures()
+	}
+	img, err = mutate.Append(base, addendum)
+	if err != nil {
+		return fmt.Errorf("add signature: %w", err)
+	}
+	if err := remote.Write(tag, img, opts...); err != nil {
+		return fmt.Errorf("push signature: %w", err)
+	}
+	return nil
+}
+
+// emptySignatures returns an image without signatures to add them to.
+func emptySignatures() crane.Image {
+	return mutate.ConfigMediaType(
+		mutate.MediaType(empty.Image, types.OCIManifestSchema1),
+		types.OCIConfigJSON,
+	)
+}
+
+// verify checks that the image with the given digest at the cache tag has a
+// valid signature by the verify key, made for the same repo and tag. The
+// signer tag of the key is checked first, then the signatures of the image,
+// which have the signatures pushed before there were signer tags.
+func (s *cacheSigning) verify(cacheTag cranename.Tag, digest crane.Hash, opts ...remote.Option) error {
+	own, err := signerTag(cacheTag, digest, s.verifier)
+	if err != nil {
+		return err
+	}
+	signed := false
+	for _, tag := range []cranename.Tag{own, signatureTag(cacheTag.Context(), digest)} {
+		img, err := remote.Image(tag, opts...)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("fetch signatures: %w", err)
+		}
+		signed = true
+		if ok, err := s.verifySignatures(img, cacheTag, digest); err != nil || ok {
+			return err
+		}
+	}
+	if !signed {
+		return errors.New("image is not signed")
+	}
+	return errors.New("no valid signature")
+}
+
+// verifySignatures reports whether one of the signatures in img is a valid
+// signature of the image with the given digest at cacheTag by the verify
+// key.
+func (s *cacheSigning) verifySignatures(
+	img crane.Image, cacheTag cranename.Tag, digest crane.Hash,
+) (bool, error) {
+	repo := cacheTag.Context()
+	manifest, err := img.Manifest()
+	if err != nil {
+		return false, fmt.Errorf("read signatures: %w", err)
+	}
+
+	for _, desc := range manifest.Layers {
+		if desc.MediaType != simpleSigningMediaType {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(desc.Annotations[cosignSignatureAnno])
+		if err != nil {
+			continue
+		}
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return false, fmt.Errorf("read signature %s: %w", desc.Digest, err)
+		}
+		payload, err := readLayer(layer)
+		if err != nil {
+			return false, fmt.Errorf("read signature %s: %w", desc.Digest, err)
+		}
+
+		h := sha256.Sum256(payload)
+		if !ecdsa.VerifyASN1(s.verifier, h[:], sig) {
+			continue
+		}
+		signed := new(simpleSigning)
+		if err := json.Unmarshal(payload, signed); err != nil {
+			continue
+		}
+		if signed.Critical.Image.DockerManifestDigest != digest.String() {
+			continue
+		}
+		if signed.Critical.Identity.DockerReference != repo.Name() {
+			continue
+		}
+		if tag, _ := signed.Optional[signedCacheTag].(string); tag != cacheTag.TagStr() {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func readLayer(l crane.Layer) ([]byte, error) {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// isNotFound reports whether err is a registry error for a missing
+// manifest or repository.
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	return terr.StatusCode == 404
+}
+
+// signCacheImage signs the image at cacheTag, if cache images are signed.
+func (f *Forge) signCacheImage(ctx context.Context, cacheTag string, out *buildOutput) error {
+	if f.signing == nil || f.signing.signer == nil {
+		return nil
+	}
+	ref, err := cranename.NewTag(cacheTag)
+	if err != nil {
+		return fmt.Errorf("parse cache tag %q: %w", cacheTag, err)
+	}
+	desc, err := remote.Head(ref, f.remoteOptsFor(ctx, nil)...)
+	if err != nil {
+		return fmt.Errorf("get cache image: %w", err)
+	}
+	if err := f.signing.sign(ref, desc.Digest, f.remoteOptsFor(ctx, nil)...); err != nil {
+		return err
+	}
+	out.log.Printf("signed cache image %s", desc.Digest)
+	return nil
+}
+
+// verifyCacheImage checks the signature of the cache image with the given
+// digest at cacheTag, if cache hits are verified.
+func (f *Forge) verifyCacheImage(
+	ctx context.Context, cacheTag cranename.Tag, digest crane.Hash,
+) error {
+	if f.signing == nil || f.signing.verifier == nil {
+		return nil
+	}
+	return f.signing.verify(cacheTag, digest, f.remoteOptsFor(ctx, nil)...)
+}
@@ -0,0 +1,277 @@
+package wanda
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// writeTestKeys writes a new ECDSA key pair to dir, and returns the paths
+// of the private and the public key.
+func writeTestKeys(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	priv, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal private key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+
+	privFile := filepath.Join(dir, name+".key")
+	pubFile := filepath.Join(dir, name+".pub")
+	for file, block := range map[string]*pem.Block{
+		privFile: {Type: "PRIVATE KEY", Bytes: priv},
+		pubFile:  {Type: "PUBLIC KEY", Bytes: pub},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("write key: %v", err)
+		}
+	}
+	return privFile, pubFile
+}
+
+func TestReadSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	privFile, pubFile := writeTestKeys(t, dir, "cosign")
+
+	key, err := readSigningKey(privFile)
+	if err != nil {
+		t.Fatalf("readSigningKey: %v", err)
+	}
+	pub, err := readVerifyKey(pubFile)
+	if err != nil {
+		t.Fatalf("readVerifyKey: %v", err)
+	}
+	if !pub.Equal(&key.PublicKey) {
+		t.Errorf("public key does not match the private key")
+	}
+
+	sec1, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	sec1File := filepath.Join(dir, "sec1.key")
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}
+	if err := os.WriteFile(sec1File, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	if _, err := readSigningKey(sec1File); err != nil {
+		t.Errorf("readSigningKey(SEC 1 key): %v", err)
+	}
+
+	encryptedFile := filepath.Join(dir, "encrypted.key")
+	block = &pem.Block{Type: "ENCRYPTED SIGSTORE PRIVATE KEY", Bytes: []byte("x")}
+	if err := os.WriteFile(encryptedFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	if _, err := readSigningKey(encryptedFile); err == nil {
+		t.Errorf("readSigningKey(encrypted key) should fail")
+	}
+	if _, err := readVerifyKey(privFile); err == nil {
+		t.Errorf("readVerifyKey(private key) should fail")
+	}
+}
+
+func TestCheckRemoteCache_signatures(t *testing.T) {
+	server := httptest.NewServer(registry.New(
+		registry.Logger(log.New(io.Discard, "", 0)),
+	))
+	defer server.Close()
+	workRepo := fmt.Sprintf("%s/work", server.Listener.Addr().String())
+
+	dir := t.TempDir()
+	signingKey, verifyKey := writeTestKeys(t, dir, "cosign")
+	otherKey, _ := writeTestKeys(t, dir, "other")
+
+	config := &ForgeConfig{
+		WorkDir:    "testdata",
+		WorkRepo:   workRepo,
+		BuildID:    "b1",
+		SigningKey: signingKey,
+	}
+	forge, err := NewForge(config)
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+	verifier, err := NewForge(&ForgeConfig{
+		WorkDir:   "testdata",
+		WorkRepo:  workRepo,
+		BuildID:   "b1",
+		VerifyKey: verifyKey,
+	})
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+	other, err := NewForge(&ForgeConfig{
+		WorkDir:    "testdata",
+		WorkRepo:   workRepo,
+		BuildID:    "b1",
+		SigningKey: otherKey,
+	})
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+	cacheTag := config.cacheTag("sha256:abc")
+	workTag := config.workTag("hello")
+	if err := remote.Write(mustNewTag(t, cacheTag), img); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+
+	out := defaultBuildOutput()
+	check := func(f *Forge) bool {
+		t.Helper()
+		hit, err := f.checkRemoteCache(t.Context(), newBuildInput(nil, nil), cacheTag, workTag, out)
+		if err != nil {
+			t.Fatalf("checkRemoteCache: %v", err)
+		}
+		return hit
+	}
+
+	if check(verifier) {
+		t.Errorf("unsigned cache image is a hit")
+	}
+
+	if err := other.signCacheImage(t.Context(), cacheTag, out); err != nil {
+		t.Fatalf("sign with other key: %v", err)
+	}
+	if check(verifier) {
+		t.Errorf("cache image signed by another key is a hit")
+	}
+
+	if err := forge.signCacheImage(t.Context(), cacheTag, out); err != nil {
+		t.Fatalf("signCacheImage: %v", err)
+	}
+	if !check(verifier) {
+		t.Errorf("signed cache image is a miss")
+	}
+	if !check(forge) {
+		t.Errorf("signing key does not verify its own signature")
+	}
+
+	// A concurrent signer that read the signatures of the image before the
+	// signature was added writes them back without it.
+	imgDigest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("image digest: %v", err)
+	}
+	repo := mustNewTag(t, cacheTag).Context()
+	if err := remote.Write(signatureTag(repo, imgDigest), emptySignatures()); err != nil {
+		t.Fatalf("overwrite signatures: %v", err)
+	}
+	if !check(verifier) {
+		t.Errorf("signed cache image is a miss after its signatures were overwritten")
+	}
+
+	// A signature copied from another image does not count.
+	poisoned, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+	if err := remote.Write(mustNewTag(t, cacheTag), poisoned); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+	poisonedDigest, err := poisoned.Digest()
+	if err != nil {
+		t.Fatalf("image digest: %v", err)
+	}
+	pub := &forge.signing.signer.PublicKey
+	from, err := signerTag(mustNewTag(t, cacheTag), imgDigest, pub)
+	if err != nil {
+		t.Fatalf("signer tag: %v", err)
+	}
+	to, err := signerTag(mustNewTag(t, cacheTag), poisonedDigest, pub)
+	if err != nil {
+		t.Fatalf("signer tag: %v", err)
+	}
+	sigs, err := remote.Image(from)
+	if err != nil {
+		t.Fatalf("fetch signatures: %v", err)
+	}
+	if err := remote.Write(to, sigs); err != nil {
+		t.Fatalf("copy signatures: %v", err)
+	}
+	if check(verifier) {
+		t.Errorf("cache image with a copied signature is a hit")
+	}
+}
+
+func TestCheckRemoteCache_retaggedSignedImage(t *testing.T) {
+	server := httptest.NewServer(registry.New(
+		registry.Logger(log.New(io.Discard, "", 0)),
+	))
+	defer server.Close()
+	workRepo := fmt.Sprintf("%s/work", server.Listener.Addr().String())
+
+	signingKey, _ := writeTestKeys(t, t.TempDir(), "cosign")
+	config := &ForgeConfig{
+		WorkDir:    "testdata",
+		WorkRepo:   workRepo,
+		BuildID:    "b1",
+		SigningKey: signingKey,
+	}
+	forge, err := NewForge(config)
+	if err != nil {
+		t.Fatalf("make forge: %v", err)
+	}
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("create random image: %v", err)
+	}
+	cacheTag := config.cacheTag("sha256:abc")
+	if err := remote.Write(mustNewTag(t, cacheTag), img); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+	out := defaultBuildOutput()
+	if err := forge.signCacheImage(t.Context(), cacheTag, out); err != nil {
+		t.Fatalf("signCacheImage: %v", err)
+	}
+
+	// Point the cache tag of another input digest at the signed image.
+	otherTag := config.cacheTag("sha256:def")
+	if err := remote.Write(mustNewTag(t, otherTag), img); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+
+	workTag := config.workTag("hello")
+	hit, err := forge.checkRemoteCache(t.Context(), newBuildInput(nil, nil), cacheTag, workTag, out)
+	if err != nil {
+		t.Fatalf("checkRemoteCache: %v", err)
+	}
+	if !hit {
+		t.Errorf("signed cache image is a miss")
+	}
+
+	hit, err = forge.checkRemoteCache(t.Context(), newBuildInput(nil, nil), otherTag, workTag, out)
+	if err != nil {
+		t.Fatalf("checkRemoteCache: %v", err)
+	}
+	if hit {
+		t.Errorf("signed image re-tagged under another cache tag is a hit")
+	}
+}
@@ -19,6 +19,10 @@ type Spec struct {
 	Srcs       []string `yaml:"srcs,omitempty"`
 	Dockerfile string   `yaml:"dockerfile"`
 
+	// Target is the stage of a multi-stage Dockerfile to build. When empty,
+	// the last stage is built.
+	Target string `yaml:"target,omitempty"`
+
 	BuildArgs []string `yaml:"build_args,omitempty"`
 
 	// BuildHintArgs are build args which values do not participate
@@ -29,12 +33,38 @@ type Spec struct {
 	// DisableCaching disables use of caching.
 	DisableCaching bool `yaml:"disable_caching,omitempty"`
 
+	// CacheEpoch is the cache epoch policy of the spec: "daily", "weekly",
+	// "monthly", "never", or an explicit epoch. The cache of the spec is
+	// invalidated when the epoch changes. It overrides the policy of the
+	// repo.
+	CacheEpoch string `yaml:"cache_epoch,omitempty"`
+
 	// Artifacts defines files and directories to extract from the built image.
 	Artifacts []*Artifact `yaml:"artifacts,omitempty"`
 
+	// Platforms lists the platforms to build the image for, in os/arch
+	// format (e.g. "linux/arm64"). When set, an image is built and cached
+	// for each platform, and they can be assembled into one image index.
+	Platforms []string `yaml:"platforms,omitempty"`
+
 	// ContextOwner overrides the uid:gid for all files and directories
 	// in the build context tar. Format: "uid:gid" (e.g. "2000:100").
 	ContextOwner string `yaml:"context_owner,omitempty"`
+
+	// Secrets maps secret ids to where their values come from. They are
+	// available to RUN instructions as secret mounts, and are not part of
+	// the build input digest.
+	Secrets map[string]*Secret `yaml:"secrets,omitempty"`
+
+	// Matrix maps variable names to lists of values. A spec with a matrix
+	// stands for one spec for every combination of the values, with the
+	// variables available to $VAR expansion. The name must use the
+	// variables, so that every combination has its own name.
+	Matrix map[string][]string `yaml:"matrix,omitempty"`
+
+	// dir is the directory of the spec file, where its .wandaignore file
+	// is looked up. It is empty if the spec was not loaded from a file.
+	dir string
 }
 
 func parseSpecFile(f string) (*Spec, error) {
@@ -133,6 +163,7 @@ func artifactsExpandVar(artifacts []*Artifact, lookup lookupFunc) []*Artifact {
 			Src:      expandVar(a.Src, lookup),
 			Dst:      expandVar(a.Dst, lookup),
 			Optional: a.Optional,
+			Mode:     a.Mode,
 		}
 	}
 	return result
@@ -146,11 +177,16 @@ func (s *Spec) expandVar(lookup lookupFunc) *Spec {
 	result.Froms = stringsExpandVar(s.Froms, lookup)
 	result.Srcs = stringsExpandVar(s.Srcs, lookup)
 	result.Dockerfile = expandVar(s.Dockerfile, lookup)
+	result.Target = expandVar(s.Target, lookup)
 	result.BuildArgs = stringsExpandVar(s.BuildArgs, lookup)
 	result.BuildHintArgs = stringsExpandVar(s.BuildHintArgs, lookup)
 	result.DisableCaching = s.DisableCaching
+	result.CacheEpoch = expandVar(s.CacheEpoch, lookup)
 	result.Artifacts = artifactsExpandVar(s.Artifacts, lookup)
 	result.ContextOwner = expandVar(s.ContextOwner, lookup)
+	result.Platforms = stringsExpandVar(s.Platforms, lookup)
+	result.Secrets = secretsExpandVar(s.Secrets, lookup)
+	result.dir = s.dir
 
 	return result
 }
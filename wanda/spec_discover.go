@@ -13,8 +13,10 @@ import (
 type specIndex map[string]*resolvedSpec
 
 // discoverSpecs scans searchRoot for *.wanda.yaml files and builds a name index.
-// Specs are expanded using the provided lookup function.
-// Returns an error if two specs expand to the same name.
+// Specs are expanded using the provided lookup function; a spec with a matrix
+// is indexed under the name of every combination.
+// Returns an error if a spec has an invalid matrix, or if two specs expand
+// to the same name.
 func discoverSpecs(searchRoot string, lookup lookupFunc) (specIndex, error) {
 	index := make(specIndex)
 	conflicts := make(map[string]map[string]struct{})
@@ -37,29 +39,35 @@ func discoverSpecs(searchRoot string, lookup lookupFunc) (specIndex, error) {
 		}
 
 		// Expand the name using env lookup and index it.
-		expanded := spec.expandVar(lookup)
-		name := expanded.Name
-
-		// Skip specs with unexpanded variables.
-		if strings.Contains(name, "$") {
-			return nil
+		specs, err := spec.expandMatrix(lookup)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
 		}
+		for _, expanded := range specs {
+			name := expanded.Name
 
-		if existing, exists := index[name]; exists && existing.Path != path {
-			// Record conflict.
-			m := conflicts[name]
-			if m == nil {
-				m = make(map[string]struct{}, 2)
-				conflicts[name] = m
+			// Skip specs with unexpanded variables.
+			if strings.Contains(name, "$") {
+				continue
 			}
-			m[existing.Path] = struct{}{}
-			m[path] = struct{}{}
-			if minConflictName == "" || name < minConflictName {
-				minConflictName = name
+
+			if existing, exists := index[name]; exists && existing.Path != path {
+				// Record conflict.
+				m := conflicts[name]
+				if m == nil {
+					m = make(map[string]struct{}, 2)
+					conflicts[name] = m
+				}
+				m[existing.Path] = struct{}{}
+				m[path] = struct{}{}
+				if minConflictName == "" || name < minConflictName {
+					minConflictName = name
+				}
+				continue
 			}
-			return nil
+			expanded.dir = filepath.Dir(path)
+			index[name] = &resolvedSpec{Path: path, Spec: expanded}
 		}
-		index[name] = &resolvedSpec{Path: path, Spec: expanded}
 		return nil
 	})
 	if err != nil {
@@ -81,6 +89,25 @@ func discoverSpecs(searchRoot string, lookup lookupFunc) (specIndex, error) {
 	return index, nil
 }
 
+// discoverAllSpecs discovers the specs in all the directories listed in
+// wandaSpecsFile.
+func discoverAllSpecs(wandaSpecsFile string, lookup lookupFunc) (specIndex, error) {
+	specDirs, err := readWandaSpecs(wandaSpecsFile)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", wandaSpecsFile, err)
+	}
+	g := &depGraph{
+		Specs:    make(map[string]*resolvedSpec),
+		baseDir:  filepath.Dir(wandaSpecsFile),
+		specDirs: specDirs,
+		lookup:   lookup,
+	}
+	if err := g.discover(); err != nil {
+		return nil, err
+	}
+	return g.Specs, nil
+}
+
 // readWandaSpecs reads the wandaSpecsFile.
 // Each non-empty line (after trimming whitespace) is treated as a directory path.
 // Lines starting with # are comments and are ignored.
@@ -88,6 +88,25 @@ func TestDiscoverSpecs_NameCollision(t *testing.T) {
 	}
 }
 
+func TestDiscoverSpecs_InvalidMatrix(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	writeSpec(t, tmpDir, "bad.wanda.yaml", strings.Join([]string{
+		"name: bad",
+		"dockerfile: Dockerfile",
+		"matrix:",
+		"  PYTHON: []",
+	}, "\n"))
+
+	_, err := discoverSpecs(tmpDir, noopLookup)
+	if err == nil {
+		t.Fatal("expected error for invalid matrix, got nil")
+	}
+	if !strings.Contains(err.Error(), "bad.wanda.yaml") {
+		t.Errorf("error should mention the spec file, got: %v", err)
+	}
+}
+
 func TestDiscoverSpecs_WithVariables(t *testing.T) {
 	tmpDir := t.TempDir()
 
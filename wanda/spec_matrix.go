@@ -0,0 +1,156 @@
+package wanda
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var matrixVarRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// matrixCombos returns every combination of the values of the matrix
+// variables of the spec, in a stable order. A spec without a matrix has a
+// single, empty combination.
+func (s *Spec) matrixCombos() ([]map[string]string, error) {
+	var names []string
+	for name, values := range s.Matrix {
+		if !matrixVarRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid matrix variable name %q", name)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("matrix variable %s has no values", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combos := []map[string]string{{}}
+	for _, name := range names {
+		var next []map[string]string
+		for _, combo := range combos {
+			for _, v := range s.Matrix[name] {
+				c := make(map[string]string, len(combo)+1)
+				for k, cv := range combo {
+					c[k] = cv
+				}
+				c[name] = v
+				next = append(next, c)
+			}
+		}
+		combos = next
+	}
+	return combos, nil
+}
+
+// matrixLookup returns a lookup function where the values of the matrix
+// combination take precedence over lookup.
+func matrixLookup(combo map[string]string, lookup lookupFunc) lookupFunc {
+	return func(k string) (string, bool) {
+		if v, ok := combo[k]; ok {
+			return v, true
+		}
+		if lookup == nil {
+			return "", false
+		}
+		return lookup(k)
+	}
+}
+
+// matrixBuildArgs gives the build args that are just the name of a matrix
+// variable the value of the variable, like they would otherwise get the
+// value of the environment variable.
+func matrixBuildArgs(args []string, combo map[string]string) []string {
+	for i, arg := range args {
+		if strings.Contains(arg, "=") {
+			continue
+		}
+		if v, ok := combo[arg]; ok {
+			args[i] = arg + "=" + v
+		}
+	}
+	return args
+}
+
+// expandMatrixCombo expands the spec for a matrix combination.
+func (s *Spec) expandMatrixCombo(combo map[string]string, lookup lookupFunc) *Spec {
+	expanded := s.expandVar(matrixLookup(combo, lookup))
+	expanded.BuildArgs = matrixBuildArgs(expanded.BuildArgs, combo)
+	expanded.BuildHintArgs = matrixBuildArgs(expanded.BuildHintArgs, combo)
+	return expanded
+}
+
+// expandMatrix expands the spec into one spec for each combination of its
+// matrix. The values of the matrix variables are used in place of the
+// environment. Every combination must expand to a different name.
+func (s *Spec) expandMatrix(lookup lookupFunc) ([]*Spec, error) {
+	combos, err := s.matrixCombos()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	var specs []*Spec
+	for _, combo := range combos {
+		expanded := s.expandMatrixCombo(combo, lookup)
+		if names[expanded.Name] {
+			return nil, fmt.Errorf(
+				"matrix expands to name %q more than once; use the matrix variables in the name",
+				expanded.Name,
+			)
+		}
+		names[expanded.Name] = true
+		specs = append(specs, expanded)
+	}
+	return specs, nil
+}
+
+// selectMatrixCombo expands the spec for the single matrix combination that
+// the environment selects: a matrix variable that is set in the environment
+// keeps only the combinations with that value. It is used for the spec
+// that is built, so that each combination can be built by its own job. A
+// spec without a matrix is expanded as is.
+func (s *Spec) selectMatrixCombo(lookup lookupFunc) (*Spec, error) {
+	combos, err := s.matrixCombos()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []map[string]string
+	for _, combo := range combos {
+		match := true
+		for k, v := range combo {
+			if lookup == nil {
+				break
+			}
+			if ev, ok := lookup(k); ok && ev != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			selected = append(selected, combo)
+		}
+	}
+
+	switch len(selected) {
+	case 1:
+		return s.expandMatrixCombo(selected[0], lookup), nil
+	case 0:
+		return nil, fmt.Errorf("no matrix combination matches the environment")
+	}
+
+	var unset []string
+	for name := range s.Matrix {
+		if lookup == nil {
+			unset = append(unset, name)
+		} else if _, ok := lookup(name); !ok {
+			unset = append(unset, name)
+		}
+	}
+	sort.Strings(unset)
+	return nil, fmt.Errorf(
+		"%d matrix combinations match; set %s to select one",
+		len(selected), strings.Join(unset, ", "),
+	)
+}
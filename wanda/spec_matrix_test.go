@@ -0,0 +1,181 @@
+package wanda
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSpecMatrixCombos(t *testing.T) {
+	spec := &Spec{Matrix: map[string][]string{
+		"PYTHON": {"3.10", "3.11"},
+		"CUDA":   {"12.1", "12.4"},
+	}}
+	got, err := spec.matrixCombos()
+	if err != nil {
+		t.Fatalf("matrixCombos: %v", err)
+	}
+	want := []map[string]string{
+		{"CUDA": "12.1", "PYTHON": "3.10"},
+		{"CUDA": "12.1", "PYTHON": "3.11"},
+		{"CUDA": "12.4", "PYTHON": "3.10"},
+		{"CUDA": "12.4", "PYTHON": "3.11"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("matrixCombos() = %v, want %v", got, want)
+	}
+
+	got, err = (&Spec{}).matrixCombos()
+	if err != nil {
+		t.Fatalf("matrixCombos without matrix: %v", err)
+	}
+	if !reflect.DeepEqual(got, []map[string]string{{}}) {
+		t.Errorf("matrixCombos() without matrix = %v, want one empty combo", got)
+	}
+
+	for _, matrix := range []map[string][]string{
+		{"PYTHON": nil},
+		{"NOT-A-VAR": {"1"}},
+	} {
+		if _, err := (&Spec{Matrix: matrix}).matrixCombos(); err == nil {
+			t.Errorf("matrixCombos(%v) got nil error, want error", matrix)
+		}
+	}
+}
+
+func TestSpecExpandMatrix(t *testing.T) {
+	spec := &Spec{
+		Name:       "ray-py$PYTHON-$ARCH",
+		Froms:      []string{"cr.ray.io/rayproject/base-py$PYTHON"},
+		Dockerfile: "Dockerfile",
+		Tags:       []string{"rayproject/ray:py$PYTHON-$ARCH"},
+		BuildArgs:  []string{"PYTHON", "ARCH_SUFFIX=-$ARCH", "OTHER"},
+		Matrix:     map[string][]string{"PYTHON": {"3.10", "3.11"}},
+	}
+	lookup := func(k string) (string, bool) {
+		switch k {
+		case "ARCH":
+			return "x86_64", true
+		case "PYTHON":
+			return "3.9", true // Matrix values take precedence.
+		}
+		return "", false
+	}
+
+	got, err := spec.expandMatrix(lookup)
+	if err != nil {
+		t.Fatalf("expandMatrix: %v", err)
+	}
+	want := []*Spec{{
+		Name:       "ray-py3.10-x86_64",
+		Froms:      []string{"cr.ray.io/rayproject/base-py3.10"},
+		Dockerfile: "Dockerfile",
+		Tags:       []string{"rayproject/ray:py3.10-x86_64"},
+		BuildArgs:  []string{"PYTHON=3.10", "ARCH_SUFFIX=-x86_64", "OTHER"},
+	}, {
+		Name:       "ray-py3.11-x86_64",
+		Froms:      []string{"cr.ray.io/rayproject/base-py3.11"},
+		Dockerfile: "Dockerfile",
+		Tags:       []string{"rayproject/ray:py3.11-x86_64"},
+		BuildArgs:  []string{"PYTHON=3.11", "ARCH_SUFFIX=-x86_64", "OTHER"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		for _, s := range got {
+			t.Logf("%+v", s)
+		}
+		t.Errorf("expandMatrix() mismatch")
+	}
+
+	spec.Name = "ray-$ARCH"
+	if _, err := spec.expandMatrix(lookup); err == nil {
+		t.Errorf("expandMatrix() with a name without matrix vars got nil error")
+	}
+}
+
+func TestSpecSelectMatrixCombo(t *testing.T) {
+	spec := &Spec{
+		Name: "ray-py$PYTHON-cu$CUDA",
+		Matrix: map[string][]string{
+			"PYTHON": {"3.10", "3.11"},
+			"CUDA":   {"12.1", "12.4"},
+		},
+	}
+	env := func(vars map[string]string) lookupFunc {
+		return func(k string) (string, bool) {
+			v, ok := vars[k]
+			return v, ok
+		}
+	}
+
+	got, err := spec.selectMatrixCombo(env(map[string]string{"PYTHON": "3.11", "CUDA": "12.4"}))
+	if err != nil {
+		t.Fatalf("selectMatrixCombo: %v", err)
+	}
+	if got.Name != "ray-py3.11-cu12.4" {
+		t.Errorf("selected spec name = %q, want ray-py3.11-cu12.4", got.Name)
+	}
+
+	_, err = spec.selectMatrixCombo(env(map[string]string{"PYTHON": "3.11"}))
+	if err == nil || !strings.Contains(err.Error(), "set CUDA") {
+		t.Errorf("selectMatrixCombo() with CUDA unset got error %v, want one naming CUDA", err)
+	}
+
+	_, err = spec.selectMatrixCombo(env(map[string]string{"PYTHON": "2.7", "CUDA": "12.4"}))
+	if err == nil {
+		t.Errorf("selectMatrixCombo() with unknown value got nil error")
+	}
+
+	plain := &Spec{Name: "plain"}
+	got, err = plain.selectMatrixCombo(noopLookup)
+	if err != nil || got.Name != "plain" {
+		t.Errorf("selectMatrixCombo() without matrix = %+v, %v", got, err)
+	}
+}
+
+func TestBuildDepGraph_Matrix(t *testing.T) {
+	tmpDir := t.TempDir()
+	specsFile := writeWandaSpecs(t, tmpDir, []string{"."})
+
+	writeSpec(t, tmpDir, "base.wanda.yaml", strings.Join([]string{
+		"name: base-py$PYTHON",
+		"dockerfile: Dockerfile",
+		"matrix:",
+		`  PYTHON: ["3.10", "3.11"]`,
+	}, "\n"))
+	writeSpec(t, tmpDir, "ray.wanda.yaml", strings.Join([]string{
+		"name: ray-py$PYTHON",
+		`froms: ["cr.ray.io/rayproject/base-py$PYTHON"]`,
+		"dockerfile: Dockerfile",
+		"matrix:",
+		`  PYTHON: ["3.10", "3.11"]`,
+	}, "\n"))
+
+	lookup := func(k string) (string, bool) {
+		if k == "PYTHON" {
+			return "3.11", true
+		}
+		return "", false
+	}
+	graph, err := buildDepGraph(filepath.Join(tmpDir, "ray.wanda.yaml"), lookup, testPrefix, specsFile)
+	if err != nil {
+		t.Fatalf("buildDepGraph: %v", err)
+	}
+
+	if graph.Root != "ray-py3.11" {
+		t.Errorf("Root = %q, want ray-py3.11", graph.Root)
+	}
+	wantOrder := []string{"base-py3.11", "ray-py3.11"}
+	if !reflect.DeepEqual(graph.Order, wantOrder) {
+		t.Errorf("Order = %v, want %v", graph.Order, wantOrder)
+	}
+	for _, name := range []string{"base-py3.10", "base-py3.11"} {
+		if _, ok := graph.Specs[name]; !ok {
+			t.Errorf("matrix spec %s was not discovered", name)
+		}
+	}
+
+	if _, err := buildDepGraph(filepath.Join(tmpDir, "ray.wanda.yaml"), noopLookup, testPrefix, specsFile); err == nil {
+		t.Errorf("buildDepGraph() of a matrix spec without a selection got nil error")
+	}
+}
@@ -89,6 +89,7 @@ func TestSpecExpand(t *testing.T) {
 			"REMOTE_CACHE_URL=$REMOTE_CACHE_URL",
 		},
 		ContextOwner: "$OWNER_UID:$OWNER_GID",
+		Platforms:    []string{"linux/$ARCH"},
 	}
 
 	envs := map[string]string{
@@ -98,6 +99,7 @@ func TestSpecExpand(t *testing.T) {
 		"REMOTE_CACHE_URL": "http://localhost:5000",
 		"OWNER_UID":        "1000",
 		"OWNER_GID":        "1000",
+		"ARCH":             "arm64",
 	}
 
 	expanded := spec.expandVar(func(k string) (string, bool) {
@@ -118,6 +120,7 @@ func TestSpecExpand(t *testing.T) {
 			"REMOTE_CACHE_URL=http://localhost:5000",
 		},
 		ContextOwner: "1000:1000",
+		Platforms:    []string{"linux/arm64"},
 	}
 
 	if !reflect.DeepEqual(expanded, want) {
@@ -0,0 +1,207 @@
+package wanda
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// wandaIgnoreFile is the name of the optional file next to a spec file that
+// lists gitignore-style patterns of files to leave out of the build context.
+const wandaIgnoreFile = ".wandaignore"
+
+// srcPattern is a gitignore-style path pattern.
+//
+//   - "*" and "?" match within a single path segment, and "**" as a whole
+//     segment matches zero or more segments.
+//   - a pattern ending with "/" only matches directories.
+//   - a pattern with a "/" at the start or in the middle is anchored to the
+//     root; otherwise it matches a file or directory name at any depth.
+//   - a pattern that matches a directory also matches everything in it.
+//
+// Patterns of a .wandaignore file are relative to the directory of the
+// file, like the patterns of a .gitignore file: they are anchored to it,
+// and only match the files in it.
+type srcPattern struct {
+	segments []string
+	negate   bool // Pattern started with "!".
+	dirOnly  bool // Pattern ended with "/".
+	anchored bool // Pattern is matched against the full path.
+
+	// base is the slash separated directory that the pattern is relative
+	// to, or "" for the root.
+	base string
+}
+
+func newSrcPattern(s string) (*srcPattern, error) {
+	p := new(srcPattern)
+	if rest, ok := strings.CutPrefix(s, "!"); ok {
+		p.negate = true
+		s = rest
+	}
+	if rest, ok := strings.CutSuffix(s, "/"); ok {
+		p.dirOnly = true
+		s = rest
+	}
+	if strings.Contains(s, "/") {
+		p.anchored = true
+	}
+
+	s = cleanPath(s)
+	if s == "" {
+		return nil, fmt.Errorf("pattern is empty")
+	}
+	p.segments = strings.Split(s, "/")
+	for _, seg := range p.segments {
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", s, err)
+		}
+	}
+	return p, nil
+}
+
+// root returns the leading segments of the pattern that have no glob in
+// them, which is the directory that files matching it can be found in.
+func (p *srcPattern) root() string {
+	var dirs []string
+	for _, seg := range p.segments[:len(p.segments)-1] {
+		if isFilePathGlob(seg) {
+			break
+		}
+		dirs = append(dirs, seg)
+	}
+	return path.Join(dirs...)
+}
+
+// matchNames reports whether the pattern matches the path with the given
+// segments, without looking at its parent directories.
+func (p *srcPattern) matchNames(names []string) bool {
+	if !p.anchored {
+		names = names[len(names)-1:]
+	}
+	return matchSegments(p.segments, names)
+}
+
+// match reports whether the pattern matches file, which is a slash
+// separated path, or any of the directories that contain it.
+func (p *srcPattern) match(file string) bool {
+	if p.base != "" {
+		rest, ok := strings.CutPrefix(file, p.base+"/")
+		if !ok {
+			return false
+		}
+		file = rest
+	}
+	names := strings.Split(file, "/")
+	for i := 1; i <= len(names); i++ {
+		if p.dirOnly && i == len(names) {
+			break // The file itself is not a directory.
+		}
+		if p.matchNames(names[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against pattern segments. The
+// patterns must have been checked with path.Match before.
+func matchSegments(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] != "**" {
+			if len(names) == 0 {
+				return false
+			}
+			if ok, _ := path.Match(patterns[0], names[0]); !ok {
+				return false
+			}
+			patterns, names = patterns[1:], names[1:]
+			continue
+		}
+
+		for len(patterns) > 0 && patterns[0] == "**" {
+			patterns = patterns[1:]
+		}
+		if len(patterns) == 0 {
+			// A trailing "**" matches everything inside, but not the
+			// directory itself.
+			return len(names) > 0
+		}
+		for i := 0; i <= len(names); i++ {
+			if matchSegments(patterns, names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(names) == 0
+}
+
+// srcIgnored reports whether file is ignored by the patterns. Later
+// patterns take precedence, and "!" patterns include files again.
+func srcIgnored(file string, patterns []*srcPattern) bool {
+	ignored := false
+	for _, p := range patterns {
+		if p.match(file) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// specSrcIgnores returns the patterns in the .wandaignore file next to the
+// spec file, if any. The patterns are relative to the directory of the spec
+// file in workDir; a spec file outside of workDir has patterns relative to
+// workDir itself.
+func specSrcIgnores(spec *Spec, workDir string) ([]*srcPattern, error) {
+	if spec.dir == "" {
+		return nil, nil
+	}
+	dir, err := filepath.Abs(spec.dir)
+	if err != nil {
+		return nil, err
+	}
+	base := ""
+	if rel, err := filepath.Rel(workDir, dir); err == nil && rel != "." && filepath.IsLocal(rel) {
+		base = filepath.ToSlash(rel)
+	}
+	return readSrcIgnoreFile(filepath.Join(dir, wandaIgnoreFile), base)
+}
+
+// readSrcIgnoreFile reads the patterns in a .wandaignore file, relative to
+// base. Empty lines and lines starting with "#" are skipped. It returns nil
+// if the file does not exist.
+func readSrcIgnoreFile(file, base string) ([]*srcPattern, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []*srcPattern
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := newSrcPattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, lineNum, err)
+		}
+		p.base = base
+		patterns = append(patterns, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
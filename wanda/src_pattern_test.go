@@ -0,0 +1,206 @@
+package wanda
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSrcPatternMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		file    string
+		want    bool
+	}{
+		{"*.pyc", "a.pyc", true},
+		{"*.pyc", "a/b/c.pyc", true},
+		{"*.pyc", "a.py", false},
+		{"/*.pyc", "a/b.pyc", false},
+		{"a/*.txt", "a/b.txt", true},
+		{"a/*.txt", "a/b/c.txt", false},
+		{"a/**/*.txt", "a/b.txt", true},
+		{"a/**/*.txt", "a/b/c/d.txt", true},
+		{"**/test", "a/b/test/x.py", true},
+		{"**/test", "test", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "a", false},
+		{"__pycache__/", "a/__pycache__/b.pyc", true},
+		{"__pycache__/", "a/__pycache__", false},
+		{"python/*/tests/", "python/ray/tests/test_a.py", true},
+		{"python/*/tests/", "python/ray/data/tests/test_a.py", false},
+		{"!*.md", "README.md", true},
+	} {
+		p, err := newSrcPattern(test.pattern)
+		if err != nil {
+			t.Fatalf("newSrcPattern(%q): %v", test.pattern, err)
+		}
+		if got := p.match(test.file); got != test.want {
+			t.Errorf("%q.match(%q) = %v, want %v", test.pattern, test.file, got, test.want)
+		}
+	}
+}
+
+func TestNewSrcPattern_bad(t *testing.T) {
+	for _, s := range []string{"", "/", "!", "a/[b"} {
+		if _, err := newSrcPattern(s); err == nil {
+			t.Errorf("newSrcPattern(%q) should fail", s)
+		}
+	}
+}
+
+func TestSrcIgnored(t *testing.T) {
+	var patterns []*srcPattern
+	for _, s := range []string{"*.log", "build/", "!keep.log"} {
+		p, err := newSrcPattern(s)
+		if err != nil {
+			t.Fatalf("newSrcPattern(%q): %v", s, err)
+		}
+		patterns = append(patterns, p)
+	}
+
+	for file, want := range map[string]bool{
+		"a.txt":         false,
+		"a.log":         true,
+		"x/keep.log":    false,
+		"build/out.txt": true,
+		"src/build":     false,
+	} {
+		if got := srcIgnored(file, patterns); got != want {
+			t.Errorf("srcIgnored(%q) = %v, want %v", file, got, want)
+		}
+	}
+}
+
+func writeSrcTree(t *testing.T, dir string, files []string) {
+	t.Helper()
+	for _, file := range files {
+		p := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(file), 0644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+}
+
+func TestListSrcFiles_patterns(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeSrcTree(t, tmpDir, []string{
+		"Dockerfile",
+		"README.md",
+		"python/setup.py",
+		"python/ray/a.py",
+		"python/ray/a.pyc",
+		"python/ray/tests/test_a.py",
+		"python/ray/data/b.py",
+		"python/ray/data/tests/test_b.py",
+		"python/ray/data/tests/conftest.py",
+	})
+
+	srcs := []string{
+		"python/**/*.py",
+		"!tests/",
+		"python/ray/data/tests/conftest.py",
+		"*.md",
+	}
+	got, err := listSrcFiles(tmpDir, srcs, "Dockerfile", nil)
+	if err != nil {
+		t.Fatalf("listSrcFiles: %v", err)
+	}
+	want := []string{
+		"Dockerfile",
+		"README.md",
+		"python/ray/a.py",
+		"python/ray/data/b.py",
+		"python/ray/data/tests/conftest.py",
+		"python/setup.py",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listSrcFiles() = %q, want %q", got, want)
+	}
+
+	// Ignore patterns apply after srcs, but never to the Dockerfile.
+	ignoreFile := filepath.Join(tmpDir, wandaIgnoreFile)
+	content := "# comment\n\n*.md\nDockerfile\npython/ray/data/\n!python/ray/data/b.py\n"
+	if err := os.WriteFile(ignoreFile, []byte(content), 0644); err != nil {
+		t.Fatalf("write ignore file: %v", err)
+	}
+	ignores, err := readSrcIgnoreFile(ignoreFile, "")
+	if err != nil {
+		t.Fatalf("readSrcIgnoreFile: %v", err)
+	}
+
+	got, err = listSrcFiles(tmpDir, srcs, "Dockerfile", ignores)
+	if err != nil {
+		t.Fatalf("listSrcFiles: %v", err)
+	}
+	want = []string{
+		"Dockerfile",
+		"python/ray/a.py",
+		"python/ray/data/b.py",
+		"python/setup.py",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listSrcFiles() with ignores = %q, want %q", got, want)
+	}
+}
+
+func TestReadSrcIgnoreFile(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	got, err := readSrcIgnoreFile(filepath.Join(tmpDir, wandaIgnoreFile), "")
+	if err != nil || got != nil {
+		t.Errorf("readSrcIgnoreFile() of missing file = %v, %v; want nil, nil", got, err)
+	}
+
+	bad := filepath.Join(tmpDir, "bad")
+	if err := os.WriteFile(bad, []byte("ok\n[oops\n"), 0644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if _, err := readSrcIgnoreFile(bad, ""); err == nil {
+		t.Errorf("readSrcIgnoreFile() with bad pattern should fail")
+	}
+}
+
+func TestSpecSrcIgnores_nestedSpecDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeSrcTree(t, tmpDir, []string{
+		"Dockerfile",
+		"build/build.sh",
+		"docker/app/Dockerfile",
+		"docker/app/build/out.txt",
+		"docker/app/main.py",
+		"docker/app/notes.md",
+		"docker/other/notes.md",
+	})
+
+	specDir := filepath.Join(tmpDir, "docker/app")
+	content := "/build/\n*.md\n"
+	if err := os.WriteFile(filepath.Join(specDir, wandaIgnoreFile), []byte(content), 0644); err != nil {
+		t.Fatalf("write ignore file: %v", err)
+	}
+
+	ignores, err := specSrcIgnores(&Spec{dir: specDir}, tmpDir)
+	if err != nil {
+		t.Fatalf("specSrcIgnores: %v", err)
+	}
+	srcs := []string{"build/", "docker/"}
+	got, err := listSrcFiles(tmpDir, srcs, "docker/app/Dockerfile", ignores)
+	if err != nil {
+		t.Fatalf("listSrcFiles: %v", err)
+	}
+	// The patterns are anchored to docker/app, and leave the files outside
+	// of it alone.
+	want := []string{
+		"build/build.sh",
+		"docker/app/.wandaignore",
+		"docker/app/Dockerfile",
+		"docker/app/main.py",
+		"docker/other/notes.md",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listSrcFiles() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,180 @@
+package wanda
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Modes of checking that a Dockerfile's COPY and ADD sources are in the
+// build context.
+const (
+	srcsCheckError   = "error"
+	srcsCheckSuggest = "suggest"
+	srcsCheckOff     = "off"
+)
+
+// dockerfileSrc is a build context path that a Dockerfile copies from.
+type dockerfileSrc struct {
+	Cmd     string   // "COPY" or "ADD".
+	Src     string   // Source path, with variables substituted.
+	Line    int      // Line number of the instruction.
+	Missing []string // Variables in the source that have no value.
+}
+
+// isRemoteSrc reports whether an ADD source is fetched from the network
+// rather than from the build context.
+func isRemoteSrc(src string) bool {
+	for _, prefix := range []string{"http://", "https://", "git@"} {
+		if strings.HasPrefix(src, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dockerfileSrcs returns the sources of the COPY and ADD instructions in
+// the given stages that read from the build context. Sources copied from
+// other stages or images, heredocs and remote ADD sources are skipped. nil
+// stages means all stages.
+func dockerfileSrcs(
+	insts []*dockerfileInstruction, buildArgs map[string]string, p *platform,
+	stages map[int]bool,
+) []*dockerfileSrc {
+	scope := newDockerfileScope(buildArgs, p)
+
+	var srcs []*dockerfileSrc
+	for _, inst := range insts {
+		if (inst.Cmd == "COPY" || inst.Cmd == "ADD") && scope.inStages(inst, stages) {
+			_, hasFrom := inst.flag("from")
+			if !hasFrom && len(inst.Args) >= 2 {
+				for _, arg := range inst.Args[:len(inst.Args)-1] {
+					if strings.HasPrefix(arg, "<<") {
+						continue
+					}
+					src, missing := scope.expand(arg)
+					if inst.Cmd == "ADD" && isRemoteSrc(src) {
+						continue
+					}
+					srcs = append(srcs, &dockerfileSrc{
+						Cmd:     inst.Cmd,
+						Src:     src,
+						Line:    inst.Line,
+						Missing: missing,
+					})
+				}
+			}
+		}
+		scope.apply(inst)
+	}
+	return srcs
+}
+
+// srcCovered reports whether the build context files include src, which
+// can be a file, a directory or a glob pattern.
+func srcCovered(src string, files []string) (bool, error) {
+	clean := cleanPath(src)
+	if clean == "" {
+		return true, nil // The whole context.
+	}
+	p, err := newSrcPattern(clean)
+	if err != nil {
+		return false, err
+	}
+	p.anchored = true
+	for _, file := range files {
+		if p.match(file) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// suggestSrc returns the srcs entry that would add src to the build
+// context of a build in workDir.
+func suggestSrc(workDir, src string) string {
+	clean := cleanPath(src)
+	if isFilePathGlob(clean) {
+		return clean
+	}
+	info, err := os.Stat(filepath.Join(workDir, filepath.FromSlash(clean)))
+	if err == nil && info.IsDir() {
+		return clean + "/"
+	}
+	return clean
+}
+
+// checkSrcs checks that the sources that the Dockerfile of spec copies
+// from are in files, the build context of the spec built for platform p.
+// It is done before resolving base images, so that a missing source fails
+// fast, instead of deep inside docker build.
+func (f *Forge) checkSrcs(spec *Spec, p *platform, files []string) error {
+	mode := f.config.SrcsCheck
+	switch mode {
+	case srcsCheckOff:
+		return nil
+	case "":
+		mode = srcsCheckError
+	case srcsCheckError, srcsCheckSuggest:
+	default:
+		return fmt.Errorf("unknown srcs check mode %q", mode)
+	}
+	if p == nil {
+		p = hostPlatform()
+	}
+
+	dockerfile := filepath.Join(f.workDir, filepath.FromSlash(spec.Dockerfile))
+	insts, err := parseDockerfileFile(dockerfile)
+	if err != nil {
+		return fmt.Errorf("read dockerfile: %w", err)
+	}
+
+	buildArgs := f.specBuildArgs(spec)
+	stages, err := targetStages(insts, spec.Target, buildArgs, p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", spec.Dockerfile, err)
+	}
+
+	var problems []string
+	suggestions := make(map[string]struct{})
+	for _, src := range dockerfileSrcs(insts, buildArgs, p, stages) {
+		if len(src.Missing) > 0 {
+			continue // Cannot tell which path it is.
+		}
+		ok, err := srcCovered(src.Src, files)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf(
+				"%s:%d: %s source %q: %v", spec.Dockerfile, src.Line, src.Cmd, src.Src, err,
+			))
+			continue
+		}
+		if ok {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf(
+			"%s:%d: %s source %q is not in srcs",
+			spec.Dockerfile, src.Line, src.Cmd, src.Src,
+		))
+		suggestions[suggestSrc(f.workDir, src.Src)] = struct{}{}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf(
+		"build context of %s is missing files:\n  %s",
+		spec.Name, strings.Join(problems, "\n  "),
+	)
+	if mode == srcsCheckSuggest {
+		var entries []string
+		for s := range suggestions {
+			entries = append(entries, s)
+		}
+		sort.Strings(entries)
+		msg += "\nadd to srcs:\n  - " + strings.Join(entries, "\n  - ")
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,131 @@
+package wanda
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDockerfileSrcs(t *testing.T) {
+	insts := mustParseDockerfile(t, strings.Join([]string{
+		"FROM ubuntu AS build",
+		"ARG PKG=ray",
+		"COPY python/$PKG/ /src/",
+		"COPY --chown=1000 a.txt b.txt /dst/",
+		`COPY ["c d.txt", "/dst/"]`,
+		"COPY --from=build /x /x",
+		"ADD https://example.com/f.tgz /f.tgz",
+		"ADD ci/*.sh /ci/",
+		"COPY $MISSING /m",
+		"COPY <<EOF /heredoc",
+		"hello",
+		"EOF",
+	}, "\n"))
+
+	got := dockerfileSrcs(insts, nil, hostPlatform(), nil)
+	want := []*dockerfileSrc{
+		{Cmd: "COPY", Src: "python/ray/", Line: 3},
+		{Cmd: "COPY", Src: "a.txt", Line: 4},
+		{Cmd: "COPY", Src: "b.txt", Line: 4},
+		{Cmd: "COPY", Src: "c d.txt", Line: 5},
+		{Cmd: "ADD", Src: "ci/*.sh", Line: 8},
+		{Cmd: "COPY", Src: "", Line: 9, Missing: []string{"MISSING"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		for _, src := range got {
+			t.Logf("%+v", src)
+		}
+		t.Errorf("dockerfileSrcs() mismatch")
+	}
+}
+
+func TestSrcCovered(t *testing.T) {
+	files := []string{"Dockerfile", "ci/build.sh", "python/ray/a.py"}
+	for _, test := range []struct {
+		src  string
+		want bool
+	}{
+		{".", true},
+		{"/ci/build.sh", true},
+		{"ci/", true},
+		{"ci/*.sh", true},
+		{"python", true},
+		{"python/ray/b.py", false},
+		{"ci/*.py", false},
+		{"java/", false},
+	} {
+		got, err := srcCovered(test.src, files)
+		if err != nil {
+			t.Fatalf("srcCovered(%q): %v", test.src, err)
+		}
+		if got != test.want {
+			t.Errorf("srcCovered(%q) = %v, want %v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestCheckSrcs(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeSrcTree(t, tmpDir, []string{
+		"ci/build.sh",
+		"python/ray/a.py",
+		"README.md",
+	})
+	dockerfile := "FROM scratch\nCOPY ci/build.sh /\nCOPY python/ray /ray\nCOPY README.md /\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatalf("write dockerfile: %v", err)
+	}
+
+	spec := &Spec{Name: "srcs", Dockerfile: "Dockerfile", Srcs: []string{"ci/build.sh"}}
+	files, err := listSrcFiles(tmpDir, spec.Srcs, spec.Dockerfile, nil)
+	if err != nil {
+		t.Fatalf("listSrcFiles: %v", err)
+	}
+
+	newForge := func(mode string) *Forge {
+		forge, err := NewForge(&ForgeConfig{WorkDir: tmpDir, SrcsCheck: mode})
+		if err != nil {
+			t.Fatalf("make forge: %v", err)
+		}
+		return forge
+	}
+
+	err = newForge("").checkSrcs(spec, nil, files)
+	if err == nil {
+		t.Fatalf("checkSrcs() should fail")
+	}
+	for _, want := range []string{
+		`Dockerfile:3: COPY source "python/ray" is not in srcs`,
+		`Dockerfile:4: COPY source "README.md" is not in srcs`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("checkSrcs() = %q, want it to contain %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "add to srcs") {
+		t.Errorf("checkSrcs() in error mode should not suggest srcs: %q", err)
+	}
+
+	err = newForge("suggest").checkSrcs(spec, nil, files)
+	if err == nil || !strings.HasSuffix(err.Error(), "add to srcs:\n  - README.md\n  - python/ray/") {
+		t.Errorf("checkSrcs() in suggest mode = %v", err)
+	}
+
+	if err := newForge("off").checkSrcs(spec, nil, files); err != nil {
+		t.Errorf("checkSrcs() in off mode = %v, want nil", err)
+	}
+	if err := newForge("bogus").checkSrcs(spec, nil, files); err == nil {
+		t.Errorf("checkSrcs() in unknown mode should fail")
+	}
+
+	spec.Srcs = []string{"ci/", "python/ray/", "*.md"}
+	files, err = listSrcFiles(tmpDir, spec.Srcs, spec.Dockerfile, nil)
+	if err != nil {
+		t.Fatalf("listSrcFiles: %v", err)
+	}
+	if err := newForge("").checkSrcs(spec, nil, files); err != nil {
+		t.Errorf("checkSrcs() with all srcs = %v, want nil", err)
+	}
+}
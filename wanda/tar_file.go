@@ -100,7 +100,9 @@ type tarFileRecord struct {
 	Symlink string `json:"symlink,omitempty"`
 }
 
-func (t *tarFile) record(owner *contextOwner) (*tarFileRecord, error) {
+// record returns the digest record of the file. The content digest of a
+// regular file is looked up in hashes, which can be nil.
+func (t *tarFile) record(owner *contextOwner, hashes *fileHashCache) (*tarFileRecord, error) {
 	// Use Lstat to detect symlinks without following them.
 	stat, err := os.Lstat(t.srcFile)
 	if err != nil {
@@ -146,17 +148,10 @@ func (t *tarFile) record(owner *contextOwner) (*tarFileRecord, error) {
 		}
 		return r, nil
 	default:
-		f, err := os.Open(t.srcFile)
+		contentDigest, err := hashes.digest(t.srcFile, stat)
 		if err != nil {
-			return nil, fmt.Errorf("open file %q: %w", t.srcFile, err)
+			return nil, err
 		}
-		defer f.Close()
-
-		h := sha256.New()
-		if _, err := io.Copy(h, f); err != nil {
-			return nil, fmt.Errorf("read file %q: %w", t.srcFile, err)
-		}
-		contentDigest := sha256DigestString(h)
 
 		r := &tarFileRecord{
 			Name:    t.name,
@@ -100,7 +100,7 @@ func TestTarFileRecord(t *testing.T) {
 		},
 	}
 
-	r, err := tf.record(nil)
+	r, err := tf.record(nil, nil)
 	if err != nil {
 		t.Fatalf("record: %v", err)
 	}
@@ -142,7 +142,7 @@ func TestTarFileRecord(t *testing.T) {
 		meta:    tf.meta, // The same meta as the first file.
 	}
 
-	r2, err := tf2.record(nil)
+	r2, err := tf2.record(nil, nil)
 	if err != nil {
 		t.Fatalf("record for file 2: %v", err)
 	}
@@ -234,7 +234,7 @@ func TestTarFileSymlinkRecord(t *testing.T) {
 		},
 	}
 
-	r, err := tf.record(nil)
+	r, err := tf.record(nil, nil)
 	if err != nil {
 		t.Fatalf("record: %v", err)
 	}
@@ -277,7 +277,7 @@ func TestTarFileSymlinkRecord(t *testing.T) {
 		meta:    tf.meta,
 	}
 
-	r2, err := tf2.record(nil)
+	r2, err := tf2.record(nil, nil)
 	if err != nil {
 		t.Fatalf("record for link2: %v", err)
 	}
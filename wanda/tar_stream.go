@@ -6,7 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"runtime"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +25,12 @@ type tarStream struct {
 
 	// owner overrides the uid/gid for all entries when set.
 	owner *contextOwner
+
+	// size is the number of bytes of the last tar stream written out.
+	size atomic.Int64
+
+	// hashes caches the content digests of the files when it is not nil.
+	hashes *fileHashCache
 }
 
 // newTarStream creates a new tarball stream.
@@ -76,32 +86,74 @@ func (s *tarStream) WriteTo(w io.Writer) (int64, error) {
 
 	writErr := s.writeTo(tw)
 	closeErr := tw.Close() // Close flushes the tar stream, writting more bytes.
+	s.size.Store(cw.n)
 	if writErr != nil {
 		return cw.n, writErr
 	}
 	return cw.n, closeErr
 }
 
+// records returns the digest records of all the files in the stream,
+// sorted by name. The files are hashed in parallel.
+func (s *tarStream) records() ([]*tarFileRecord, error) {
+	names := s.sortedNames()
+	records := make([]*tarFileRecord, len(names))
+	errs := make([]error, len(names))
+
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			r, err := s.files[name].record(s.owner, s.hashes)
+			if err != nil {
+				errs[i] = fmt.Errorf("digest file %q: %w", name, err)
+				return
+			}
+			records[i] = r
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The cache only saves time, so a failure to save it does not fail the
+	// digest.
+	if err := s.hashes.save(); err != nil {
+		log.Printf("warning: %v", err)
+	}
+	return records, nil
+}
+
 // digest calculates the digest of the content of input files.
 func (s *tarStream) digest() (string, error) {
+	records, err := s.records()
+	if err != nil {
+		return "", err
+	}
+	return digestTarFileRecords(records)
+}
+
+// digestTarFileRecords calculates the digest of the build context from its
+// file records.
+func digestTarFileRecords(records []*tarFileRecord) (string, error) {
 	// We have our own record format, so that the digest is controlled by
 	// ourselves, and won't be affected by changes in the archive/tar package.
 
 	h := sha256.New()
-	names := s.sortedNames()
-
 	enc := json.NewEncoder(h)
 
-	for _, name := range names {
-		f := s.files[name]
-
-		r, err := f.record(s.owner)
-		if err != nil {
-			return "", fmt.Errorf("digest file %q: %w", name, err)
-		}
-
+	for _, r := range records {
 		if err := enc.Encode(r); err != nil {
-			return "", fmt.Errorf("write record for file %q: %w", name, err)
+			return "", fmt.Errorf("write record for file %q: %w", r.Name, err)
 		}
 	}
 
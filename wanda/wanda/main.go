@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"text/template"
 
 	"github.com/ray-project/rayci/wanda"
@@ -22,9 +25,28 @@ Runs in either remote mode or local mode.
 - Local:
    Takes exactly one argument for the spec file and builds the image for local
    use only.
+   With -local_registry <dir>, serves a registry from dir as the work repo, so
+   that the build cache is kept in dir and used like in remote mode.
 
 Subcommands:
   digest  Print the content-addressed digest for a spec file without building.
+          With -explain, dump all inputs of the digest as JSON; with
+          -diff <old.json>, compare such a dump with the current inputs.
+  plan    Digest every spec in the dependency graph of a spec file and check
+          its cache tag in the work repo without building, printing which
+          specs would be cache hits and why the others would be rebuilt.
+  index   Assemble the per-platform images of a multi-platform spec into one
+          image index, pushed under the work tag and the spec's tags.
+  graph   Print the dependency graph of a spec file as dot, mermaid or json.
+  gc      Delete cache tags and build work tags in the work repo whose images
+          are older than -max_age_days or -max_epochs. Takes no spec file.
+  lock    Pin the external base images of all the specs in the spec
+          directories to their manifest digests in a lockfile, which builds
+          and digests with -locked resolve them from without the network.
+          Takes no spec file.
+  lint    Check every spec file in the spec directories for problems, like
+          unknown fields, unset variables, missing srcs or Dockerfiles,
+          duplicate names and dependency cycles. Takes no spec file.
 
 Supported platforms:
   {{.Platforms}}
@@ -42,14 +64,19 @@ func usageText() string {
 
 func main() {
 	args := os.Args[1:]
-	digest := len(args) > 0 && args[0] == "digest"
-	if digest {
-		args = args[1:]
+	var subcmd string
+	if len(args) > 0 {
+		switch args[0] {
+		case "digest", "plan", "index", "graph", "gc", "lock", "lint":
+			subcmd = args[0]
+			args = args[1:]
+		}
 	}
 
 	fs := flag.NewFlagSet("wanda", flag.ExitOnError)
 	workDir := fs.String("work_dir", ".", "root directory for the build")
-	docker := fs.String("docker", "", "path to the docker client binary")
+	docker := fs.String("docker", "", "path to the docker client binary, or the podman one with -engine=podman")
+	engine := fs.String("engine", "docker", "container engine to build images with: docker or podman")
 	rayCI := fs.Bool(
 		"rayci", false,
 		"takes RAYCI_ env vars for input and run in remote mode",
@@ -61,7 +88,10 @@ func main() {
 	)
 	buildID := fs.String("build_id", "", "build ID for the image tag")
 	readOnly := fs.Bool("read_only", false, "read-only cache repository")
-	epoch := fs.String("epoch", "", "epoch for the image tag")
+	epoch := fs.String(
+		"epoch", "",
+		"cache epoch, or epoch policy (daily, weekly, monthly or never), of specs without their own policy; overrides the repo's .wandaepoch",
+	)
 	rebuild := fs.Bool("rebuild", false, "always rebuild the image")
 	wandaSpecsFile := fs.String(
 		"wanda_specs_file", "",
@@ -75,6 +105,87 @@ func main() {
 		"artifacts_dir", "",
 		"base directory for artifact extraction",
 	)
+	localRegistry := fs.String(
+		"local_registry", "",
+		"directory to serve a built-in registry from as the work repo in local mode; linux only",
+	)
+	platform := fs.String(
+		"platform", "",
+		"only build this os/arch platform of multi-platform specs",
+	)
+	explain := fs.Bool(
+		"explain", false,
+		"digest: dump the build input and context file records as JSON",
+	)
+	diffFile := fs.String(
+		"diff", "",
+		"digest: compare a dump from -explain with the current digest input",
+	)
+	format := fs.String(
+		"format", "dot",
+		"output format of the graph subcommand: dot, mermaid or json",
+	)
+	fromsCheck := fs.String(
+		"froms_check", "warn",
+		"how to handle froms that do not match the Dockerfile: warn, error or off",
+	)
+	srcsCheck := fs.String(
+		"srcs_check", "error",
+		"how to handle Dockerfile COPY/ADD sources missing from srcs: error, suggest or off",
+	)
+	maxAgeDays := fs.Int(
+		"max_age_days", 0,
+		"gc: delete tags of images older than this many days",
+	)
+	maxEpochs := fs.Int(
+		"max_epochs", 0,
+		"gc: delete tags of images older than this many cache epochs of the epoch policy they were built with",
+	)
+	dryRun := fs.Bool("dry_run", false, "gc: only report what would be deleted")
+	gitCommit := fs.String(
+		"git_commit", "",
+		"git commit to record on built images; defaults to HEAD of work_dir",
+	)
+	provenance := fs.Bool(
+		"provenance", false,
+		"push a SLSA provenance attestation of built images to the work repo",
+	)
+	signingKey := fs.String(
+		"signing_key", "",
+		"ECDSA private key PEM file to sign pushed cache images with",
+	)
+	verifyKey := fs.String(
+		"verify_key", "",
+		"ECDSA public key PEM file to verify cache hits with; defaults to the signing key",
+	)
+	report := fs.String(
+		"report", "",
+		"file to write a JSON report of the build to",
+	)
+	retryAttempts := fs.Int(
+		"retry_attempts", 0,
+		"times to try registry operations that fail with transient errors; 0 uses the default",
+	)
+	retryBackoff := fs.Duration(
+		"retry_backoff", 0,
+		"base delay before retrying a registry operation; 0 uses the default",
+	)
+	hashCache := fs.String(
+		"hash_cache", "",
+		"file to cache the content hashes of build context files in across runs",
+	)
+	lockFile := fs.String(
+		"lock_file", "",
+		"lockfile of the external base images; defaults to wanda.lock next to the wandaspecs file",
+	)
+	locked := fs.Bool(
+		"locked", false,
+		"resolve external base images only from the lockfile, failing if it is stale",
+	)
+	jobs := fs.Int(
+		"jobs", 1,
+		"max number of independent specs to build concurrently",
+	)
 
 	fs.Usage = func() {
 		fmt.Fprint(os.Stderr, usageText())
@@ -90,14 +201,24 @@ func main() {
 		*rebuild = os.Getenv("RAYCI_WANDA_ALWAYS_REBUILD") == "true"
 		*envFile = os.Getenv("RAYCI_ENV_FILE")
 		*artifactsDir = os.Getenv("RAYCI_ARTIFACTS_DIR")
-
-		if *epoch == "" {
-			*epoch = wanda.DefaultCacheEpoch()
+		if *gitCommit == "" {
+			*gitCommit = os.Getenv("BUILDKITE_COMMIT")
 		}
 	}
 
+	// Without an explicit -epoch, the repo's .wandaepoch applies, and
+	// RayCI builds fall back to the default epoch.
+	var defaultEpoch string
+	if *rayCI {
+		defaultEpoch = wanda.DefaultCacheEpoch()
+	}
+
 	var input string
-	if !*rayCI {
+	if subcmd == "gc" || subcmd == "lock" || subcmd == "lint" {
+		if fs.NArg() != 0 {
+			log.Fatalf("%s takes no arguments. Run with -help for usage.", subcmd)
+		}
+	} else if !*rayCI {
 		if fs.NArg() != 1 {
 			log.Fatal("needs exactly one argument for the spec file in local mode. Run with -help for usage.")
 		}
@@ -109,13 +230,30 @@ func main() {
 	config := &wanda.ForgeConfig{
 		WorkDir:        *workDir,
 		DockerBin:      *docker,
+		Engine:         *engine,
 		WorkRepo:       *workRepo,
 		NamePrefix:     *namePrefix,
 		BuildID:        *buildID,
 		Epoch:          *epoch,
+		DefaultEpoch:   defaultEpoch,
 		WandaSpecsFile: *wandaSpecsFile,
 		EnvFile:        *envFile,
 		ArtifactsDir:   *artifactsDir,
+		Jobs:           *jobs,
+		Platform:       *platform,
+		FromsCheck:     *fromsCheck,
+		SrcsCheck:      *srcsCheck,
+		LocalRegistry:  *localRegistry,
+		GitCommit:      *gitCommit,
+		Provenance:     *provenance,
+		SigningKey:     *signingKey,
+		VerifyKey:      *verifyKey,
+		Report:         *report,
+		RetryAttempts:  *retryAttempts,
+		RetryBackoff:   *retryBackoff,
+		HashCache:      *hashCache,
+		LockFile:       *lockFile,
+		Locked:         *locked,
 
 		RayCI:   *rayCI,
 		Rebuild: *rebuild,
@@ -123,14 +261,69 @@ func main() {
 		ReadOnlyCache: *readOnly,
 	}
 
-	if digest {
-		if err := wanda.Digest(input, config, os.Stdout); err != nil {
+	// On SIGINT or SIGTERM, like when a CI job is cancelled, stop the docker
+	// commands and registry requests in flight and remove temporary
+	// containers before exiting. A second signal exits right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	switch subcmd {
+	case "digest":
+		var err error
+		switch {
+		case *diffFile != "":
+			err = wanda.DigestDiff(ctx, input, config, *diffFile, os.Stdout)
+		case *explain:
+			err = wanda.DigestExplain(ctx, input, config, os.Stdout)
+		default:
+			err = wanda.Digest(ctx, input, config, os.Stdout)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "plan":
+		if err := wanda.Plan(ctx, input, config, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "graph":
+		if err := wanda.Graph(input, config, *format, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "gc":
+		gcConfig := &wanda.GCConfig{
+			MaxAgeDays: *maxAgeDays,
+			MaxEpochs:  *maxEpochs,
+			DryRun:     *dryRun,
+		}
+		if err := wanda.GC(ctx, config, gcConfig, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "lock":
+		if err := wanda.Lock(ctx, config, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "lint":
+		if err := wanda.Lint(config, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "index":
+		if err := wanda.Index(ctx, input, config); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
 
-	if err := wanda.Build(input, config); err != nil {
+	if err := wanda.Build(ctx, input, config); err != nil {
 		log.Fatal(err)
 	}
 }